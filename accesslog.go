@@ -0,0 +1,124 @@
+package main
+
+//
+// Access logging.  With -access-log, each request is logged to stdout once
+// it's been answered, with its method, path, status, response size,
+// duration and client certificate CN, either as a combined-format line
+// with the duration in milliseconds appended, or as a JSON object.  With
+// -access-log-devices=redact or hash, device names are left out of logged
+// paths, or replaced by a hash, so the log can go where device names
+// shouldn't; the query string, which can name devices too, is then left
+// out altogether.
+//
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// An access log record, as JSON.
+type accessRecord struct {
+	Time     time.Time `json:"time"`
+	Remote   string    `json:"remote"`
+	Client   string    `json:"client"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Proto    string    `json:"proto"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Duration float64   `json:"duration_ms"`
+	Agent    string    `json:"user_agent,omitempty"`
+}
+
+// Returns a request's path as it's logged: with the device name left out
+// or hashed, and the query string dropped, unless devices is plain.
+func loggedPath(r *http.Request, devices string) string {
+
+	if devices == "plain" {
+		return r.URL.RequestURI()
+	}
+
+	rt, arg := findRoute(r.URL.Path)
+	switch {
+	case rt == nil || !rt.takesDevice() || arg == "":
+		return r.URL.Path
+	case devices == "hash":
+		sum := sha256.Sum256([]byte(arg))
+		return rt.path + hex.EncodeToString(sum[:8])
+	default:
+		return rt.path + "-"
+	}
+
+}
+
+// Returns the address a request came from, without the port.
+func remoteHost(r *http.Request) string {
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+
+}
+
+// Middleware logging each request once it's been answered, in format
+// combined or json.
+func accessLog(next http.Handler, format, devices string) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		rec := &accessRecord{
+			Time:     start,
+			Remote:   remoteHost(r),
+			Client:   clientCN(r),
+			Method:   r.Method,
+			Path:     loggedPath(r, devices),
+			Proto:    r.Proto,
+			Status:   sw.status,
+			Bytes:    sw.size,
+			Duration: float64(time.Since(start).Microseconds()) / 1000,
+			Agent:    r.UserAgent(),
+		}
+
+		var line []byte
+		if format == "json" {
+			line, _ = json.Marshal(rec)
+			line = append(line, '\n')
+		} else {
+			client, referer := rec.Client, r.Referer()
+			if client == "" {
+				client = "-"
+			}
+			if referer == "" {
+				referer = "-"
+			}
+			line = fmt.Appendf(nil, "%s - %s [%s] %q %d %d %q %q "+
+				"%.3f\n", rec.Remote, client,
+				start.Format("02/Jan/2006:15:04:05 -0700"),
+				rec.Method+" "+rec.Path+" "+rec.Proto,
+				rec.Status, rec.Bytes, referer, rec.Agent,
+				rec.Duration)
+		}
+
+		// One write per record, so concurrent requests' lines don't
+		// interleave.
+		os.Stdout.Write(line)
+
+	})
+
+}
@@ -13,17 +13,24 @@ package main
 import (
 	"bytes"
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
 	// Bolt is a simple key-value store.
 	"encoding/json"
+	"errors"
+	"flag"
 	"github.com/boltdb/bolt"
 	"io"
-	"io/ioutil"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 )
 
@@ -32,250 +39,1894 @@ var (
 	// First IP address to allocate.
 	ini = net.ParseIP("10.8.0.2").To4()
 
-	// Last IP address to allocate.  An attempt to allocate this address
-	// will fail.
+	// End of the compiled-in pool.  The pool stops short of it, as it
+	// looks like a broadcast address, so the last address allocated is
+	// the one before; with -end-inclusive it's allocated too.
 	fin = net.ParseIP("10.92.255.255").To4()
 )
 
+// Configuration options.
+type options struct {
+
+	// Client certificate CNs allowed to use admin endpoints.  If empty,
+	// and adminOUs too, any client may.
+	admins map[string]bool
+
+	// Client certificate OUs whose holders may use admin endpoints.
+	adminOUs map[string]bool
+
+	// Largest request body accepted, in bytes.
+	maxBody int64
+
+	// Allocate the lowest free address in the used part of the pool
+	// before extending it.
+	fillHoles bool
+
+	// Lease length; zero means leases never expire.
+	ttl time.Duration
+
+	// Percentage by which each lease's length is randomly varied.
+	ttlJitter float64
+
+	// Commands run when an address is allocated or released, and when
+	// the pool passes warnThreshold.
+	onAllocate string
+	onRelease  string
+	onPoolLow  string
+
+	// Percentage of the pool allocated at which to warn; zero for no
+	// warning.
+	warnThreshold float64
+
+	// Time a hook command may run before it's killed.
+	hookTimeout time.Duration
+
+	// Only accept device names which are DNS labels.
+	strictDevice bool
+
+	// Only accept device names which are safe as file names.
+	pathSafeDevice bool
+
+	// Where a client's tenant comes from: ou, header, or "" for no
+	// tenants.
+	tenantFrom string
+
+	// Network the pool belongs to, for netmasks in generated configs.
+	subnet *net.IPNet
+
+	// Test the allocation path on startup.
+	selfTesting bool
+
+	// Only allocate through /reserve, never on first sight of a device.
+	explicitOnly bool
+
+	// JSON file of device name to address, pinned on startup.
+	reservations string
+
+	// Time a freed address waits before it's reused.
+	reuseCooldown time.Duration
+
+	// Longest lease a request may ask for with ?ttl=.
+	maxTTL time.Duration
+
+	// A device belongs to the client identity which first gets it.
+	claims bool
+
+	// Clients other than admins are the device their certificate names.
+	authFromCert bool
+
+	// Reclaim the addresses of devices whose certificates have expired,
+	// checking -cert-inventory for renewals if given.
+	reclaimCerts  bool
+	certInventory string
+
+	// What to do with stored allocations outside the pool: serve,
+	// quarantine or reject.
+	outOfPool string
+
+	// Refuse to start if there are any.
+	strictPool bool
+
+	// What a released device asking for an address again gets:
+	// reallocate gives it a new one, gone a 410, for up to goneTTL if
+	// that's set.
+	afterRelease string
+	goneTTL      time.Duration
+
+	// Refuse /release/ and /renew/ without a lease ID.
+	requireLease bool
+
+	// Most devices allocated at once; zero for no limit.
+	maxDevices uint32
+
+	// With -claim, most devices a client CN may own; 0 for no limit.
+	maxPerClient uint32
+
+	// What to do if the database can't be written: serve read-only, or
+	// fail.
+	onReadOnly string
+
+	// Where events are logged as JSON, if anywhere.
+	eventLog slog.Handler
+
+	// Where events are streamed as JSON lines, if anywhere.
+	eventStream *eventStream
+
+	// Where events are POSTed, if anywhere.
+	webhooks *webhooks
+
+	// Directory to back the database up to, how often, and how many
+	// backups to keep; zero keeps all.
+	backupDir      string
+	backupInterval time.Duration
+	backupKeep     int
+
+	// Keep events in the database, for /audit.
+	auditing bool
+
+	// Skip the fsync on each commit, syncing every syncInterval instead.
+	relaxed bool
+
+	// Serve from an in-memory copy of the database, written back every
+	// flushInterval, or only on shutdown if that's zero.
+	inMemory      bool
+	flushInterval time.Duration
+
+	// With inMemory, the write-back, on the default pool's handler.
+	writeBack *writeBack
+
+	// Source of the current time.
+	clock clock
+
+	// How long answers to requests with an Idempotency-Key are kept;
+	// zero ignores the header.
+	idempotencyTTL time.Duration
+
+	// How long tombstones of removed allocations are kept; zero for
+	// ever.
+	tombstoneTTL time.Duration
+
+	// Serve profiles under /debug/pprof/.
+	pprof bool
+
+	// Most keys a listing walks before stopping; zero for no limit.
+	maxScan int
+
+	// Cache-Control header on /get/ answers.
+	cacheControl string
+
+	// Past allocations kept per device; zero keeps none.
+	historyLen int
+
+	// Domain device names are qualified with in hosts and zone exports.
+	domain string
+
+	// Check index entries against the records on lookup, and with heal,
+	// repair them: "", flag or heal.
+	verifyIndex string
+
+	// WireGuard server public key and endpoint, and the template for
+	// /wireguard/, nil unless both are given.
+	wgServerKey string
+	wgEndpoint  string
+	wgTemplate  *template.Template
+
+	// DNS servers and MTU for /ifconfig/; an MTU of zero is left out.
+	dns []net.IP
+	mtu int
+
+	// Write allocations with Bolt's Batch, sharing commits between
+	// concurrent requests.
+	batched bool
+}
+
 // State information.
 type Handler struct {
+	options
 
 	// Key-value store.
 	db *bolt.DB
 
-	// Next IP address to allocate.
-	next net.IP
+	// Names of the buckets state is kept in.
+	buckets *buckets
+
+	// Set once the database is open and state loaded.  Until then, as a
+	// cold standby, requests get a 503.
+	active atomic.Bool
+
+	// Set if the database can't be written.
+	readOnly atomic.Bool
+
+	// Name of the pool, and with -pools the device name prefix which
+	// selects it.
+	name   string
+	prefix string
+
+	// All the pools served, if this is one of them.
+	set *poolSet
+
+	// With -pools, the pool's own listener, if it has one.
+	listener *poolListener
+
+	// With -pools, blocks configured to be held on startup.
+	reserved []*net.IPNet
+
+	// Guards pool, next, used, highWater, nearExhaustion, cooling,
+	// blocks and blocked.
+	mu sync.Mutex
+
+	// Range allocated from.
+	pool *pool
+
+	// IPv6 network addresses are also given from, with -pool6.
+	pool6 *net.IPNet
+
+	// Position in the pool of the next address to allocate.  Equal to
+	// the pool size once it's been allocated to the end.
+	next uint32
+
+	// Addresses in the pool which are allocated.
+	used *bitmap
+
+	// Most addresses ever allocated at once.
+	highWater uint32
+
+	// Set while more of the pool than warnThreshold is allocated.
+	nearExhaustion bool
+
+	// Freed addresses not yet reusable, as positions in the pool, with
+	// when they become so.  Their bits in used stay set until then.
+	cooling map[uint32]time.Time
+
+	// Reserved blocks, and how many addresses are marked used on their
+	// account rather than a device's.
+	blocks  []*net.IPNet
+	blocked uint32
+
+	// Guards idemRunning.
+	idemMu sync.Mutex
+
+	// Client identity and Idempotency-Key of requests being served.
+	idemRunning map[string]bool
 }
 
-// From an IP address, calculate the 'next' one.
-func nextIP(a net.IP) {
-
-	a[3]++
-	if a[3] == 0 {
-		a[3] = 0
-		a[2]++
-		if a[2] == 0 {
-			a[2] = 0
-			a[1]++
-			if a[1] == 0 {
-				a[1] = 0
-				a[0]++
-			}
+// Picks a free address and marks it used.  Returns false if the pool is
+// exhausted.  Caller holds h.mu.
+func (h *Handler) claim() (net.IP, bool) {
+
+	// When filling holes, take the lowest free address below next.
+	if h.fillHoles {
+		if i, ok := h.used.firstClear(h.next); ok {
+			h.used.set(i)
+			return h.pool.address(i), true
 		}
 	}
 
+	// Skip addresses beyond next which were assigned explicitly.  As
+	// positions run through the segments in order, this moves on to the
+	// next segment when one is full.
+	size := h.pool.size()
+	for h.next < size && h.used.isSet(h.next) {
+		h.next++
+	}
+
+	if h.next >= size {
+		return nil, false
+	}
+
+	i := h.next
+	h.used.set(i)
+	h.next++
+
+	return h.pool.address(i), true
+
 }
 
-// HTTP request handler.
-func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// Records an allocation in the addresses bucket and the byip index,
+// stamping it as modified, and clears any tombstone for the device.
+func (h *Handler) putAllocation(tx *bolt.Tx, device string,
+	rec *record) error {
 
-	if r.URL.Path == "/all" {
-		h.ServeAll(w, r)
-		return
+	rec.Address = canonicalIP(rec.Address)
+	rec.Modified = h.now()
+	v, err := rec.encode()
+	if err != nil {
+		return err
 	}
 
-	if strings.HasPrefix(r.URL.Path, "/get/") {
-		h.ServeGet(w, r, strings.TrimPrefix(r.URL.Path, "/get/"))
-		return
+	err = tx.Bucket(h.buckets.addresses).Put([]byte(device), v)
+	if err != nil {
+		return err
 	}
 
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusNotFound)
-	io.WriteString(w, "Not found.")
-	return
+	err = h.noteModified(tx, rec.Modified)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket(h.buckets.byip).Put(rec.Address, []byte(device))
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(h.buckets.removed).Delete([]byte(device))
 
 }
 
-func (h *Handler) ServeAll(w http.ResponseWriter, r *http.Request) {
-	// Find next available IP address.
+// Records that a device has been seen now, without counting it as a
+// change to the allocation.
+func (h *Handler) touch(tx *bolt.Tx, device string, rec *record) error {
 
-	mappings := map[string]string{}
+	rec.LastSeen = h.now()
+	v, err := rec.encode()
+	if err != nil {
+		return err
+	}
 
-	h.db.Update(func(tx *bolt.Tx) error {
+	return tx.Bucket(h.buckets.addresses).Put([]byte(device), v)
 
-		// Create bucket
-		b, err := tx.CreateBucketIfNotExists([]byte("addresses"))
-		if err != nil {
-			log.Fatal(err)
+}
+
+// Removes an allocation from the addresses bucket and the byip index,
+// leaving a tombstone in the removed bucket and, with -history, an entry
+// in the device's history.
+func (h *Handler) deleteAllocation(tx *bolt.Tx, device string,
+	rec *record, cause string) error {
+
+	err := tx.Bucket(h.buckets.addresses).Delete([]byte(device))
+	if err != nil {
+		return err
+	}
+
+	err = h.noteHistory(tx, device, rec)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket(h.buckets.byip).Delete(canonicalIP(rec.Address))
+	if err != nil {
+		return err
+	}
+
+	now := h.now()
+	v, err := json.Marshal(&tombstone{
+		Device:  device,
+		Address: rec.Address,
+		Removed: now,
+		Cause:   cause,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket(h.buckets.removed).Put([]byte(device), v)
+	if err != nil {
+		return err
+	}
+
+	return h.noteModified(tx, now)
+
+}
+
+// Marks a specific address used, if it's in the pool and free.
+func (h *Handler) take(ip net.IP) bool {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.pool.contains(ip) || h.used.isSet(h.pool.index(ip)) {
+		return false
+	}
+	h.used.set(h.pool.index(ip))
+
+	return true
+
+}
+
+// Returns an address to the pool once its allocation has been removed.
+func (h *Handler) free(ip net.IP) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.pool.contains(ip) {
+		h.unuse(h.pool.index(ip))
+	}
+
+}
+
+// Picks the lowest free address in part of the pool, given as positions
+// from start up to but not including end, and marks it used.  Returns
+// false if that part is full.  Caller holds h.mu.
+func (h *Handler) claimIn(start, end uint32) (net.IP, bool) {
+
+	i, ok := h.used.firstClearIn(start, end)
+	if !ok {
+		return nil, false
+	}
+	h.used.set(i)
+
+	return h.pool.address(i), true
+
+}
+
+// Rebuilds next and the bitmap from the addresses bucket, and brings the
+// byip index into line with it.  Safe to call while serving, to pick up
+// changes made to the database behind the allocator's back; allocation is
+// held up only for the swap.
+func (h *Handler) scan() error {
+
+	p := h.currentPool()
+	var next uint32
+	used := newBitmap(p.size())
+	var highWater uint32
+	var cooling map[uint32]time.Time
+	var blocks []*net.IPNet
+	var blocked uint32
+
+	// Read-only, the state is loaded but nothing is repaired.
+	txn := h.db.Update
+	if h.isReadOnly() {
+		txn = h.db.View
+	}
+
+	err := txn(func(tx *bolt.Tx) error {
+
+		// Create buckets
+		var err error
+		if tx.Writable() {
+			err = h.createBuckets(tx)
+			if err != nil {
+				return err
+			}
+		}
+		b := tx.Bucket(h.buckets.addresses)
+		idx := tx.Bucket(h.buckets.byip)
+		if b == nil || idx == nil {
+			return errors.New("the database is read-only and " +
+				"has no allocations")
 		}
 
+		// Allocations outside the pool, from before it was
+		// reconfigured, to be quarantined or rejected.
+		outside := []allocation{}
+
+		// Records in older formats, to be upgraded.
+		outdated := []allocation{}
+
 		// Cursor on all keys.
 		c := b.Cursor()
 
 		// Loop through all keys.
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			var ip net.IP = v
-			mappings[string(k)] = ip.To4().String()
+
+			rec, err := decodeRecord(v)
+			if err != nil {
+				return fmt.Errorf("device %s: %s", k, err)
+			}
+			ip := rec.Address
+
+			fmt.Printf("Existing allocation: %s: %s\n",
+				k, ip.String())
+
+			// Next follows the last allocation in the pool.
+			if p.contains(ip) {
+				used.set(p.index(ip))
+				next = max(next, p.index(ip)+1)
+			} else if h.outOfPool == "serve" {
+				fmt.Printf("Device %s: %s is outside the "+
+					"pool, serving it anyway\n", k, ip)
+			} else {
+				outside = append(outside, allocation{
+					Device: string(k), record: *rec})
+			}
+
+			// Index entries missing or pointing elsewhere.
+			if !bytes.Equal(idx.Get(ip), k) && tx.Writable() {
+				err = idx.Put(ip, k)
+				if err != nil {
+					return err
+				}
+			}
+
+			if outdatedRecord(v) {
+				outdated = append(outdated, allocation{
+					Device: string(k), record: *rec})
+			}
+
+		}
+
+		// Rewrite records from before the binary format.
+		for i := range outdated {
+			if !tx.Writable() {
+				break
+			}
+			v, err := outdated[i].record.encode()
+			if err != nil {
+				return err
+			}
+			err = b.Put([]byte(outdated[i].Device), v)
+			if err != nil {
+				return err
+			}
+		}
+		if len(outdated) > 0 && tx.Writable() {
+			log.Printf("Pool %s: upgraded %d records to format %d",
+				h.name, len(outdated), recordVersion)
+		}
+
+		for _, a := range outside {
+			if !tx.Writable() {
+				break
+			}
+			err = h.dropOutside(tx, &a)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Drop index entries for devices which no longer hold the
+		// address, and those keyed by a 16-byte IPv4-mapped address,
+		// which was indexed in the canonical form above.
+		stale := [][]byte{}
+		c = idx.Cursor()
+		for k, v := c.First(); k != nil && tx.Writable(); k, v = c.Next() {
+			rec, err := h.getAllocation(tx, string(v))
+			if err != nil {
+				return err
+			}
+			if rec == nil || !bytes.Equal(rec.Address, k) {
+				stale = append(stale, k)
+			}
+		}
+		for _, k := range stale {
+			err = idx.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Addresses freed but still cooling down.
+		cooling, err = h.loadCooling(tx, p, used)
+		if err != nil {
+			return err
+		}
+
+		// Reserved blocks.
+		blocks, blocked, err = h.loadBlocks(tx, p, used)
+		if err != nil {
+			return err
 		}
 
+		// The high-water mark, which can't be below what's
+		// allocated now.
+		highWater = h.getHighWater(tx)
+		allocated := used.count - uint32(len(cooling)) - blocked
+		if allocated > highWater {
+			highWater = allocated
+		}
+		if highWater > h.getHighWater(tx) && tx.Writable() {
+			err = h.putHighWater(tx, highWater)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Swap the new state in.  Addresses are claimed in write
+		// transactions, which this one excludes, so no claim is in
+		// progress to be lost, and none can be made on the old state
+		// between here and the commit.
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.pool != p {
+			return errors.New("the pool was extended during the " +
+				"scan")
+		}
+		h.next = next
+		h.used = used
+		h.highWater = highWater
+		h.cooling = cooling
+		h.blocks = blocks
+		h.blocked = blocked
+
 		return nil
 	})
 
-	b, err := json.Marshal(mappings)
+	return err
+
+}
+
+// Reads the request body.  On failure an error response has been written
+// and false is returned.
+func (h *Handler) readBody(w http.ResponseWriter, r *http.Request) ([]byte,
+	bool) {
+
+	b, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Fatal("Couldn't marshal json: %s", err.Error())
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			writeError(w, r, http.StatusRequestEntityTooLarge,
+				"Request body too large.")
+		} else {
+			writeError(w, r, http.StatusBadRequest,
+				"Couldn't read request body.")
+		}
+		return nil, false
+	}
+
+	return b, true
+
+}
+
+// Returns allocations as a JSON object, device to address, or with
+// ?detail=true device to the whole record.  ?prefix= restricts it to
+// device names with that prefix, using a range scan, and ?glob= to names
+// matching a shell pattern.  Sorting, paging and the other formats are in
+// listing.go.  The walk is bounded by -max-scan; see scanlimit.go.
+func (h *Handler) ServeAll(w http.ResponseWriter, r *http.Request) {
+
+	l := listingFor(w, r)
+	if l == nil {
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	io.WriteString(w, string(b))
+	scan := h.scanFor(w, r)
+	if scan == nil {
+		return
+	}
+
+	if l.format == "text" && l.sort == "device" {
+		h.serveAllText(w, r, l, scan)
+		return
+	}
+
+	all := []allocation{}
+	var next []byte
+
+	// A read transaction: listing doesn't create the bucket if it's
+	// missing, there's just nothing to list.
+	err := h.db.View(func(tx *bolt.Tx) error {
+
+		// Loop through keys with the prefix.
+		var err error
+		next, err = scan.each(tx, h.buckets.addresses,
+			func(k, v []byte) error {
+				rec, err := decodeRecord(v)
+				if err != nil {
+					return err
+				}
+				if l.detail {
+					h.redact(r, h.scoped(r, string(k)),
+						rec)
+				}
+				all = append(all, allocation{string(k), *rec})
+				return nil
+			})
+
+		return err
+	})
+	if err != nil {
+		writeLookupFailed(w, r)
+		return
+	}
+	truncated(w, next)
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(all)))
+
+	page := l.page(all)
+	switch l.format {
+	case "csv":
+		l.writeCSV(w, page)
+	case "text":
+		writeAllText(w, page)
+	default:
+		l.writeJSON(w, page)
+	}
 	return
 
 }
 
+// Returns a device's address, allocating one if it's new.  The address is
+// dotted-decimal text, or with Accept: application/octet-stream the raw
+// address in network byte order: 4 bytes for IPv4, 16 for IPv6, so the
+// length gives the family.  With Accept: application/json it's an object
+// which also gives allocated_at, last_seen and age in seconds, so a caller
+// can tell how fresh the allocation is; as that changes on every request
+// it isn't cached, while the others carry an ETag.
 func (h *Handler) ServeGet(w http.ResponseWriter, r *http.Request,
 	device string) {
 
-	var addr string
-	found := false
+	if device == "" {
+		writeError(w, r, http.StatusBadRequest,
+			"No device name given, use /get/<device>.")
+		return
+	}
+
+	family := r.URL.Query().Get("family")
+	switch {
+	case family != "" && family != "4" && family != "6":
+		writeError(w, r, http.StatusBadRequest,
+			"Bad ?family=, use 4 or 6.")
+		return
+	case family == "6" && h.pool6 == nil:
+		writeError(w, r, http.StatusBadRequest,
+			"IPv6 addresses aren't given out without -pool6.")
+		return
+	}
+
+	rec, ok := h.getOrAllocate(w, r, device)
+	if !ok {
+		return
+	}
+	h.setLease(w, r, device, rec)
+
+	// The address answered with, unless the JSON answer is wanted.
+	addr := rec.Address
+	if family == "6" {
+		if rec.Address6 == nil {
+			writeFailed(w, r, errReadOnly)
+			return
+		}
+		addr = rec.Address6
+	}
+
+	if wantsJSON(r) {
+		now := h.now()
+		resp := map[string]interface{}{
+			"device":    h.bareDevice(device),
+			"address":   rec.Address.String(),
+			"last_seen": rec.lastSeen(),
+		}
+		if !rec.Allocated.IsZero() {
+			resp["allocated_at"] = rec.Allocated
+			resp["age"] = int64(now.Sub(rec.Allocated).Seconds())
+		}
+		if !rec.Expires.IsZero() {
+			resp["expires"] = rec.Expires
+		}
+		if rec.Lease != "" && h.mayView(r, device, rec) {
+			resp["lease"] = rec.Lease
+		}
+		if rec.Address6 != nil {
+			resp["address6"] = rec.Address6.String()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"),
+		"application/octet-stream") {
+		if !h.checkCache(w, r, device, addr.String(), "raw") {
+			return
+		}
+		raw := []byte(canonicalIP(addr))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write(raw)
+		return
+	}
+
+	if !h.checkCache(w, r, device, addr.String(), "text") {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, addr.String())
+	return
+
+}
+
+// Returns the reason given for an allocation, as ?reason= or in the
+// X-Alloc-Reason header.
+func allocationReason(r *http.Request) string {
+
+	if reason := r.URL.Query().Get("reason"); reason != "" {
+		return reason
+	}
+
+	return r.Header.Get("X-Alloc-Reason")
+
+}
+
+// Returns a device's allocation, allocating an address if it's new.  On
+// failure an error response has been written and false is returned.
+func (h *Handler) getOrAllocate(w http.ResponseWriter, r *http.Request,
+	device string) (*record, bool) {
 
-	// See if this address is already in the database.
-	err := h.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("addresses"))
-		v := b.Get([]byte(device))
-		if v != nil {
-			var v2 net.IP = v
-			addr = v2.To4().String()
-			fmt.Printf("Device %s: returning %s\n", device, addr)
-			found = true
+	if !h.deviceOK(w, r, device) {
+		return nil, false
+	}
+
+	ttl, ok := h.requestTTL(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	var rec *record
+	var gone *tombstone
+
+	// See if this address is already in the database.  Read-only, the
+	// last seen time isn't updated.  With ?ttl=, an existing lease is
+	// renewed in the same transaction.
+	txn := h.db.Update
+	if h.isReadOnly() {
+		txn = h.db.View
+	}
+	err := txn(func(tx *bolt.Tx) error {
+		var err error
+		rec, err = h.getAllocation(tx, device)
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			gone, err = h.released(tx, device)
+			return err
+		}
+		if rec != nil {
+			err = h.checkOwner(tx, r, device, rec)
+			if err != nil {
+				return err
+			}
+			if tx.Writable() && (ttl > 0 || h.lacks6(rec)) {
+				now := h.now()
+				rec.LastSeen = now
+				if ttl > 0 {
+					rec.Expires = h.leaseExpiry(now, ttl)
+				}
+				err = h.assign6(tx, rec)
+				if err != nil {
+					return err
+				}
+				err = h.putAllocation(tx, device, rec)
+			} else if tx.Writable() {
+				err = h.touch(tx, device, rec)
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Device %s: returning %s\n", device,
+				rec.Address)
 		}
 		return nil
 	})
 
 	// Handle failure with a 500 status.
+	if err == errNotOwner {
+		writeError(w, r, http.StatusForbidden,
+			"Device belongs to another identity.")
+		return nil, false
+	}
 	if err != nil {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusInternalServerError)
-		io.WriteString(w, "Database lookup failed.")
-		return
+		writeLookupFailed(w, r)
+		return nil, false
 	}
 
-	// If not found...
-	if !found {
+	if rec != nil {
+		return rec, true
+	}
 
-		// If we've run out of addresses, that's a 500 error.
-		if bytes.Compare(h.next, fin) == 0 {
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			w.WriteHeader(http.StatusInternalServerError)
-			io.WriteString(w, "Ran out of IP addresses.")
-			return
+	if gone != nil {
+		writeGone(w, r, gone)
+		return nil, false
+	}
+
+	if h.explicitOnly {
+		writeError(w, r, http.StatusNotFound,
+			"Device not found; addresses are only assigned with "+
+				"/reserve.")
+		return nil, false
+	}
+
+	if h.isReadOnly() {
+		writeFailed(w, r, errReadOnly)
+		return nil, false
+	}
+
+	return h.allocate(w, r, device, h.owner(r))
+
+}
+
+// Allocates an address for a device which doesn't have one, honouring
+// ?range=, ?prefer=, ?ttl= and ?reason=, and recording the owner given,
+// which is empty for an allocation which isn't claimed.  Writes an error
+// response on failure.
+func (h *Handler) allocate(w http.ResponseWriter, r *http.Request,
+	device, owner string) (*record, bool) {
+
+	ttl, ok := h.requestTTL(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	// With ?range=, the address has to come from that part of the pool.
+	within := r.URL.Query().Get("range")
+	var n *net.IPNet
+	if within != "" {
+		var err error
+		_, n, err = net.ParseCIDR(within)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest,
+				"Bad ?range=, expected a CIDR.")
+			return nil, false
+		}
+		if len(h.currentPool().windows(n)) == 0 {
+			writeError(w, r, http.StatusBadRequest,
+				"?range= doesn't overlap the pool.")
+			return nil, false
+		}
+	}
+
+	// With ?prefer=, that address if it's free, else any.
+	var prefer net.IP
+	if s := r.URL.Query().Get("prefer"); s != "" {
+		prefer = parseIPv4(s)
+		if prefer == nil {
+			writeError(w, r, http.StatusBadRequest,
+				"Bad ?prefer=, expected an IPv4 address.")
+			return nil, false
+		}
+		if n != nil && !n.Contains(prefer) {
+			prefer = nil
 		}
+	}
 
-		// Allocate new address.
-		addr = h.next.String()
-		fmt.Printf("Device %s: allocating: %s\n", device, addr)
+	desc, tags, ok := requestMetadata(w, r)
+	if !ok {
+		return nil, false
+	}
 
-		// Write address to database.
-		err = h.db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte("addresses"))
+	now := h.now()
+	rec := &record{
+		Allocated:   now,
+		Expires:     h.leaseExpiry(now, ttl),
+		Reason:      allocationReason(r),
+		Lease:       newLeaseID(),
+		Description: desc,
+		Tags:        tags,
+		Owner:       owner,
+	}
+	if owner != "" {
+		h.noteCert(r, rec)
+	}
+
+	// Claim an address and write it to the database.  With -batch the
+	// transaction may be shared with other requests' and, if one of
+	// them fails, run again, so an address claimed by an earlier run is
+	// given back first.  The device is looked up again in the same
+	// transaction, since a concurrent request for it may have allocated
+	// it an address since the lookup, which would otherwise be
+	// overwritten and leaked.
+	var ip net.IP
+	var found *record
+	write := func(tx *bolt.Tx) error {
+		if ip != nil {
+			h.free(ip)
+			ip = nil
+		}
+		found = nil
+		existing, err := h.getAllocation(tx, device)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			found = existing
+			if owner == "" {
+				return nil
+			}
+			return h.checkOwner(tx, r, device, existing)
+		}
+		err = h.checkLimit()
+		if err != nil {
+			return err
+		}
+		if h.maxPerClient > 0 && owner != "" {
+			owned, err := h.clientDevices(tx, rec.Owner)
 			if err != nil {
 				return err
 			}
-			err = b.Put([]byte(device), h.next)
+			err = h.checkClientLimit(owned)
 			if err != nil {
 				return err
 			}
+		}
+		var ok bool
+		if prefer != nil && h.take(prefer) {
+			ip, ok = prefer, true
+		} else {
+			ip, ok = h.claimWithin(n)
+		}
+		if !ok {
+			return errExhausted
+		}
+		rec.Address = ip
+		err = h.assign6(tx, rec)
+		if err != nil {
+			return err
+		}
+		err = h.putAllocation(tx, device, rec)
+		if err != nil {
+			return err
+		}
+		return h.notePeak(tx)
+	}
+
+	var err error
+	if h.batched {
+		err = h.db.Batch(write)
+	} else {
+		err = h.db.Update(write)
+	}
+
+	// Throw error if allocation failed, and give the address back.  If
+	// we've run out, that's a 500 error, or a 503 for a full ?range=.
+	if err != nil {
+		if ip != nil {
+			h.free(ip)
+		}
+		switch {
+		case err == errNotOwner:
+			writeError(w, r, http.StatusForbidden,
+				"Device belongs to another identity.")
+		case err == errTooMany:
+			h.writeTooMany(w, r)
+		case err == errClientTooMany:
+			h.writeClientTooMany(w, r)
+		case err == errExhausted && n != nil:
+			exhaustions.WithLabelValues(h.name).Inc()
+			writeError(w, r, http.StatusServiceUnavailable,
+				"No free addresses in "+within+".")
+		case err == errExhausted:
+			exhaustions.WithLabelValues(h.name).Inc()
+			writeError(w, r, http.StatusInternalServerError,
+				"Ran out of IP addresses.")
+		case err == errExhausted6:
+			writeError(w, r, http.StatusInternalServerError,
+				"Ran out of IPv6 addresses.")
+		default:
+			writeFailed(w, r, err)
+		}
+		return nil, false
+	}
 
-			return nil
+	if found != nil {
+		fmt.Printf("Device %s: returning %s\n", device, found.Address)
+		return found, true
+	}
 
-		})
+	// Allocate new address.
+	fmt.Printf("Device %s: allocating: %s\n", device, ip)
 
-		// Throw error if allocation failed.
-		if err != nil {
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			w.WriteHeader(http.StatusInternalServerError)
-			io.WriteString(w, "Database write failed.")
-			return
+	h.emit((&event{Type: eventAllocate, Device: device, Address: ip,
+		Reason: rec.Reason, Time: now}).by(r))
+
+	return rec, true
+
+}
+
+// Claims an address from the part of the pool in a network, or from
+// anywhere in the pool if it's nil.  Returns false if there's none free.
+func (h *Handler) claimWithin(n *net.IPNet) (net.IP, bool) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if n == nil {
+		return h.claim()
+	}
+
+	for _, sp := range h.pool.windows(n) {
+		if ip, ok := h.claimIn(sp.start, sp.end); ok {
+			return ip, true
 		}
+	}
 
-		// Address is allocated, increment next address.
-		nextIP(h.next)
+	return nil, false
+
+}
 
+// Returns pool size and utilisation from the bitmap.
+func (h *Handler) capacity() map[string]uint32 {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := map[string]uint32{
+		"size":       h.used.size,
+		"allocated":  h.deviceCount(),
+		"free":       h.used.free(),
+		"high_water": h.highWater,
+	}
+	if h.blocked > 0 {
+		c["blocked"] = h.blocked
+	}
+	if len(h.cooling) > 0 {
+		c["cooling"] = uint32(len(h.cooling))
+	}
+	if h.maxDevices > 0 {
+		c["max_devices"] = h.maxDevices
+		c["headroom"] = h.maxDevices - min(h.deviceCount(), h.maxDevices)
+	}
+
+	return c
+
+}
+
+// Reports pool size and utilisation.
+func (h *Handler) ServeCapacity(w http.ResponseWriter, r *http.Request) {
+
+	b, err := json.Marshal(h.capacity())
+	if err != nil {
+		log.Fatalf("Couldn't marshal json: %s", err.Error())
+		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+	return
+
+}
+
+// Rebuilds the in-memory allocation state from the database.
+func (h *Handler) ServeReconcile(w http.ResponseWriter, r *http.Request) {
+
+	err := h.scan()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError,
+			"Database scan failed.")
+		return
+	}
+	h.checkThreshold()
+
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	io.WriteString(w, addr)
+	io.WriteString(w, "Reconciled, next free address is "+
+		h.currentNext()+".")
 	return
 
 }
 
+// Moves the end of the pool up.
+func (h *Handler) ServeExtend(w http.ResponseWriter, r *http.Request) {
+
+	last := parseIPv4(r.URL.Query().Get("end"))
+	if last == nil {
+		writeError(w, r, http.StatusBadRequest,
+			"Give the new last address as ?end=<address>.")
+		return
+	}
+
+	err := h.extend(last)
+	if err != nil {
+		writeError(w, r, http.StatusConflict,
+			"Can't extend the pool: "+err.Error()+".")
+		return
+	}
+
+	fmt.Printf("Pool extended to %s\n", last)
+	h.checkThreshold()
+
+	h.ServeCapacity(w, r)
+
+}
+
 func main() {
 
-	// Get CA certs.
-	caCert, err := ioutil.ReadFile("/key/cert.ca")
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err := migrate(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	metricsListen := flag.String("metrics-listen", "",
+		"Address to serve /metrics, /healthz and /readyz on over "+
+			"plain HTTP as well, host:port, e.g. :9100")
+	listen := flag.String("listen", ":443",
+		"Address to listen on, host:port; give a host such as "+
+			"10.0.0.5:443 to listen on that interface only")
+	dbPath := flag.String("db", "/addresses/addr.db",
+		"Database file")
+	caFile := flag.String("ca-cert", "/key/cert.ca",
+		"CA certificates client certificates are verified against")
+	certFile := flag.String("server-cert", "/key/cert.allocator",
+		"Server certificate")
+	keyFile := flag.String("server-key", "/key/key.allocator",
+		"Server private key")
+	segments := flag.String("pool", "",
+		"Ranges to allocate from, comma-separated, each a CIDR or "+
+			"first-last, filled in the order given; defaults to "+
+			ini.String()+"-"+uintToIP(ipToUint(fin)-1).String())
+	pool6 := flag.String("pool6", "",
+		"IPv6 network, e.g. fd00:8::/64, to also give each device an "+
+			"address from, for dual stack")
+	endInclusive := flag.Bool("end-inclusive", false,
+		"Allocate the default pool's end, "+fin.String()+", too, "+
+			"rather than stopping at the address before; ranges "+
+			"given with -pool always include their last address")
+	poolStart := flag.String("pool-start", "",
+		"First address of the pool, with -pool-size, instead of -pool")
+	poolSize := flag.Uint64("pool-size", 0,
+		"Number of addresses in the pool, from -pool-start")
+	outOfPool := flag.String("out-of-pool", "serve",
+		"What to do on startup with stored allocations outside "+
+			"the pool, e.g. after shrinking it: serve keeps "+
+			"serving them, quarantine moves them to a quarantine "+
+			"bucket, reject deletes them")
+	maxBody := flag.Int64("max-body", 1<<20,
+		"Largest request body accepted, in bytes; larger ones get a 413")
+	fillHoles := flag.Bool("fill-holes", true,
+		"Allocate the lowest free address before extending the used "+
+			"range; false always allocates after the highest address")
+	readTimeout := flag.Duration("read-timeout", 10*time.Second,
+		"Time allowed to read a whole request, including the body")
+	readHeaderTimeout := flag.Duration("read-header-timeout",
+		5*time.Second, "Time allowed to read request headers")
+	writeTimeout := flag.Duration("write-timeout", 10*time.Second,
+		"Time allowed to write a response; raise for large /all "+
+			"responses over slow links")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute,
+		"Time an idle keep-alive connection is kept open")
+	keepAlive := flag.Bool("keep-alive", true,
+		"Keep HTTP/1.1 connections open between requests, so polling "+
+			"clients don't pay for a TLS handshake each time")
+	maxStreams := flag.Int("max-concurrent-streams", 250,
+		"Requests a client may have in flight over one HTTP/2 "+
+			"connection")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second,
+		"On SIGINT or SIGTERM, time allowed for requests in flight "+
+			"to finish before their connections are closed anyway")
+	handlerTimeout := flag.Duration("handler-timeout", 0,
+		"Time allowed to produce a response, after which the client "+
+			"gets a 503; unlike -write-timeout this doesn't limit "+
+			"sending it.  0 means no limit")
+	ttl := flag.Duration("ttl", 0,
+		"Lease length, after which an allocation is reclaimed; "+
+			"0 means leases never expire")
+	maxTTL := flag.Duration("max-ttl", 0,
+		"Longest lease a request may ask for with ?ttl=, e.g. for "+
+			"guest devices; defaults to -ttl")
+	ttlJitter := flag.Float64("ttl-jitter", 0,
+		"Vary each lease's length randomly by up to this percentage "+
+			"of -ttl, so a burst of allocations doesn't all expire "+
+			"at once")
+	admins := flag.String("admin", "",
+		"Comma-separated client certificate CNs allowed to use admin "+
+			"endpoints; if empty, and -admin-ou too, any client may")
+	adminOUs := flag.String("admin-ou", "",
+		"Comma-separated client certificate OUs whose holders may use "+
+			"admin endpoints, as well as the -admin CNs")
+	onAllocate := flag.String("on-allocate", "",
+		"Command run with device name and address whenever an "+
+			"address is allocated")
+	onRelease := flag.String("on-release", "",
+		"Command run with device name and address whenever an "+
+			"address is released")
+	onPoolLow := flag.String("on-pool-low", "",
+		"Command run with pool name and percentage allocated when "+
+			"the pool passes -warn-threshold")
+	warnThreshold := flag.Float64("warn-threshold", 0,
+		"Percentage of the pool allocated at which to warn, so it can "+
+			"be enlarged before it runs out; 0 for no warning")
+	eventLog := flag.String("event-log", "",
+		"File to log allocation events to, as JSON lines")
+	eventLogSize := flag.Int64("event-log-max-size", 100,
+		"Size in megabytes at which the event log is rotated")
+	eventLogBackups := flag.Int("event-log-backups", 5,
+		"Number of rotated event logs kept")
+	accessFormat := flag.String("access-log", "",
+		"Log each request to stdout, as combined, a combined-format "+
+			"line with the duration in milliseconds appended, or "+
+			"json")
+	accessDevices := flag.String("access-log-devices", "plain",
+		"How device names appear in the access log: plain, redact "+
+			"or hash; redact and hash also leave out query strings")
+	eventStream := flag.String("event-stream", "",
+		"Where to write events as JSON lines for a sidecar to follow: "+
+			"stdout, which moves other output to stderr, fd:<n> "+
+			"for an inherited descriptor, or a file")
+	webhook := flag.String("webhook", "",
+		"Comma-separated URLs each event is POSTed to as JSON")
+	webhookSecret := flag.String("webhook-secret", "",
+		"Secret signing -webhook requests with an HMAC-SHA256 in "+
+			"X-Addr-Alloc-Signature; ADDR_ALLOC_WEBHOOK_SECRET "+
+			"keeps it off the command line")
+	backupDir := flag.String("backup-dir", "",
+		"Directory to write database snapshots to, every "+
+			"-backup-interval")
+	backupInterval := flag.Duration("backup-interval", time.Hour,
+		"How often to back up to -backup-dir")
+	backupKeep := flag.Int("backup-keep", 24,
+		"Number of backups kept in -backup-dir; 0 keeps all")
+	hookTimeout := flag.Duration("hook-timeout", 30*time.Second,
+		"Time a hook command, such as -on-allocate, may run")
+	tenantFrom := flag.String("tenant", "",
+		"Give each tenant its own device names, taking the tenant from "+
+			"the client certificate's first OU (ou) or the "+
+			"X-Tenant header (header), which only a trusted proxy "+
+			"should set; empty for no tenants")
+	pathSafeDevice := flag.Bool("path-safe-device", false,
+		"Refuse device names containing \\ too, so they're safe to "+
+			"use as Windows file names; /, . and .. and control "+
+			"characters are always refused")
+	strictDevice := flag.Bool("strict-device-charset", false,
+		"Only accept device names which are DNS labels (a-z, 0-9 and "+
+			"-, at most 63 characters); recommended when names "+
+			"end up in DNS or VPN configs")
+	subnet := flag.String("subnet", "",
+		"VPN network, as a CIDR, from which generated configs take "+
+			"their netmask; defaults to the smallest network "+
+			"containing the pool")
+	verifyIndex := flag.String("verify-index", "",
+		"On /lookup, check the address index against the device's "+
+			"record, the authority: flag to log and count "+
+			"mismatches, or heal to repair them too")
+	dns := flag.String("dns", "",
+		"Comma-separated DNS server addresses for /ifconfig/")
+	mtu := flag.Int("mtu", 0,
+		"Interface MTU for /ifconfig/; 0 leaves it out")
+	wgServerKey := flag.String("wg-server-key", "",
+		"WireGuard server public key for /wireguard/ configs")
+	wgEndpoint := flag.String("wg-endpoint", "",
+		"WireGuard server endpoint, host:port, for /wireguard/ configs")
+	wgTemplate := flag.String("wg-template", "",
+		"File holding a Go text/template for /wireguard/ configs, "+
+			"instead of the built-in one")
+	reuseCooldown := flag.Duration("reuse-cooldown", 0,
+		"Time an address freed by a release, lease expiry, "+
+			"certificate reclaim or move waits before it's "+
+			"allocated again, so stale traffic for the old device "+
+			"doesn't reach a new one")
+	claims := flag.Bool("claim", false,
+		"A device belongs to the client certificate CN which first "+
+			"gets its address, and other clients get a 403 for it; "+
+			"admin endpoints aren't restricted")
+	authFromCert := flag.Bool("auth-from-cert", false,
+		"Clients other than admins are the device their certificate "+
+			"CN names, and only device endpoints for that device "+
+			"and a few about the pool are open to them; needs -admin")
+	reclaimCerts := flag.Bool("reclaim-expired-certs", false,
+		"With -claim, periodically release the addresses of devices "+
+			"whose owner's certificate has expired")
+	certInventory := flag.String("cert-inventory", "",
+		"PEM bundle of issued certificates; with "+
+			"-reclaim-expired-certs, an owner with an unexpired "+
+			"certificate in it keeps its devices")
+	reservations := flag.String("reservations", "",
+		"JSON file of device name to address, assigned on startup "+
+			"to devices without one")
+	explicit := flag.Bool("explicit-allocation", false,
+		"Only assign addresses through the admin /reserve endpoint; "+
+			"/get/ and the other self-service endpoints return "+
+			"404 for devices without one")
+	poolsFile := flag.String("pools", "",
+		"JSON file configuring further pools, each chosen by a "+
+			"device name prefix; see multipool.go")
+	namespace := flag.String("namespace", defaultNamespace,
+		"Name of the bucket allocations are kept in, and prefix of "+
+			"the allocator's other buckets, so several "+
+			"allocators can share a database file")
+	standby := flag.Bool("cold-standby", false,
+		"If the database is locked by another instance, answer 503 to "+
+			"everything but health checks and metrics, reads "+
+			"included, and take over when it exits, instead of "+
+			"blocking")
+	durability := flag.String("durability", "strict",
+		"strict fsyncs the database on every commit, so an "+
+			"allocation once answered survives a crash; relaxed "+
+			"fsyncs once a second, for much higher allocation "+
+			"throughput, but a crash can lose the last second's "+
+			"allocations and hand those addresses out again")
+	inMemory := flag.Bool("in-memory", false,
+		"Serve from an in-memory copy of the database, written back "+
+			"every -flush-interval and on shutdown; a crash loses "+
+			"the allocations since the last flush, and may hand "+
+			"those addresses out again")
+	flushInterval := flag.Duration("flush-interval", time.Minute,
+		"With -in-memory, how often the copy is written back to disk; "+
+			"0 for only on shutdown")
+	afterRelease := flag.String("after-release", "reallocate",
+		"What a device which has released its address gets if it asks "+
+			"again: reallocate gives it a new one, gone a 410 "+
+			"until an admin uses /forget/")
+	goneTTL := flag.Duration("gone-ttl", 0,
+		"With -after-release=gone, how long a release is remembered; "+
+			"0 for ever")
+	onReadOnly := flag.String("on-read-only", "serve",
+		"If the database can't be written, e.g. on a read-only mount: "+
+			"serve existing addresses and lookups, answering 503 "+
+			"to anything else, or fail to start")
+	maxDevices := flag.Uint("max-devices", 0,
+		"Most devices allocated at once, whatever the pool size, "+
+			"e.g. for licensing; more get 403; 0 for no limit")
+	maxPerClient := flag.Uint("max-devices-per-client", 0,
+		"With -claim, most devices one client certificate CN may "+
+			"own in a pool; more get 403; 0 for no limit")
+	rateLimitRate := flag.Float64("rate-limit", 0,
+		"Requests a second allowed each client certificate CN, "+
+			"beyond which they get 429; 0 for no limit")
+	rateBurst := flag.Int("rate-burst", 20,
+		"Requests a client may make at once under -rate-limit")
+	requireLease := flag.Bool("require-lease", false,
+		"Refuse /release/ and /renew/ without the lease ID handed out "+
+			"with the address, in the X-Lease-ID header")
+	strictPool := flag.Bool("strict-pool", false,
+		"Refuse to start if stored allocations lie outside the pool, "+
+			"e.g. after a mistyped -pool, instead of warning")
+	checkCert := flag.Bool("check-server-cert", true,
+		"On startup, check the server certificate matches its key and "+
+			"is signed by the client CA; turn off if the server's "+
+			"certificate comes from another CA")
+	tlsMinVersion := flag.String("tls-min-version", "1.2",
+		"Oldest TLS version accepted: 1.0, 1.1, 1.2 or 1.3")
+	tlsCiphers := flag.String("tls-cipher-suites", "",
+		"Comma-separated cipher suites allowed for TLS 1.2 and below, "+
+			"by Go name, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256; "+
+			"HTTP/2 needs an AES_128_GCM_SHA256 one; empty for Go's "+
+			"defaults")
+	idempotencyTTL := flag.Duration("idempotency-ttl", 24*time.Hour,
+		"How long the answer to a request with an Idempotency-Key is "+
+			"kept, to replay if it's retried; 0 to ignore the header")
+	tombstoneTTL := flag.Duration("tombstone-ttl", 90*24*time.Hour,
+		"How long a removed allocation is remembered, for /export "+
+			"?since= to report; releases refused by "+
+			"-after-release=gone are kept for -gone-ttl; 0 for ever")
+	auditing := flag.Bool("audit", false,
+		"Keep every event in the database, for /audit to query by "+
+			"time")
+	pprof := flag.Bool("pprof", false,
+		"Serve Go profiles to admins under /debug/pprof/")
+	maxScan := flag.Int("max-scan", 0,
+		"Most allocations /all or /mine walks before answering with "+
+			"what it has and X-Truncated, so ?after= can carry on; "+
+			"0 for no limit")
+	cacheControl := flag.String("cache-control", "private, no-cache",
+		"Cache-Control header on /get/ answers, which carry an ETag "+
+			"for If-None-Match; empty for none")
+	history := flag.Int("history", 0,
+		"Number of past addresses kept per device, for /history; "+
+			"0 keeps none")
+	domain := flag.String("domain", "",
+		"Domain to qualify device names with in hosts and zone "+
+			"exports, and to answer for with -dns-listen, e.g. "+
+			"vpn.example.com")
+	dnsListen := flag.String("dns-listen", "",
+		"Address to answer DNS queries for <device>.<-domain> on "+
+			"over UDP, host:port, e.g. :53")
+	dnsTTL := flag.Duration("dns-ttl", time.Minute,
+		"TTL of the records served with -dns-listen")
+	batch := flag.Bool("batch", false,
+		"Coalesce concurrent allocations into shared commits, for "+
+			"more throughput under load at the cost of a few "+
+			"milliseconds' latency each")
+	selfTest := flag.Bool("self-test", false,
+		"On startup, allocate, read back and release a throwaway "+
+			"address, and refuse to start if that fails")
+	flag.Parse()
+	err := flagsFromEnv()
 	if err != nil {
 		log.Fatal(err)
 	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
 
-	// Create TLS configuration.  Client certificates are mandatory.
-	tlsConfig := &tls.Config{
-		ClientCAs:  caCertPool,
-		ClientAuth: tls.RequireAndVerifyClientCert,
+	if *ttlJitter < 0 || *ttlJitter >= 100 {
+		log.Fatal("-ttl-jitter must be at least 0 and less than 100")
+	}
+	if *history < 0 {
+		log.Fatal("-history can't be negative")
+	}
+	if *warnThreshold < 0 || *warnThreshold > 100 {
+		log.Fatal("-warn-threshold must be from 0 to 100")
+	}
+	if *outOfPool != "serve" && *outOfPool != "quarantine" &&
+		*outOfPool != "reject" {
+		log.Fatal("-out-of-pool must be serve, quarantine or reject")
+	}
+	if *authFromCert && *admins == "" && *adminOUs == "" {
+		log.Fatal("-auth-from-cert needs -admin or -admin-ou, or " +
+			"every client would be an admin")
+	}
+	if *maxPerClient > 0 && !*claims {
+		log.Fatal("-max-devices-per-client needs -claim")
+	}
+	if *rateLimitRate < 0 {
+		log.Fatal("-rate-limit can't be negative")
+	}
+	if *rateLimitRate > 0 && *rateBurst < 1 {
+		log.Fatal("-rate-burst must be at least 1")
+	}
+	if *reclaimCerts && !*claims {
+		log.Fatal("-reclaim-expired-certs needs -claim")
+	}
+	if *certInventory != "" && !*reclaimCerts {
+		log.Fatal("-cert-inventory needs -reclaim-expired-certs")
+	}
+	if *backupDir != "" && *backupInterval <= 0 {
+		log.Fatal("-backup-interval must be positive")
+	}
+	if *backupKeep < 0 {
+		log.Fatal("-backup-keep can't be negative")
+	}
+	if *onReadOnly != "serve" && *onReadOnly != "fail" {
+		log.Fatal("-on-read-only must be serve or fail")
+	}
+	if *tenantFrom != "" && *tenantFrom != "ou" && *tenantFrom != "header" {
+		log.Fatal("-tenant must be ou or header")
+	}
+	if *afterRelease != "reallocate" && *afterRelease != "gone" {
+		log.Fatal("-after-release must be reallocate or gone")
+	}
+	if *durability != "strict" && *durability != "relaxed" {
+		log.Fatal("-durability must be strict or relaxed")
+	}
+	if *accessFormat != "" && *accessFormat != "combined" &&
+		*accessFormat != "json" {
+		log.Fatal("-access-log must be combined or json")
+	}
+	if *accessDevices != "plain" && *accessDevices != "redact" &&
+		*accessDevices != "hash" {
+		log.Fatal("-access-log-devices must be plain, redact or hash")
+	}
+	if *verifyIndex != "" && *verifyIndex != "flag" &&
+		*verifyIndex != "heal" {
+		log.Fatal("-verify-index must be flag or heal")
+	}
+	if *flushInterval < 0 {
+		log.Fatal("-flush-interval can't be negative")
+	}
+	if (*wgServerKey == "") != (*wgEndpoint == "") {
+		log.Fatal("-wg-server-key and -wg-endpoint go together")
+	}
+	if *wgServerKey != "" && !wireGuardKeyOK(*wgServerKey) {
+		log.Fatal("-wg-server-key must be a base64 WireGuard key")
+	}
+	if *wgTemplate != "" && *wgServerKey == "" {
+		log.Fatal("-wg-template needs -wg-server-key and -wg-endpoint")
 	}
-	tlsConfig.BuildNameToCertificate()
-
-	handler := &Handler{}
 
-	// Open database.
-	handler.db, err = bolt.Open("/addresses/addr.db", 0600, nil)
+	minVersion, err := parseTLSVersion(*tlsMinVersion)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("-tls-min-version: %s", err)
+	}
+	var ciphers []uint16
+	if *tlsCiphers != "" {
+		ciphers, err = parseCipherSuites(*tlsCiphers)
+		if err != nil {
+			log.Fatalf("-tls-cipher-suites: %s", err)
+		}
 	}
 
-	handler.next = ini
+	// Create TLS configuration, and load the server certificate and
+	// client CA certs.  Client certificates are mandatory.
+	tlsConfig := &tls.Config{
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		NextProtos:   []string{"h2", "http/1.1"},
+		MinVersion:   minVersion,
+		CipherSuites: ciphers,
+	}
+	creds, err := newTLSFiles(tlsConfig, *certFile, *keyFile, *caFile,
+		*checkCert)
+	if err != nil {
+		log.Fatalf("Server certificate: %s", err)
+	}
 
-	// Find next available IP address.
-	handler.db.Update(func(tx *bolt.Tx) error {
+	handler := &Handler{}
+	handler.clock = realClock{}
+	handler.pool = defaultPool(*endInclusive)
+	switch {
+	case *endInclusive && (*segments != "" || *poolStart != ""):
+		log.Fatal("-end-inclusive only applies to the default pool")
+	case *segments != "" && (*poolStart != "" || *poolSize != 0):
+		log.Fatal("Give -pool or -pool-start and -pool-size, not both")
+	case *segments != "":
+		handler.pool, err = parsePool(*segments)
+		if err != nil {
+			log.Fatalf("-pool: %s", err)
+		}
+	case *poolStart != "" && *poolSize != 0:
+		handler.pool, err = sizedPool(*poolStart, *poolSize)
+		if err != nil {
+			log.Fatalf("-pool-start, -pool-size: %s", err)
+		}
+	case *poolStart != "" || *poolSize != 0:
+		log.Fatal("-pool-start and -pool-size go together")
+	}
+	if *pool6 != "" {
+		handler.pool6, err = parsePool6(*pool6)
+		if err != nil {
+			log.Fatalf("-pool6: %s", err)
+		}
+	}
+	handler.buckets = newBuckets(*namespace)
+	handler.admins = map[string]bool{}
+	for _, cn := range strings.Split(*admins, ",") {
+		if cn != "" {
+			handler.admins[cn] = true
+		}
+	}
+	handler.adminOUs = map[string]bool{}
+	for _, ou := range strings.Split(*adminOUs, ",") {
+		if ou != "" {
+			handler.adminOUs[ou] = true
+		}
+	}
+	handler.maxBody = *maxBody
+	handler.fillHoles = *fillHoles
+	handler.ttl = *ttl
+	handler.ttlJitter = *ttlJitter
+	handler.maxTTL = *maxTTL
+	handler.claims = *claims
+	handler.authFromCert = *authFromCert
+	handler.reclaimCerts = *reclaimCerts
+	handler.certInventory = *certInventory
+	handler.outOfPool = *outOfPool
+	handler.strictPool = *strictPool
+	handler.afterRelease = *afterRelease
+	handler.goneTTL = *goneTTL
+	handler.requireLease = *requireLease
+	handler.maxDevices = uint32(*maxDevices)
+	handler.maxPerClient = uint32(*maxPerClient)
+	handler.onReadOnly = *onReadOnly
+	handler.backupDir = *backupDir
+	handler.backupInterval = *backupInterval
+	handler.backupKeep = *backupKeep
+	handler.auditing = *auditing
+	handler.onAllocate = *onAllocate
+	handler.onRelease = *onRelease
+	handler.onPoolLow = *onPoolLow
+	handler.warnThreshold = *warnThreshold
+	handler.hookTimeout = *hookTimeout
+	handler.strictDevice = *strictDevice
+	handler.pathSafeDevice = *pathSafeDevice
+	handler.tenantFrom = *tenantFrom
+	handler.selfTesting = *selfTest
+	handler.explicitOnly = *explicit
+	handler.reservations = *reservations
+	handler.reuseCooldown = *reuseCooldown
+	if *eventLog != "" {
+		w, err := newRotator(*eventLog, *eventLogSize<<20,
+			*eventLogBackups)
+		if err != nil {
+			log.Fatalf("-event-log: %s", err)
+		}
+		handler.eventLog = slog.NewJSONHandler(w, nil)
+	}
+	if *eventStream != "" {
+		handler.eventStream, err = openEventStream(*eventStream)
+		if err != nil {
+			log.Fatalf("-event-stream: %s", err)
+		}
+	}
+	if *webhook != "" {
+		urls := []string{}
+		for _, s := range strings.Split(*webhook, ",") {
+			u, err := url.Parse(strings.TrimSpace(s))
+			if err != nil || (u.Scheme != "http" &&
+				u.Scheme != "https") || u.Host == "" {
+				log.Fatalf("-webhook: bad URL %s", s)
+			}
+			urls = append(urls, u.String())
+		}
+		handler.webhooks = newWebhooks(urls, *webhookSecret)
+	} else if *webhookSecret != "" {
+		log.Fatal("-webhook-secret needs -webhook")
+	}
+	handler.relaxed = *durability == "relaxed"
+	handler.inMemory = *inMemory
+	handler.flushInterval = *flushInterval
+	handler.batched = *batch
+	handler.historyLen = *history
+	handler.cacheControl = *cacheControl
+	handler.maxScan = *maxScan
+	handler.pprof = *pprof
+	handler.idempotencyTTL = *idempotencyTTL
+	handler.tombstoneTTL = *tombstoneTTL
+	if *pprof {
+		enableProfiling()
+	}
+	handler.domain = strings.TrimSuffix(*domain, ".")
+	if *dns != "" {
+		for _, s := range strings.Split(*dns, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil {
+				log.Fatalf("-dns: bad address %s", s)
+			}
+			handler.dns = append(handler.dns, ip)
+		}
+	}
+	if *mtu < 0 || *mtu > 65535 {
+		log.Fatal("-mtu must be between 0 and 65535")
+	}
+	handler.mtu = *mtu
+	if *wgServerKey != "" {
+		handler.wgServerKey = *wgServerKey
+		handler.wgEndpoint = *wgEndpoint
+		name, text := "wireguard", defaultWireGuardTemplate
+		if *wgTemplate != "" {
+			b, err := os.ReadFile(*wgTemplate)
+			if err != nil {
+				log.Fatalf("-wg-template: %s", err)
+			}
+			name, text = *wgTemplate, string(b)
+		}
+		handler.wgTemplate, err = parseWireGuardTemplate(name, text)
+		if err != nil {
+			log.Fatalf("-wg-template: %s", err)
+		}
+	}
+	handler.verifyIndex = *verifyIndex
+	if *subnet != "" {
+		_, handler.subnet, err = net.ParseCIDR(*subnet)
+		if err != nil {
+			log.Fatalf("-subnet: %s", err)
+		}
+	}
 
-		// Create bucket
-		b, err := tx.CreateBucketIfNotExists([]byte("addresses"))
+	pools := newPoolSet(handler)
+	if *poolsFile != "" {
+		err = pools.load(*poolsFile)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("-pools: %s", err)
 		}
+	}
 
-		// Cursor on all keys.
-		c := b.Cursor()
+	for _, h := range pools.handlers {
+		registerPoolMetrics(h)
+	}
+	pools.banner(*listen, *dbPath, *standby)
+	ciphersLogged := "default"
+	if *tlsCiphers != "" {
+		ciphersLogged = *tlsCiphers
+	}
+	slog.Info("TLS", "min_version", *tlsMinVersion,
+		"cipher_suites", ciphersLogged, "ca_cert", *caFile,
+		"server_cert", *certFile, "server_key", *keyFile)
+	slog.Info("Access log", "format", *accessFormat,
+		"devices", *accessDevices)
+	slog.Info("Rate limit", "rate", *rateLimitRate, "burst", *rateBurst)
+	slog.Info("Metrics", "listen", *metricsListen)
+	slog.Info("DNS", "listen", *dnsListen, "domain", handler.domain,
+		"ttl", dnsTTL.String())
 
-		// Loop through all keys.
-		for k, v := c.First(); k != nil; k, v = c.Next() {
+	// Bind before opening the database, so a bad -listen fails straight
+	// away rather than after the scan.
+	if _, _, err := net.SplitHostPort(*listen); err != nil {
+		log.Fatalf("-listen: %s", err)
+	}
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("-listen: %s", err)
+	}
 
-			var ip net.IP = v
-			ip = ip.To4()
+	pools.creds = append(pools.creds, creds)
 
-			fmt.Printf("Existing allocation: %s: %s\n",
-				k, ip.String())
+	// Pools with listeners of their own.
+	type poolServer struct {
+		ln      net.Listener
+		handler http.Handler
+		tls     *tls.Config
+	}
+	poolServers := []poolServer{}
+	for _, p := range pools.handlers[1:] {
+		if p.listener == nil {
+			continue
+		}
+		pc, err := p.listener.credentials(creds)
+		if err != nil {
+			log.Fatalf("Pool %s: %s", p.name, err)
+		}
+		pools.creds = append(pools.creds, pc)
+		pln, err := net.Listen("tcp", p.listener.addr)
+		if err != nil {
+			log.Fatalf("Pool %s: %s", p.name, err)
+		}
+		poolServers = append(poolServers,
+			poolServer{pln, pools.only(p), pc.config()})
+	}
 
-			// Look for a higher key than the last seen.
-			if bytes.Compare(ip, handler.next) >= 0 {
-				handler.next = net.IPv4(ip[0], ip[1], ip[2],
-					ip[3]).To4()
+	var metricsLn net.Listener
+	if *metricsListen != "" {
+		if _, _, err := net.SplitHostPort(*metricsListen); err != nil {
+			log.Fatalf("-metrics-listen: %s", err)
+		}
+		metricsLn, err = net.Listen("tcp", *metricsListen)
+		if err != nil {
+			log.Fatalf("-metrics-listen: %s", err)
+		}
+	}
 
-				// Increment highest key to make next available
-				// free.
-				nextIP(handler.next)
-			}
+	var dnsConn net.PacketConn
+	if *dnsListen != "" {
+		if handler.domain == "" {
+			log.Fatal("-dns-listen needs -domain")
+		}
+		if *dnsTTL < time.Second {
+			log.Fatal("-dns-ttl must be at least 1s")
+		}
+		if _, _, err := net.SplitHostPort(*dnsListen); err != nil {
+			log.Fatalf("-dns-listen: %s", err)
+		}
+		dnsConn, err = net.ListenPacket("udp", *dnsListen)
+		if err != nil {
+			log.Fatalf("-dns-listen: %s", err)
+		}
+	}
 
+	// Open database.  As a cold standby, that means waiting for the
+	// active instance to let go of it, serving 503s meanwhile.
+	if *standby {
+		go func() {
+			err := pools.open(*dbPath, true)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}()
+	} else {
+		err = pools.open(*dbPath, false)
+		if err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		return nil
-	})
+	// Rescan the database on SIGHUP.
+	go pools.reloadOnHUP()
 
-	fmt.Printf("Next free address is %s\n", handler.next.String())
+	// Start HTTPS servers.  The credentials come from the TLS
+	// configuration, so they can be reloaded.
+	servers := []*http.Server{}
+	limiter := newRateLimiter(*rateLimitRate, *rateBurst)
+	serve := func(ln net.Listener, h http.Handler, tc *tls.Config) {
+		if *handlerTimeout > 0 {
+			h = http.TimeoutHandler(h, *handlerTimeout,
+				"Timed out producing a response.")
+		}
+		if *rateLimitRate > 0 {
+			h = rateLimit(h, limiter)
+		}
+		h = instrument(h)
+		if *accessFormat != "" {
+			h = accessLog(h, *accessFormat, *accessDevices)
+		}
+		s := &http.Server{
+			Addr:              ln.Addr().String(),
+			Handler:           h,
+			ReadTimeout:       *readTimeout,
+			ReadHeaderTimeout: *readHeaderTimeout,
+			WriteTimeout:      *writeTimeout,
+			IdleTimeout:       *idleTimeout,
+			MaxHeaderBytes:    1 << 20,
+			TLSConfig:         tc,
+			ConnState:         trackConn,
+			HTTP2: &http.HTTP2Config{
+				MaxConcurrentStreams: *maxStreams,
+			},
+		}
+		s.SetKeepAlivesEnabled(*keepAlive)
+		servers = append(servers, s)
+		go func() {
+			err := s.ServeTLS(ln, "", "")
+			if err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
 
-	// Start HTTPS server.
-	s := &http.Server{
-		Addr:           ":443",
-		Handler:        handler,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
-		TLSConfig:      tlsConfig,
+	serve(ln, pools, creds.config())
+	for _, ps := range poolServers {
+		serve(ps.ln, ps.handler, ps.tls)
 	}
-	log.Fatal(s.ListenAndServeTLS("/key/cert.allocator",
-		"/key/key.allocator"))
+	if metricsLn != nil {
+		servers = append(servers,
+			serveMetrics(metricsLn, handler, *readHeaderTimeout))
+	}
+	if dnsConn != nil {
+		go serveDNS(dnsConn, pools, handler.domain,
+			uint32(*dnsTTL/time.Second))
+	}
+
+	handler.awaitShutdown(servers, *shutdownTimeout)
 
 }
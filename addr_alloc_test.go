@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// Requests /get/ for each device at once, each from its own goroutine,
+// returning the status and body of each response in order.
+func getConcurrently(t *testing.T, h *Handler, devices []string) ([]int,
+	[]string) {
+
+	t.Helper()
+
+	codes := make([]int, len(devices))
+	bodies := make([]string, len(devices))
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, d := range devices {
+		wg.Add(1)
+		go func(i int, d string) {
+			defer wg.Done()
+			<-start
+			w := do(t, h, "GET", "/get/"+d, "dev1", "")
+			codes[i], bodies[i] = w.Code, w.Body.String()
+		}(i, d)
+	}
+	close(start)
+	wg.Wait()
+
+	return codes, bodies
+
+}
+
+// Checks the database holds exactly the allocations given, device to
+// address, and that the in-memory state agrees with it.
+func checkAllocations(t *testing.T, h *Handler, want map[string]string) {
+
+	t.Helper()
+
+	got := map[string]string{}
+	err := json.Unmarshal([]byte(expect(t, h, "GET", "/all", "dev1",
+		http.StatusOK)), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Errorf("/all: got %d allocations, want %d", len(got),
+			len(want))
+	}
+	for d, a := range want {
+		if got[d] != a {
+			t.Errorf("/all: %s: got %q, want %q", d, got[d], a)
+		}
+	}
+
+	h.mu.Lock()
+	n := h.deviceCount()
+	h.mu.Unlock()
+	if int(n) != len(want) {
+		t.Errorf("in memory: got %d allocations, want %d", n, len(want))
+	}
+
+}
+
+// Requests the devices at once, checking each device got one address and
+// no address went to two devices, and that wantCount allocations were made
+// and all are in the database.
+func checkConcurrent(t *testing.T, h *Handler, devices []string,
+	wantCount int) {
+
+	t.Helper()
+
+	codes, bodies := getConcurrently(t, h, devices)
+
+	want := map[string]string{}
+	holder := map[string]string{}
+	for i, d := range devices {
+		if codes[i] != http.StatusOK {
+			continue
+		}
+		a := bodies[i]
+		if prev, ok := want[d]; ok && prev != a {
+			t.Errorf("%s: got %s and %s", d, prev, a)
+		}
+		if other, ok := holder[a]; ok && other != d {
+			t.Errorf("%s: given to %s and %s", a, other, d)
+		}
+		want[d], holder[a] = a, d
+	}
+	if len(want) != wantCount {
+		t.Errorf("got %d allocations, want %d", len(want), wantCount)
+	}
+
+	checkAllocations(t, h, want)
+
+}
+
+// Returns n device names, each repeated r times.
+func deviceNames(n, r int) []string {
+
+	devices := []string{}
+	for j := 0; j < r; j++ {
+		for i := 0; i < n; i++ {
+			devices = append(devices, fmt.Sprintf("dev%d", i))
+		}
+	}
+
+	return devices
+
+}
+
+// With -batch, concurrent allocations coalesced into shared transactions
+// each get their own address, none is lost, and a device requested twice
+// at once gets one.  Past the end of the pool, the surplus requests fail
+// and nothing is over-allocated.
+func TestBatchedAllocation(t *testing.T) {
+
+	tests := []struct {
+		devices int
+		repeats int
+		want    int
+	}{
+		{1, 1, 1},
+		{100, 1, 100},
+		{100, 2, 100},
+		{254, 1, 254},
+		{300, 1, 254},
+	}
+
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%dx%d", tc.devices, tc.repeats),
+			func(t *testing.T) {
+				h := newTestHandler(t, func(h *Handler) {
+					h.batched = true
+				})
+				checkConcurrent(t, h,
+					deviceNames(tc.devices, tc.repeats), tc.want)
+			})
+	}
+
+}
+
+// Returns the ID of the last write transaction committed.
+func lastWrite(t *testing.T, h *Handler) int {
+
+	t.Helper()
+
+	var id int
+	err := h.db.View(func(tx *bolt.Tx) error {
+		id = tx.ID()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+
+}
+
+// On a database with no allocations bucket, /all lists nothing, as {},
+// without writing to the database or creating the bucket.
+func TestAllEmpty(t *testing.T) {
+
+	h := newTestHandler(t, nil)
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(h.buckets.addresses)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/all", "/all?detail=true",
+		"/all?prefix=a"} {
+		before := lastWrite(t, h)
+		body := expect(t, h, "GET", target, "dev1", http.StatusOK)
+		if strings.TrimSpace(body) != "{}" {
+			t.Errorf("%s: got %q, want {}", target, body)
+		}
+		if after := lastWrite(t, h); after != before {
+			t.Errorf("%s: wrote transaction %d", target, after)
+		}
+	}
+
+	err = h.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(h.buckets.addresses) != nil {
+			t.Error("/all created the bucket")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+// Concurrent requests for new devices each get their own address, and
+// concurrent requests for the same device all get the one address.
+func TestConcurrentAllocation(t *testing.T) {
+
+	tests := []struct {
+		devices int
+		repeats int
+		want    int
+	}{
+		{50, 1, 50},
+		{50, 4, 50},
+		{1, 50, 1},
+		{254, 1, 254},
+		{260, 1, 254},
+	}
+
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%dx%d", tc.devices, tc.repeats),
+			func(t *testing.T) {
+				h := newTestHandler(t, nil)
+				checkConcurrent(t, h,
+					deviceNames(tc.devices, tc.repeats), tc.want)
+			})
+	}
+
+}
+
+// Hammered with allocations and releases of overlapping devices at once,
+// the handler never gives an address to two devices, and its in-memory
+// state matches what a rebuild from the database finds.
+func TestConcurrentAllocateRelease(t *testing.T) {
+
+	h := newTestHandler(t, nil)
+
+	const workers, rounds, devices = 20, 25, 30
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				d := fmt.Sprintf("dev%d", (i*7+j)%devices)
+				if (i+j)%3 == 0 {
+					do(t, h, "POST", "/release/"+d, "dev1", "")
+				} else {
+					do(t, h, "GET", "/get/"+d, "dev1", "")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	all := map[string]string{}
+	err := json.Unmarshal([]byte(expect(t, h, "GET", "/all", "dev1",
+		http.StatusOK)), &all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder := map[string]string{}
+	for d, a := range all {
+		if other, ok := holder[a]; ok {
+			t.Errorf("%s: given to %s and %s", a, other, d)
+		}
+		holder[a] = d
+	}
+
+	state := func() (uint32, uint32) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.deviceCount(), h.used.count
+	}
+	n, used := state()
+	if int(n) != len(all) {
+		t.Errorf("in memory: %d allocations, database %d", n, len(all))
+	}
+	if err := h.scan(); err != nil {
+		t.Fatal(err)
+	}
+	if n2, used2 := state(); n2 != n || used2 != used {
+		t.Errorf("rebuilt: %d allocations and %d used, were %d and %d",
+			n2, used2, n, used)
+	}
+
+}
@@ -0,0 +1,319 @@
+package main
+
+//
+// addrctl, a command line client for the address allocator's admin
+// operations:
+//
+//   addrctl get <device>
+//   addrctl list
+//   addrctl lookup <address>
+//   addrctl release <device>
+//   addrctl reserve <device> <address>
+//   addrctl backup <file>
+//
+// The allocator's URL and the TLS credentials are read from a JSON config
+// file, by default ~/.addrctl.json:
+//
+//   {"url": "https://alloc.example.com", "cert": "/etc/addrctl/cert.pem",
+//    "key": "/etc/addrctl/key.pem", "ca": "/etc/addrctl/ca.pem"}
+//
+// and flags override them.  Answers are printed as a table, or as JSON with
+// -json.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cybermaggedon/addr-alloc/client"
+)
+
+// Time allowed for a command, other than a backup.
+const timeout = 30 * time.Second
+
+// The config file.
+type config struct {
+
+	// Allocator's base URL.
+	URL string `json:"url"`
+
+	// Client certificate and key, and the CA for the server's
+	// certificate, PEM files.  The system's CAs are trusted if CA is
+	// empty.
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	CA   string `json:"ca,omitempty"`
+}
+
+// Reads the config file.  A missing file is only an error if it was named.
+func readConfig(path string, named bool) (*config, error) {
+
+	c := &config{}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !named {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return c, nil
+
+}
+
+// Writes an answer as JSON if asJSON is set, else as a table of the rows
+// given, under a heading.
+func output(asJSON bool, v interface{}, heading []string,
+	rows [][]string) error {
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, row := range append([][]string{heading}, rows...) {
+		for i, cell := range row {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, cell)
+		}
+		fmt.Fprintln(tw)
+	}
+
+	return tw.Flush()
+
+}
+
+// Writes a single device and address.
+func outputDevice(asJSON bool, device string, ip net.IP) error {
+
+	return output(asJSON, map[string]string{
+		"device":  device,
+		"address": ip.String(),
+	}, []string{"DEVICE", "ADDRESS"}, [][]string{{device, ip.String()}})
+
+}
+
+func usage() {
+
+	fmt.Fprintf(os.Stderr, `Usage: addrctl [flags] <command> [args]
+
+Commands:
+  get <device>                 Return a device's address, allocating if new
+  list                         List every device's address
+  lookup <address>             Return the device holding an address
+  release <device>             Release a device's address
+  reserve <device> <address>   Assign an address to a new device
+  backup <file>                Save a snapshot of the database
+
+Flags:
+`)
+	flag.PrintDefaults()
+
+}
+
+// Parses an address argument.
+func parseIP(s string) (net.IP, error) {
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("bad address %s", s)
+	}
+
+	return ip, nil
+
+}
+
+// Runs a command.
+func run(c *client.Client, asJSON bool, args []string) error {
+
+	ctx := context.Background()
+	if args[0] != "backup" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	want := map[string]int{"get": 1, "list": 0, "lookup": 1,
+		"release": 1, "reserve": 2, "backup": 1}
+	n, ok := want[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %s", args[0])
+	}
+	if len(args)-1 != n {
+		return fmt.Errorf("%s takes %d arguments", args[0], n)
+	}
+
+	switch args[0] {
+
+	case "get":
+		ip, err := c.Get(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		return outputDevice(asJSON, args[1], ip)
+
+	case "list":
+		all, err := c.All(ctx)
+		if err != nil {
+			return err
+		}
+		devices := []string{}
+		for device := range all {
+			devices = append(devices, device)
+		}
+		sort.Strings(devices)
+		rows := [][]string{}
+		for _, device := range devices {
+			rows = append(rows, []string{device,
+				all[device].String()})
+		}
+		return output(asJSON, all, []string{"DEVICE", "ADDRESS"},
+			rows)
+
+	case "lookup":
+		ip, err := parseIP(args[1])
+		if err != nil {
+			return err
+		}
+		device, err := c.Lookup(ctx, ip)
+		if err != nil {
+			return err
+		}
+		return outputDevice(asJSON, device, ip)
+
+	case "release":
+		ip, err := c.Release(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		return outputDevice(asJSON, args[1], ip)
+
+	case "reserve":
+		ip, err := parseIP(args[2])
+		if err != nil {
+			return err
+		}
+		ip, err = c.Reserve(ctx, args[1], ip)
+		if err != nil {
+			return err
+		}
+		return outputDevice(asJSON, args[1], ip)
+
+	case "backup":
+		return backup(ctx, c, args[1])
+
+	}
+
+	return nil
+
+}
+
+// Saves a backup to a file, written alongside and renamed into place so a
+// failed backup doesn't leave a partial file.
+func backup(ctx context.Context, c *client.Client, path string) error {
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".addrctl-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	n, err := c.Backup(ctx, f)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Saved %d bytes to %s\n", n, path)
+
+	return nil
+
+}
+
+func main() {
+
+	home, _ := os.UserHomeDir()
+	dflt := filepath.Join(home, ".addrctl.json")
+
+	configFile := flag.String("config", dflt, "Config file")
+	base := flag.String("url", "", "Allocator URL, overriding the config")
+	cert := flag.String("cert", "",
+		"Client certificate file, overriding the config")
+	key := flag.String("key", "", "Client key file, overriding the config")
+	ca := flag.String("ca", "", "Server CA file, overriding the config")
+	asJSON := flag.Bool("json", false, "Print answers as JSON")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	named := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			named = true
+		}
+	})
+	cfg, err := readConfig(*configFile, named)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "addrctl: %s\n", err)
+		os.Exit(1)
+	}
+	for _, o := range []struct {
+		flag  string
+		field *string
+	}{{*base, &cfg.URL}, {*cert, &cfg.Cert}, {*key, &cfg.Key},
+		{*ca, &cfg.CA}} {
+		if o.flag != "" {
+			*o.field = o.flag
+		}
+	}
+	if cfg.URL == "" || cfg.Cert == "" || cfg.Key == "" {
+		fmt.Fprintln(os.Stderr, "addrctl: the allocator URL, client "+
+			"certificate and key must be configured")
+		os.Exit(2)
+	}
+
+	c, err := client.New(cfg.URL, cfg.Cert, cfg.Key, cfg.CA)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "addrctl: %s\n", err)
+		os.Exit(1)
+	}
+
+	err = run(c, *asJSON, flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "addrctl: %s\n", err)
+		os.Exit(1)
+	}
+
+}
@@ -0,0 +1,122 @@
+package main
+
+//
+// Allocations as an aligned text table, for monitoring which can't parse
+// JSON or Prometheus but can grep and awk.  In device order, the default,
+// the table is streamed from a read transaction rather than built in
+// memory, so a large listing costs no more than its widest name.
+//
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Stops the walk writing rows once the page is done.
+var errPageDone = errors.New("page done")
+
+// Writes an allocation as a line of device, address and allocation time
+// columns, with a time of - for records from before it was kept.
+func writeTextRow(w io.Writer, width int, a *allocation) {
+
+	at := "-"
+	if !a.Allocated.IsZero() {
+		at = a.Allocated.UTC().Format(time.RFC3339)
+	}
+	fmt.Fprintf(w, "%-*s  %-15s  %s\n", width, a.Device, a.Address, at)
+
+}
+
+// Writes allocations one per line, with the device column as wide as the
+// longest device name.
+func writeAllText(w http.ResponseWriter, all []allocation) {
+
+	width := 0
+	for _, a := range all {
+		width = max(width, len(a.Device))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	for i := range all {
+		writeTextRow(out, width, &all[i])
+	}
+
+}
+
+// Answers /all?format=text in device order, in one read transaction: a
+// first walk counts the allocations and finds the width of the page's
+// device column, and a second writes the page's rows straight to w.
+func (h *Handler) serveAllText(w http.ResponseWriter, r *http.Request,
+	l *listing, scan *deviceScan) {
+
+	inPage := func(i int) bool {
+		return i >= l.offset && (l.limit == 0 || i < l.offset+l.limit)
+	}
+
+	err := h.db.View(func(tx *bolt.Tx) error {
+
+		total, width := 0, 0
+		next, err := scan.each(tx, h.buckets.addresses,
+			func(k, v []byte) error {
+				if inPage(total) {
+					width = max(width, len(k))
+				}
+				total++
+				return nil
+			})
+		if err != nil {
+			return err
+		}
+
+		truncated(w, next)
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+
+		out := bufio.NewWriter(w)
+		defer out.Flush()
+
+		// The answer's begun, so a failure now can only cut it short.
+		i := 0
+		_, err = scan.each(tx, h.buckets.addresses,
+			func(k, v []byte) error {
+				defer func() { i++ }()
+				if !inPage(i) {
+					if i >= l.offset {
+						return errPageDone
+					}
+					return nil
+				}
+				rec, err := decodeRecord(v)
+				if err != nil {
+					return err
+				}
+				writeTextRow(out, width,
+					&allocation{string(k), *rec})
+				return nil
+			})
+		if err != nil && err != errPageDone {
+			log.Printf("Listing allocations failed: %s", err)
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		writeLookupFailed(w, r)
+	}
+
+}
@@ -0,0 +1,178 @@
+package main
+
+//
+// The audit trail.  With -audit, every event is also kept in the database,
+// keyed by time, so /audit can answer what happened in a window, e.g.
+// during an incident, a page at a time.  Keys are the event time in
+// nanoseconds then a sequence number, both big-endian, so they sort by
+// time and a cursor is just the last key returned.
+//
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Events /audit returns by default, and at most, per page.
+const (
+	auditPage    = 100
+	maxAuditPage = 1000
+)
+
+// Returns the audit key for an event at t with a sequence number.
+func auditKey(t time.Time, seq uint64) []byte {
+
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+
+	return k
+
+}
+
+// Adds an event to the audit trail.  Requests emitting events at once
+// share a transaction.
+func (h *Handler) audit(ev *event) {
+
+	v, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Audit: %s", err)
+		return
+	}
+
+	err = h.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket(h.buckets.audit)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(auditKey(ev.Time, seq), v)
+	})
+	if err != nil {
+		log.Printf("Audit: %s", err)
+	}
+
+}
+
+// Returns a JSON object with the events from ?from= up to but not
+// including ?to=, both RFC 3339 times and both optional, oldest first,
+// and only those about ?device= if given: at most ?limit= of them, and if
+// there are more, a "cursor" to pass as ?cursor= for the next page.
+// X-Total-Count gives the number in the window.
+func (h *Handler) ServeAudit(w http.ResponseWriter, r *http.Request) {
+
+	if !h.auditing {
+		writeError(w, r, http.StatusNotFound,
+			"The audit trail isn't kept, see -audit.")
+		return
+	}
+
+	q := r.URL.Query()
+	var window [2]time.Time
+	for i, name := range []string{"from", "to"} {
+		if s := q.Get(name); s != "" {
+			var err error
+			window[i], err = time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest,
+					"Bad ?"+name+"=, expected an RFC 3339 "+
+						"time.")
+				return
+			}
+		}
+	}
+
+	start := auditKey(window[0], 0)
+	if window[0].IsZero() {
+		start = nil
+	}
+	var end []byte
+	if !window[1].IsZero() {
+		end = auditKey(window[1], 0)
+	}
+
+	limit := auditPage
+	if s := q.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxAuditPage {
+			writeError(w, r, http.StatusBadRequest,
+				"Bad ?limit=, expected 1 to "+
+					strconv.Itoa(maxAuditPage)+".")
+			return
+		}
+	}
+
+	var after []byte
+	if s := q.Get("cursor"); s != "" {
+		var err error
+		after, err = hex.DecodeString(s)
+		if err != nil || len(after) != 16 {
+			writeError(w, r, http.StatusBadRequest, "Bad ?cursor=.")
+			return
+		}
+	}
+
+	device := canonicalDevice(q.Get("device"))
+
+	result := struct {
+		Events []json.RawMessage `json:"events"`
+		Cursor string            `json:"cursor,omitempty"`
+	}{
+		Events: []json.RawMessage{},
+	}
+	total := 0
+
+	err := h.db.View(func(tx *bolt.Tx) error {
+
+		c := tx.Bucket(h.buckets.audit).Cursor()
+		var last []byte
+		for k, v := c.Seek(start); k != nil &&
+			(end == nil || bytes.Compare(k, end) < 0); k, v = c.Next() {
+			if device != "" {
+				var ev event
+				err := json.Unmarshal(v, &ev)
+				if err != nil {
+					return err
+				}
+				if ev.Device != device &&
+					ev.PreviousDevice != device {
+					continue
+				}
+			}
+			total++
+			if after != nil && bytes.Compare(k, after) <= 0 {
+				continue
+			}
+			if len(result.Events) < limit {
+				result.Events = append(result.Events,
+					json.RawMessage(append([]byte(nil), v...)))
+				last = k
+			} else if result.Cursor == "" {
+				result.Cursor = hex.EncodeToString(last)
+			}
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		writeLookupFailed(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+	return
+
+}
@@ -0,0 +1,155 @@
+package main
+
+//
+// Backups.  With -backup-dir, a consistent snapshot of the database is
+// written there every -backup-interval, as addr-<time>.db, keeping the
+// newest -backup-keep.  A snapshot is taken in a read transaction, so
+// allocations carry on meanwhile, and is written to a temporary file,
+// synced and renamed into place, so a crash never leaves a partial
+// backup under a backup's name.  Any snapshot can be used as the
+// database as it stands.  /backup streams one on demand.
+//
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Backup file names, with the time of the snapshot between.
+const (
+	backupPrefix = "addr-"
+	backupSuffix = ".db"
+)
+
+// When the last backup was made.
+var lastBackup = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "addr_alloc_last_backup_timestamp_seconds",
+	Help: "When the last scheduled backup was written, as a Unix time.",
+})
+
+func init() {
+	prometheus.MustRegister(lastBackup)
+}
+
+// Writes a snapshot of the database to a new file in dir, returning its
+// path.
+func backup(db *bolt.DB, dir string, now time.Time) (string, error) {
+
+	path := filepath.Join(dir, backupPrefix+
+		now.UTC().Format("20060102T150405Z")+backupSuffix)
+
+	f, err := os.CreateTemp(dir, ".backup-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return "", err
+	}
+	err = f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	return path, os.Rename(f.Name(), path)
+
+}
+
+// Deletes all but the newest keep backups in dir.
+func pruneBackups(dir string, keep int) error {
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// The time in the name sorts them oldest first.
+	names := []string{}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), backupPrefix) &&
+			strings.HasSuffix(e.Name(), backupSuffix) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for len(names) > keep {
+		err = os.Remove(filepath.Join(dir, names[0]))
+		if err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+
+	return nil
+
+}
+
+// Backs the database up every interval, forever.
+func (h *Handler) backups(db *bolt.DB) {
+
+	for range time.Tick(h.backupInterval) {
+
+		path, err := backup(db, h.backupDir, h.now())
+		if err != nil {
+			log.Printf("Backup failed: %s", err)
+			continue
+		}
+		lastBackup.SetToCurrentTime()
+		log.Printf("Backed up to %s", path)
+
+		if h.backupKeep > 0 {
+			err = pruneBackups(h.backupDir, h.backupKeep)
+			if err != nil {
+				log.Printf("Pruning backups failed: %s", err)
+			}
+		}
+
+	}
+
+}
+
+// Streams a snapshot of the database, to restore by using it as the
+// database file.
+func (h *Handler) ServeBackup(w http.ResponseWriter, r *http.Request) {
+
+	name := backupPrefix + h.now().UTC().Format("20060102T150405Z") +
+		backupSuffix
+
+	err := h.db.View(func(tx *bolt.Tx) error {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition",
+			`attachment; filename="`+name+`"`)
+		w.Header().Set("Content-Length", strconv.FormatInt(tx.Size(), 10))
+		w.WriteHeader(http.StatusOK)
+		_, err := tx.WriteTo(w)
+		return err
+	})
+
+	// Part of the snapshot may have been sent, so all that can be done is
+	// to log it; the client sees a short body.
+	if err != nil {
+		log.Printf("Backup to %s failed: %s", clientCN(r), err)
+	}
+
+}
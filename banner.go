@@ -0,0 +1,120 @@
+package main
+
+//
+// Startup summary of the effective configuration, so the logs say how the
+// allocator was set up as well as what it did.
+//
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// Logs the effective configuration as structured fields.
+func (h *Handler) banner(listen, dbPath string, standby bool) {
+
+	strategy := "sequential"
+	if h.fillHoles {
+		strategy = "fill-holes"
+	}
+
+	durability := "strict"
+	if h.relaxed {
+		durability = "relaxed"
+	}
+
+	storage := "bolt"
+	if h.inMemory {
+		storage = "memory"
+	}
+
+	admins := "any client"
+	if len(h.admins) > 0 || len(h.adminOUs) > 0 {
+		names := []string{}
+		for cn := range h.admins {
+			names = append(names, cn)
+		}
+		for ou := range h.adminOUs {
+			names = append(names, "OU="+ou)
+		}
+		sort.Strings(names)
+		admins = strings.Join(names, ",")
+	}
+
+	webhooks := 0
+	if h.webhooks != nil {
+		webhooks = len(h.webhooks.targets)
+	}
+
+	slog.Info("Configuration",
+		"pool", h.pool.String(),
+		"size", h.pool.size(),
+		"network", h.network().String(),
+		"pool6", h.pool6String(),
+		"strategy", strategy,
+		"explicit_allocation", h.explicitOnly,
+		"reservations", h.reservations,
+		"claim", h.claims,
+		"auth_from_cert", h.authFromCert,
+		"reclaim_expired_certs", h.reclaimCerts,
+		"cert_inventory", h.certInventory,
+		"ttl", h.ttl,
+		"ttl_jitter", h.ttlJitter,
+		"max_ttl", h.maxTTL,
+		"reuse_cooldown", h.reuseCooldown,
+		"out_of_pool", h.outOfPool,
+		"strict_pool", h.strictPool,
+		"after_release", h.afterRelease,
+		"gone_ttl", h.goneTTL,
+		"require_lease", h.requireLease,
+		"max_devices", h.maxDevices,
+		"max_devices_per_client", h.maxPerClient,
+		"warn_threshold", h.warnThreshold,
+		"history", h.historyLen,
+		"audit", h.auditing,
+		"webhooks", webhooks,
+		"listen", listen,
+		"storage", storage,
+		"database", dbPath,
+		"namespace", string(h.buckets.addresses),
+		"verify_index", h.verifyIndex,
+		"dns", h.dns,
+		"mtu", h.mtu,
+		"wg_endpoint", h.wgEndpoint,
+		"durability", durability,
+		"flush_interval", h.flushInterval,
+		"on_read_only", h.onReadOnly,
+		"backup_dir", h.backupDir,
+		"backup_interval", h.backupInterval,
+		"backup_keep", h.backupKeep,
+		"tombstone_ttl", h.tombstoneTTL,
+		"batch", h.batched,
+		"cold_standby", standby,
+		"mtls", "client certificate required",
+		"admins", admins,
+		"strict_device_charset", h.strictDevice,
+		"path_safe_device", h.pathSafeDevice,
+		"tenant", h.tenantFrom,
+		"pprof", h.pprof)
+
+}
+
+// Logs the effective configuration, with a line for each pool from
+// -pools.
+func (ps *poolSet) banner(listen, dbPath string, standby bool) {
+
+	ps.handlers[0].banner(listen, dbPath, standby)
+
+	for _, h := range ps.handlers[1:] {
+		slog.Info("Pool",
+			"name", h.name,
+			"prefix", h.prefix,
+			"pool", h.pool.String(),
+			"size", h.pool.size(),
+			"network", h.network().String(),
+			"namespace", string(h.buckets.addresses),
+			"listen", h.listenAddr())
+	}
+
+}
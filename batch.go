@@ -0,0 +1,191 @@
+package main
+
+//
+// Allocating addresses for a group of devices at once.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+)
+
+var errExhausted = errors.New("pool exhausted")
+
+// Allocates addresses for a JSON array of device names in one transaction,
+// returning a JSON object of device name to address.  Devices which
+// already have an address keep it.  If the new ones don't all fit, none
+// are allocated and the answer is 503.
+func (h *Handler) ServeAllocateBatch(w http.ResponseWriter,
+	r *http.Request) {
+
+	if h.explicitOnly {
+		writeError(w, r, http.StatusForbidden,
+			"Addresses are only assigned with /reserve.")
+		return
+	}
+
+	body, ok := h.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var devices []string
+	err := json.Unmarshal(body, &devices)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest,
+			"Expected a JSON array of device names.")
+		return
+	}
+	for _, device := range devices {
+		if device == "" {
+			writeError(w, r, http.StatusBadRequest,
+				"Empty device name.")
+			return
+		}
+		if !h.deviceOK(w, r, h.scoped(r, device)) {
+			return
+		}
+	}
+
+	ttl, ok := h.requestTTL(w, r)
+	if !ok {
+		return
+	}
+
+	desc, tags, ok := requestMetadata(w, r)
+	if !ok {
+		return
+	}
+
+	now := h.now()
+	reason := allocationReason(r)
+	result := map[string]string{}
+	claimed := []net.IP{}
+	created := map[string]*record{}
+
+	err = h.db.Update(func(tx *bolt.Tx) error {
+
+		// Devices the client owns, counted once for the batch.
+		owned := uint32(0)
+		if h.maxPerClient > 0 {
+			var err error
+			owned, err = h.clientDevices(tx, h.owner(r))
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, name := range devices {
+
+			if _, ok := result[name]; ok {
+				continue
+			}
+			device := h.scoped(r, name)
+
+			rec, err := h.getAllocation(tx, device)
+			if err != nil {
+				return err
+			}
+			if rec != nil {
+				err = h.checkOwner(tx, r, device, rec)
+				if err != nil {
+					return err
+				}
+			}
+
+			if rec == nil {
+				t, err := h.released(tx, device)
+				if err != nil {
+					return err
+				}
+				if t != nil {
+					return errGone
+				}
+				err = h.checkLimit()
+				if err != nil {
+					return err
+				}
+				err = h.checkClientLimit(owned +
+					uint32(len(created)))
+				if err != nil {
+					return err
+				}
+				h.mu.Lock()
+				ip, ok := h.claim()
+				h.mu.Unlock()
+				if !ok {
+					return errExhausted
+				}
+				claimed = append(claimed, ip)
+				rec = &record{
+					Address:     ip,
+					Allocated:   now,
+					Expires:     h.leaseExpiry(now, ttl),
+					Reason:      reason,
+					Lease:       newLeaseID(),
+					Description: desc,
+					Tags:        tags,
+					Owner:       h.owner(r),
+				}
+				h.noteCert(r, rec)
+				err = h.assign6(tx, rec)
+				if err != nil {
+					return err
+				}
+				err = h.putAllocation(tx, device, rec)
+				if err != nil {
+					return err
+				}
+				created[device] = rec
+			}
+
+			result[name] = rec.Address.String()
+
+		}
+
+		return h.notePeak(tx)
+
+	})
+
+	if err != nil {
+		for _, ip := range claimed {
+			h.free(ip)
+		}
+		if err == errTooMany {
+			h.writeTooMany(w, r)
+		} else if err == errClientTooMany {
+			h.writeClientTooMany(w, r)
+		} else if err == errExhausted {
+			exhaustions.WithLabelValues(h.name).Inc()
+			writeError(w, r, http.StatusServiceUnavailable,
+				"Not enough free addresses for the batch.")
+		} else if err == errGone {
+			writeError(w, r, http.StatusGone,
+				"A device in the batch has been released.")
+		} else if err == errNotOwner {
+			writeError(w, r, http.StatusForbidden,
+				"A device in the batch belongs to another "+
+					"identity.")
+		} else {
+			writeFailed(w, r, err)
+		}
+		return
+	}
+
+	for device, rec := range created {
+		fmt.Printf("Device %s: allocating: %s\n", device, rec.Address)
+		h.emit((&event{Type: eventAllocate, Device: device,
+			Address: rec.Address, Reason: reason, Time: now}).by(r))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+	return
+
+}
@@ -0,0 +1,176 @@
+package main
+
+//
+// Allocation bitmap.  One bit per address in the pool, set when the address
+// is allocated.  It's a cache of what's in the addresses bucket, built by
+// the startup scan (or /reconcile) and updated on every allocation, so
+// finding a free address or counting them doesn't mean walking the
+// database.
+//
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net"
+)
+
+type bitmap struct {
+
+	// Bits, least significant first.
+	words []uint64
+
+	// Number of addresses covered.
+	size uint32
+
+	// Number of bits set.
+	count uint32
+}
+
+func newBitmap(size uint32) *bitmap {
+	return &bitmap{
+		words: make([]uint64, (uint64(size)+63)/64),
+		size:  size,
+	}
+}
+
+func (b *bitmap) set(i uint32) {
+	if !b.isSet(i) {
+		b.words[i/64] |= 1 << (i % 64)
+		b.count++
+	}
+}
+
+func (b *bitmap) clear(i uint32) {
+	if b.isSet(i) {
+		b.words[i/64] &^= 1 << (i % 64)
+		b.count--
+	}
+}
+
+func (b *bitmap) isSet(i uint32) bool {
+	return b.words[i/64]&(1<<(i%64)) != 0
+}
+
+// Returns the lowest clear bit below limit, if there is one.
+func (b *bitmap) firstClear(limit uint32) (uint32, bool) {
+	return b.firstClearIn(0, limit)
+}
+
+// Returns the lowest clear bit from start up to but not including limit,
+// if there is one.  Whole words of allocated addresses are skipped at once.
+func (b *bitmap) firstClearIn(start, limit uint32) (uint32, bool) {
+
+	if limit > b.size {
+		limit = b.size
+	}
+
+	for w := start / 64; w*64 < limit; w++ {
+
+		// Treat bits before start as allocated.
+		word := b.words[w]
+		if w == start/64 {
+			word |= 1<<(start%64) - 1
+		}
+
+		if word == ^uint64(0) {
+			continue
+		}
+		i := w*64 + uint32(bits.TrailingZeros64(^word))
+		if i < limit {
+			return i, true
+		}
+		return 0, false
+
+	}
+
+	return 0, false
+
+}
+
+// Returns a copy of the bitmap covering a larger number of addresses.
+func (b *bitmap) grow(size uint32) *bitmap {
+
+	n := newBitmap(size)
+	copy(n.words, b.words)
+	n.count = b.count
+
+	return n
+
+}
+
+// Counts runs of consecutive free addresses, returning the number of runs
+// and the length of the longest.
+func (b *bitmap) freeRuns() (uint32, uint32) {
+
+	var runs, longest, current uint32
+
+	for i := uint32(0); i < b.size; {
+
+		w := b.words[i/64]
+
+		// Whole words at once where possible.
+		if i%64 == 0 && i+64 <= b.size && (w == 0 || w == ^uint64(0)) {
+			if w == 0 {
+				if current == 0 {
+					runs++
+				}
+				current += 64
+			} else {
+				current = 0
+			}
+			if current > longest {
+				longest = current
+			}
+			i += 64
+			continue
+		}
+
+		if w&(1<<(i%64)) == 0 {
+			if current == 0 {
+				runs++
+			}
+			current++
+			if current > longest {
+				longest = current
+			}
+		} else {
+			current = 0
+		}
+		i++
+
+	}
+
+	return runs, longest
+
+}
+
+// Number of addresses free.
+func (b *bitmap) free() uint32 {
+	return b.size - b.count
+}
+
+// Returns an address in one form whatever form it came in: 4 bytes for
+// IPv4, including IPv4-mapped IPv6, else 16.  Stored addresses and index
+// keys are always in this form, so bytes.Equal and bytes.Compare on them
+// compare like with like.
+func canonicalIP(a net.IP) net.IP {
+
+	if v4 := a.To4(); v4 != nil {
+		return v4
+	}
+
+	return a
+
+}
+
+// Converts an IPv4 address to an integer.
+func ipToUint(a net.IP) uint32 {
+	return binary.BigEndian.Uint32(a.To4())
+}
+
+// Converts an integer to an IPv4 address.
+func uintToIP(v uint32) net.IP {
+	a := make(net.IP, 4)
+	binary.BigEndian.PutUint32(a, v)
+	return a
+}
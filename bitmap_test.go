@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestCanonicalIP(t *testing.T) {
+
+	tests := []struct {
+		in   net.IP
+		want []byte
+	}{
+		{net.IP{10, 1, 0, 5}, []byte{10, 1, 0, 5}},
+		{net.ParseIP("10.1.0.5"), []byte{10, 1, 0, 5}},
+		{net.IPv4(10, 1, 0, 5), []byte{10, 1, 0, 5}},
+		{net.ParseIP("fd00::1"), net.ParseIP("fd00::1")},
+		{nil, nil},
+	}
+
+	for _, tc := range tests {
+		if got := canonicalIP(tc.in); !bytes.Equal(got, tc.want) {
+			t.Errorf("%v: got %v, want %v", tc.in, []byte(got),
+				tc.want)
+		}
+	}
+
+}
+
+// An IPv4 address given in 16 bytes is stored, indexed and compared as
+// the 4-byte form is: the same byip key, the same pool position, and the
+// same address as far as conflicts go.
+func TestMixedAddressForms(t *testing.T) {
+
+	h := newTestHandler(t, nil)
+
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		for device, ip := range map[string]net.IP{
+			"long":  net.ParseIP("10.1.0.5"),
+			"short": {10, 1, 0, 6},
+		} {
+			if len(ip) == 4 && device == "long" {
+				t.Fatal("test address isn't 16 bytes")
+			}
+			err := h.putAllocation(tx, device, &record{Address: ip})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = h.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(h.buckets.byip).ForEach(func(k, v []byte) error {
+			if len(k) != 4 {
+				t.Errorf("%s: byip key of %d bytes", v, len(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := h.currentPool()
+	if p.index(net.ParseIP("10.1.0.5")) != p.index(net.IP{10, 1, 0, 5}) {
+		t.Error("pool positions differ")
+	}
+
+	tests := []struct {
+		method string
+		target string
+		code   int
+		body   string
+	}{
+		{"GET", "/lookup/10.1.0.5", http.StatusOK, "long"},
+		{"GET", "/lookup/10.1.0.6", http.StatusOK, "short"},
+		{"GET", "/get/long", http.StatusOK, "10.1.0.5"},
+		{"POST", "/reserve/other?address=10.1.0.5", http.StatusConflict,
+			""},
+		{"POST", "/reserve/other?address=10.1.0.6", http.StatusConflict,
+			""},
+		{"POST", "/import", http.StatusConflict, ""},
+	}
+
+	for _, tc := range tests {
+		body := ""
+		if tc.target == "/import" {
+			body = `[{"device": "other", "address": "10.1.0.5"}]`
+		}
+		w := do(t, h, tc.method, tc.target, "admin", body)
+		if w.Code != tc.code {
+			t.Errorf("%s %s: got %d, want %d", tc.method, tc.target,
+				w.Code, tc.code)
+		}
+		if tc.body != "" && w.Body.String() != tc.body {
+			t.Errorf("%s %s: got %q, want %q", tc.method, tc.target,
+				w.Body.String(), tc.body)
+		}
+	}
+
+	// Neither address is handed out again.
+	for _, want := range []string{"10.1.0.1", "10.1.0.2", "10.1.0.3",
+		"10.1.0.4", "10.1.0.7"} {
+		got := expect(t, h, "GET", "/get/new"+want, "dev1",
+			http.StatusOK)
+		if got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+
+}
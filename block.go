@@ -0,0 +1,308 @@
+package main
+
+//
+// Reserved blocks: contiguous ranges held out of the pool at runtime, e.g.
+// for a new server cluster, without a restart.  Every address in a block is
+// marked used, so nothing is allocated from it, and the block is kept in
+// its own bucket, so it's held again after a restart or /reconcile.  A
+// block can only be reserved while none of its addresses are in use.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	errBlockInUse = errors.New("part of the block is in use")
+	errNoBlock    = errors.New("no such block")
+)
+
+// A reserved block, as stored.
+type block struct {
+	Created time.Time `json:"created"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// Reports whether a pool position lies in a reserved block.  Called with
+// h.mu held.
+func (h *Handler) inBlock(i uint32) bool {
+
+	ip := h.pool.address(i)
+	for _, n := range h.blocks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// Says why an address no device holds can't be had: it's in a reserved
+// block, or else cooling down.
+func (h *Handler) whyUnavailable(ip net.IP) string {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.pool.contains(ip) && h.inBlock(h.pool.index(ip)) {
+		return "Address is in a reserved block."
+	}
+
+	return "Address was freed recently and is cooling down."
+
+}
+
+// Marks a position free, unless it's in a reserved block, in which case it
+// stays used, now on the block's account.  Called with h.mu held.
+func (h *Handler) unuse(i uint32) {
+
+	if h.inBlock(i) {
+		h.blocked++
+		return
+	}
+
+	h.used.clear(i)
+
+}
+
+// Reads the reserved blocks, marking their addresses used.  Returns the
+// blocks and the number of addresses marked.  Addresses already in use,
+// from allocations made before the block, stay with those.
+func (h *Handler) loadBlocks(tx *bolt.Tx, p *pool, used *bitmap) (
+	[]*net.IPNet, uint32, error) {
+
+	blocks := []*net.IPNet{}
+	var blocked uint32
+
+	b := tx.Bucket(h.buckets.blocks)
+	if b == nil {
+		return blocks, 0, nil
+	}
+
+	err := b.ForEach(func(k, v []byte) error {
+		_, n, err := net.ParseCIDR(string(k))
+		if err != nil {
+			return fmt.Errorf("block %s: %s", k, err)
+		}
+		blocks = append(blocks, n)
+		held := 0
+		for _, sp := range p.windows(n) {
+			for i := sp.start; i < sp.end; i++ {
+				if used.isSet(i) {
+					held++
+					continue
+				}
+				used.set(i)
+				blocked++
+			}
+		}
+		if held > 0 {
+			fmt.Printf("Block %s: %d addresses are in use\n", n,
+				held)
+		}
+		return nil
+	})
+
+	return blocks, blocked, err
+
+}
+
+// Parses the block given as ?cidr=, answering 400 if it's missing or bad,
+// or lies wholly outside the pool.
+func (h *Handler) requestBlock(w http.ResponseWriter, r *http.Request) (
+	*net.IPNet, bool) {
+
+	_, n, err := net.ParseCIDR(r.URL.Query().Get("cidr"))
+	if err != nil || n.IP.To4() == nil {
+		writeError(w, r, http.StatusBadRequest,
+			"Give the block as ?cidr=, an IPv4 CIDR.")
+		return nil, false
+	}
+	if len(h.currentPool().windows(n)) == 0 {
+		writeError(w, r, http.StatusBadRequest,
+			"Block is outside the pool.")
+		return nil, false
+	}
+
+	return n, true
+
+}
+
+// With POST, reserves the block given as ?cidr=, with the reason given as
+// ?reason=.  With DELETE, releases it.
+func (h *Handler) ServeReserveBlock(w http.ResponseWriter,
+	r *http.Request) {
+
+	n, ok := h.requestBlock(w, r)
+	if !ok {
+		return
+	}
+
+	var err error
+	if r.Method == http.MethodDelete {
+		err = h.releaseBlock(n)
+	} else {
+		err = h.reserveBlock(n, allocationReason(r))
+	}
+
+	switch {
+	case err == errBlockInUse:
+		writeError(w, r, http.StatusConflict,
+			"Part of the block is in use.")
+		return
+	case err == errNoBlock:
+		writeError(w, r, http.StatusNotFound, "No such block.")
+		return
+	case err != nil:
+		writeFailed(w, r, err)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		fmt.Printf("Block %s: released\n", n)
+	} else {
+		fmt.Printf("Block %s: reserved\n", n)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.capacity())
+	return
+
+}
+
+// Reserves a block, none of whose addresses may be in use.  Claims are
+// made in write transactions, so none can come between the check and the
+// marking.
+func (h *Handler) reserveBlock(n *net.IPNet, reason string) error {
+
+	return h.db.Update(func(tx *bolt.Tx) error {
+
+		b := tx.Bucket(h.buckets.blocks)
+		if b.Get([]byte(n.String())) != nil {
+			return errBlockInUse
+		}
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		spans := h.pool.windows(n)
+		for _, sp := range spans {
+			for i := sp.start; i < sp.end; i++ {
+				if h.used.isSet(i) {
+					return errBlockInUse
+				}
+			}
+		}
+
+		v, err := json.Marshal(&block{Created: h.now(), Reason: reason})
+		if err != nil {
+			return err
+		}
+		err = b.Put([]byte(n.String()), v)
+		if err != nil {
+			return err
+		}
+
+		for _, sp := range spans {
+			for i := sp.start; i < sp.end; i++ {
+				h.used.set(i)
+				h.blocked++
+			}
+		}
+		h.blocks = append(h.blocks, n)
+
+		return nil
+
+	})
+
+}
+
+// Releases a block, freeing its addresses except those held by devices or
+// cooling down.
+func (h *Handler) releaseBlock(n *net.IPNet) error {
+
+	return h.db.Update(func(tx *bolt.Tx) error {
+
+		b := tx.Bucket(h.buckets.blocks)
+		if b.Get([]byte(n.String())) == nil {
+			return errNoBlock
+		}
+		err := b.Delete([]byte(n.String()))
+		if err != nil {
+			return err
+		}
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		blocks := []*net.IPNet{}
+		for _, o := range h.blocks {
+			if o.String() != n.String() {
+				blocks = append(blocks, o)
+			}
+		}
+		h.blocks = blocks
+
+		for _, sp := range h.pool.windows(n) {
+			for i := sp.start; i < sp.end; i++ {
+				if _, ok := h.cooling[i]; ok {
+					continue
+				}
+				if h.lookupIP(tx, h.pool.address(i)) != "" {
+					continue
+				}
+				h.used.clear(i)
+				h.blocked--
+			}
+		}
+
+		return nil
+
+	})
+
+}
+
+// Holds the blocks configured for the pool, unless already held.  One which
+// is partly in use is left with a warning.
+func (h *Handler) holdReserved() error {
+
+	for _, n := range h.reserved {
+
+		held := false
+		h.mu.Lock()
+		for _, o := range h.blocks {
+			if o.String() == n.String() {
+				held = true
+			}
+		}
+		h.mu.Unlock()
+		if held {
+			continue
+		}
+
+		err := h.reserveBlock(n, "configured")
+		if err == errBlockInUse {
+			log.Printf("Warning: pool %s: reserved block %s is "+
+				"partly in use, not held", h.name, n)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Block %s: reserved\n", n)
+
+	}
+
+	return nil
+
+}
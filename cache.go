@@ -0,0 +1,62 @@
+package main
+
+//
+// Caching of /get/ answers.  A device's address is given an ETag derived
+// from the device name and address, so a client polling for its address
+// can send If-None-Match and get 304 Not Modified while it's unchanged.
+// The lookup, and allocation for a new device, happen first, so a 304
+// never skips an allocation.  Cache-Control is set by -cache-control.
+//
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Returns the ETag for a representation of a device's address.
+func addressETag(device, address, repr string) string {
+
+	sum := sha256.Sum256([]byte(device + "\x00" + address + "\x00" + repr))
+
+	return `"` + hex.EncodeToString(sum[:12]) + `"`
+
+}
+
+// Reports whether an If-None-Match header matches an ETag.
+func etagMatches(header, etag string) bool {
+
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// Sets the caching headers for a representation of a device's address,
+// answering 304 if the client already has it.  Returns false if a
+// response has been written.
+func (h *Handler) checkCache(w http.ResponseWriter, r *http.Request,
+	device, address, repr string) bool {
+
+	etag := addressETag(device, address, repr)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Accept")
+	if h.cacheControl != "" {
+		w.Header().Set("Cache-Control", h.cacheControl)
+	}
+
+	inm := r.Header.Get("If-None-Match")
+	if inm != "" && etagMatches(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return false
+	}
+
+	return true
+
+}
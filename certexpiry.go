@@ -0,0 +1,173 @@
+package main
+
+//
+// Reclaiming the addresses of devices whose certificates have expired.
+// With -claim, an allocation records the serial number and expiry of its
+// owner's certificate, as last presented.  A device whose certificate has
+// expired can't ask for its address again, so with -reclaim-expired-certs
+// a background goroutine releases such allocations.  With -cert-inventory,
+// a PEM bundle of issued certificates, re-read on each pass, an owner with
+// a newer certificate in the bundle isn't treated as expired, so renewals
+// not yet presented are honoured.
+//
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// How often to look for expired certificates.
+const certCheckInterval = 10 * time.Minute
+
+// Tombstone cause for an allocation reclaimed because its owner's
+// certificate expired.
+const causeCertExpired = "cert-expired"
+
+// Records the client certificate's serial number and expiry with an
+// allocation, with -claim.  Reports whether they changed.
+func (h *Handler) noteCert(r *http.Request, rec *record) bool {
+
+	if !h.claims || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+
+	cert := r.TLS.PeerCertificates[0]
+	serial := cert.SerialNumber.Text(16)
+	if rec.CertSerial == serial && rec.CertExpires.Equal(cert.NotAfter) {
+		return false
+	}
+	rec.CertSerial = serial
+	rec.CertExpires = cert.NotAfter
+
+	return true
+
+}
+
+// Reads a PEM bundle of certificates, returning the latest expiring
+// certificate for each CN.
+func readCertInventory(path string) (map[string]*x509.Certificate, error) {
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := map[string]*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		cn := cert.Subject.CommonName
+		if l, ok := latest[cn]; !ok || cert.NotAfter.After(l.NotAfter) {
+			latest[cn] = cert
+		}
+	}
+
+	return latest, nil
+
+}
+
+// Reclaims allocations with expired certificates, forever.
+func (h *Handler) reapCerts() {
+
+	for {
+		time.Sleep(certCheckInterval)
+		err := h.reclaimExpiredCerts(h.now())
+		if err != nil {
+			log.Printf("Certificate expiry check failed: %s", err)
+		}
+	}
+
+}
+
+// Removes allocations whose owner's certificate expired before now,
+// freeing their addresses.  Allocations without a recorded certificate are
+// left alone.
+func (h *Handler) reclaimExpiredCerts(now time.Time) error {
+
+	var inventory map[string]*x509.Certificate
+	if h.certInventory != "" {
+		var err error
+		inventory, err = readCertInventory(h.certInventory)
+		if err != nil {
+			return err
+		}
+	}
+
+	type expiry struct {
+		device string
+		rec    *record
+		serial string
+	}
+	expired := []expiry{}
+
+	err := h.db.Update(func(tx *bolt.Tx) error {
+
+		c := tx.Bucket(h.buckets.addresses).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			rec, err := decodeRecord(v)
+			if err != nil {
+				return err
+			}
+			if rec.CertExpires.IsZero() {
+				continue
+			}
+			expires, serial := rec.CertExpires, rec.CertSerial
+			if cert, ok := inventory[rec.Owner]; ok &&
+				cert.NotAfter.After(expires) {
+				expires = cert.NotAfter
+				serial = cert.SerialNumber.Text(16)
+			}
+			if expires.Before(now) {
+				expired = append(expired,
+					expiry{string(k), rec, serial})
+			}
+		}
+
+		for _, e := range expired {
+			err := h.deleteAllocation(tx, e.device, e.rec,
+				causeCertExpired)
+			if err != nil {
+				return err
+			}
+			err = h.cool(tx, e.rec.Address, now)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range expired {
+		h.retire(e.rec.Address, now)
+		fmt.Printf("Device %s: certificate %s expired, reclaimed %s\n",
+			e.device, e.serial, e.rec.Address)
+		h.emit(&event{Type: eventExpire, Device: e.device,
+			Address: e.rec.Address, Time: now,
+			Reason: "certificate " + e.serial + " expired"})
+	}
+
+	return nil
+
+}
@@ -0,0 +1,97 @@
+package main
+
+//
+// Reloading TLS credentials.  Each listener's server certificate, key and
+// client CA are read from their files on startup and again on SIGHUP, so
+// rotated certificates are picked up without a restart.  Connections
+// already open carry on with the credentials they were made with; new
+// handshakes get the new ones.  Files which fail to load, or with
+// -check-server-cert fail the startup check, are logged and the old
+// credentials kept.
+//
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// A listener's credentials, as files, and the TLS configuration last
+// loaded from them.
+type tlsFiles struct {
+	cert  string
+	key   string
+	ca    string
+	check bool
+
+	// Settings other than the credentials.
+	base *tls.Config
+
+	current atomic.Pointer[tls.Config]
+}
+
+// Loads credentials from files into a copy of base.  The certificate is
+// checked against the CA if check is set.
+func newTLSFiles(base *tls.Config, cert, key, ca string,
+	check bool) (*tlsFiles, error) {
+
+	f := &tlsFiles{cert: cert, key: key, ca: ca, check: check,
+		base: base.Clone()}
+
+	err := f.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+
+}
+
+// Reads the files again, replacing the credentials if they're good.
+func (f *tlsFiles) load() error {
+
+	b, err := os.ReadFile(f.ca)
+	if err != nil {
+		return err
+	}
+	cas := x509.NewCertPool()
+	if !cas.AppendCertsFromPEM(b) {
+		return fmt.Errorf("%s: no certificates", f.ca)
+	}
+
+	if f.check {
+		err = checkServerCert(f.cert, f.key, cas)
+		if err != nil {
+			return err
+		}
+	}
+
+	pair, err := tls.LoadX509KeyPair(f.cert, f.key)
+	if err != nil {
+		return err
+	}
+
+	c := f.base.Clone()
+	c.ClientCAs = cas
+	c.Certificates = []tls.Certificate{pair}
+	f.current.Store(c)
+
+	return nil
+
+}
+
+// Returns the configuration to serve with, which hands each handshake the
+// credentials current at the time.
+func (f *tlsFiles) config() *tls.Config {
+
+	c := f.current.Load().Clone()
+	c.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config,
+		error) {
+		return f.current.Load(), nil
+	}
+
+	return c
+
+}
@@ -0,0 +1,204 @@
+package main
+
+//
+// Device ownership.  With -claim, the client certificate CN which first
+// gets a device's address owns the device, and other clients are refused
+// it, so a device name can't be squatted on by another credential.
+// Allocations from before -claim, or made through /reserve, are owned by
+// whoever gets them first.  Admin endpoints aren't restricted, so an
+// admin can move or rename a device regardless.  /mine lists a client's
+// own devices.
+//
+// With -auth-from-cert, stricter, a client other than an admin is the
+// device its certificate CN names, and can only use device endpoints for
+// that device, the name being optional, and the endpoints about itself or
+// the pool as a whole.  Listings and lookups are left to admins.
+//
+// With -admin or -admin-ou, a client other than an admin sees the lease
+// IDs, owners and history only of its own devices.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var errNotOwner = errors.New("device owned by another identity")
+
+// Endpoints other than device endpoints which a client can use for itself
+// with -auth-from-cert.
+var selfRoutes = map[string]bool{
+	"/": true, "/mine": true, "/capacity": true, "/preview": true,
+	"/whoami": true, "/metrics": true, "/openapi.json": true,
+	"/healthz": true, "/readyz": true,
+}
+
+// With -auth-from-cert, returns the device a request is for: the one its
+// client certificate names, which the path may give too, for a client
+// other than an admin.  Answers 403 and returns false for another device
+// or an endpoint not about the client.
+func (h *Handler) certDevice(w http.ResponseWriter, r *http.Request,
+	rt *route, device string) (string, bool) {
+
+	if !h.authFromCert || h.isAdmin(r) {
+		return device, true
+	}
+
+	if !rt.takesDevice() {
+		if selfRoutes[rt.path] {
+			return device, true
+		}
+		writeError(w, r, http.StatusForbidden,
+			"Admin access required with -auth-from-cert.")
+		return "", false
+	}
+
+	cn := clientCN(r)
+	if device == "" {
+		return cn, true
+	}
+	if device != cn {
+		writeError(w, r, http.StatusForbidden,
+			"Device name doesn't match the client certificate.")
+		return "", false
+	}
+
+	return device, true
+
+}
+
+// Returns the owner to record for a new allocation by a request.
+func (h *Handler) owner(r *http.Request) string {
+
+	if !h.claims {
+		return ""
+	}
+
+	return clientCN(r)
+
+}
+
+// Checks a request may use a device's allocation, returning errNotOwner if
+// not.  An unowned device is claimed for the client.
+func (h *Handler) checkOwner(tx *bolt.Tx, r *http.Request, device string,
+	rec *record) error {
+
+	if !h.claims {
+		return nil
+	}
+
+	cn := clientCN(r)
+	if rec.Owner == "" {
+		rec.Owner = cn
+		h.noteCert(r, rec)
+		return h.putAllocation(tx, device, rec)
+	}
+	if rec.Owner != cn {
+		return errNotOwner
+	}
+	if h.noteCert(r, rec) {
+		return h.putAllocation(tx, device, rec)
+	}
+
+	return nil
+
+}
+
+// Returns the allocations owned by the client as a JSON object, device to
+// address, or with ?detail=true device to the whole record.  An admin can
+// give ?owner= to list another identity's.
+func (h *Handler) ServeMine(w http.ResponseWriter, r *http.Request) {
+
+	if !h.claims {
+		writeError(w, r, http.StatusNotFound,
+			"Devices only have owners with -claim.")
+		return
+	}
+
+	owner := clientCN(r)
+	if o := r.URL.Query().Get("owner"); o != "" {
+		if !h.isAdmin(r) {
+			writeError(w, r, http.StatusForbidden,
+				"Admin access required for ?owner=.")
+			return
+		}
+		owner = o
+	}
+	detail := r.URL.Query().Get("detail") == "true"
+
+	scan := h.scanFor(w, r)
+	if scan == nil {
+		return
+	}
+
+	mappings := map[string]interface{}{}
+	var next []byte
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		next, err = scan.each(tx, h.buckets.addresses,
+			func(k, v []byte) error {
+				rec, err := decodeRecord(v)
+				if err != nil {
+					return err
+				}
+				if rec.Owner != owner {
+					return nil
+				}
+				if detail {
+					mappings[string(k)] = rec
+				} else {
+					mappings[string(k)] = rec.Address.String()
+				}
+				return nil
+			})
+		return err
+	})
+	if err != nil {
+		writeLookupFailed(w, r)
+		return
+	}
+
+	truncated(w, next)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(mappings)
+	return
+
+}
+
+// Reports whether a request may see another device's details: its lease
+// ID, owner and history.  Admins may see any device's, and others only
+// their own, the one their certificate names or one they own.  Without
+// -admin or -admin-ou, every client is an admin.
+func (h *Handler) mayView(r *http.Request, device string, rec *record) bool {
+
+	if h.isAdmin(r) {
+		return true
+	}
+
+	cn := clientCN(r)
+	if cn == "" {
+		return false
+	}
+
+	return h.bareDevice(device) == cn || (rec != nil && rec.Owner == cn)
+
+}
+
+// Clears the parts of a record a request may not see, as mayView has it.
+func (h *Handler) redact(r *http.Request, device string, rec *record) {
+
+	if h.mayView(r, device, rec) {
+		return
+	}
+
+	rec.Lease = ""
+	rec.Owner = ""
+	rec.CertSerial = ""
+	rec.CertExpires = time.Time{}
+
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// With admins configured, a client other than an admin sees lease IDs,
+// owners and history only for its own devices, and can't export.
+func TestAdminDetail(t *testing.T) {
+
+	h := newTestHandler(t, func(h *Handler) {
+		h.admins = map[string]bool{"admin": true}
+		h.claims = true
+		h.historyLen = 5
+	})
+	for _, d := range []string{"dev1", "dev2", "shared"} {
+		cn := d
+		if d == "shared" {
+			cn = "dev2"
+		}
+		expect(t, h, "GET", "/get/"+d, cn, http.StatusOK)
+	}
+	expect(t, h, "POST", "/release/dev2", "dev2", http.StatusOK)
+	expect(t, h, "GET", "/get/dev2", "dev2", http.StatusOK)
+
+	tests := []struct {
+		cn     string
+		shown  map[string]bool
+		export int
+		hist   map[string]int
+	}{
+		{"admin", map[string]bool{"dev1": true, "dev2": true,
+			"shared": true}, http.StatusOK,
+			map[string]int{"dev1": 200, "dev2": 200, "shared": 200}},
+		{"dev1", map[string]bool{"dev1": true}, http.StatusForbidden,
+			map[string]int{"dev1": 200, "dev2": 403, "shared": 403}},
+		{"dev2", map[string]bool{"dev2": true, "shared": true},
+			http.StatusForbidden,
+			map[string]int{"dev1": 403, "dev2": 200, "shared": 200}},
+		{"other", map[string]bool{}, http.StatusForbidden,
+			map[string]int{"dev1": 403, "dev2": 403, "shared": 403}},
+	}
+
+	for _, tc := range tests {
+
+		recs := map[string]*record{}
+		err := json.Unmarshal([]byte(expect(t, h, "GET",
+			"/all?detail=true", tc.cn, http.StatusOK)), &recs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recs) != 3 {
+			t.Errorf("%s: listed %d devices", tc.cn, len(recs))
+		}
+		for d, rec := range recs {
+			shown := rec.Lease != "" && rec.Owner != ""
+			if shown != tc.shown[d] {
+				t.Errorf("%s: %s: lease %q, owner %q", tc.cn, d,
+					rec.Lease, rec.Owner)
+			}
+			if rec.Address == nil {
+				t.Errorf("%s: %s: no address", tc.cn, d)
+			}
+		}
+
+		for d, code := range tc.hist {
+			expect(t, h, "GET", "/history/"+d, tc.cn, code)
+		}
+		expect(t, h, "GET", "/export", tc.cn, tc.export)
+
+	}
+
+	// Nor does /get/ hand another client a device's lease ID, in the
+	// header or the JSON answer, so with -require-lease it can't release
+	// the device.
+	h = newTestHandler(t, func(h *Handler) {
+		h.admins = map[string]bool{"admin": true}
+		h.requireLease = true
+	})
+	own := do(t, h, "GET", "/get/dev2", "dev2", "")
+	lease := own.Header().Get(leaseHeader)
+	if lease == "" {
+		t.Fatal("dev2: no lease ID for its own device")
+	}
+
+	asJSON := http.Header{"Accept": {"application/json"}}
+	for _, cn := range []string{"dev1", "admin"} {
+		for _, hdr := range []http.Header{nil, asJSON} {
+			w := doWith(t, h, "GET", "/get/dev2", cn, "", hdr)
+			var resp struct {
+				Lease string `json:"lease"`
+			}
+			if hdr != nil {
+				json.Unmarshal(w.Body.Bytes(), &resp)
+			}
+			shown := w.Header().Get(leaseHeader)
+			if hdr != nil {
+				shown = resp.Lease
+			}
+			if (shown != "") != (cn == "admin") {
+				t.Errorf("%s: /get/dev2 gave lease %q", cn, shown)
+			}
+		}
+	}
+
+	w := do(t, h, "POST", "/release/dev2", "dev1", "")
+	if w.Code == http.StatusOK {
+		t.Error("dev1 released dev2 without its lease ID")
+	}
+	w = doWith(t, h, "POST", "/release/dev2", "dev2", "",
+		http.Header{leaseHeader: {lease}})
+	if w.Code != http.StatusOK {
+		t.Errorf("dev2: release with its lease ID: got %d", w.Code)
+	}
+
+}
+
+// Under -tenant, a client's own device is found by its name within the
+// tenant, so /all?detail=true shows its lease ID and not another's.
+func TestAdminDetailTenant(t *testing.T) {
+
+	h := newTestHandler(t, func(h *Handler) {
+		h.admins = map[string]bool{"admin": true}
+		h.tenantFrom = "header"
+	})
+	tenant := http.Header{"X-Tenant": {"a"}}
+	for _, d := range []string{"dev1", "other"} {
+		w := doWith(t, h, "GET", "/get/"+d, "dev1", "", tenant)
+		if w.Code != http.StatusOK {
+			t.Fatalf("/get/%s: got %d", d, w.Code)
+		}
+	}
+
+	w := doWith(t, h, "GET", "/all?detail=true", "dev1", "", tenant)
+	recs := map[string]*record{}
+	err := json.Unmarshal(w.Body.Bytes(), &recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recs["dev1"] == nil || recs["dev1"].Lease == "" {
+		t.Errorf("dev1: own lease ID hidden: %+v", recs["dev1"])
+	}
+	if recs["other"] == nil || recs["other"].Lease != "" {
+		t.Errorf("other: lease ID shown: %+v", recs["other"])
+	}
+
+}
+
+// With -claim, an address an admin reserves, whether it names one or not,
+// is left unowned for the device to claim, rather than owned by the admin.
+func TestReserveUnowned(t *testing.T) {
+
+	h := newTestHandler(t, func(h *Handler) {
+		h.admins = map[string]bool{"admin": true}
+		h.claims = true
+	})
+
+	for _, target := range []string{"/reserve/dev1",
+		"/reserve/dev2?address=10.1.0.9"} {
+		expect(t, h, "POST", target, "admin", http.StatusOK)
+	}
+
+	recs := map[string]*record{}
+	err := json.Unmarshal([]byte(expect(t, h, "GET", "/all?detail=true",
+		"admin", http.StatusOK)), &recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"dev1", "dev2"} {
+		rec := recs[d]
+		if rec == nil {
+			t.Fatalf("%s: not reserved", d)
+		}
+		if rec.Owner != "" {
+			t.Errorf("%s: owned by %s", d, rec.Owner)
+		}
+
+		// The device then claims its own.
+		got := expect(t, h, "GET", "/get/"+d, d, http.StatusOK)
+		if got != rec.Address.String() {
+			t.Errorf("%s: got %s, reserved %s", d, got, rec.Address)
+		}
+		expect(t, h, "GET", "/get/"+d, "other", http.StatusForbidden)
+	}
+
+}
@@ -0,0 +1,295 @@
+package client
+
+//
+// A client for the address allocator, for Go services which want
+// addresses for their devices without making the HTTP calls themselves.
+// Requests ask for JSON, so errors come back as *Error with the status and
+// message the allocator gave.
+//
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// A client for one allocator.
+type Client struct {
+
+	// Base URL, e.g. https://alloc.example.com.
+	base string
+
+	// HTTP client, set up with the client certificate.
+	http *http.Client
+}
+
+// An error answered by the allocator.
+type Error struct {
+	Status  int    `json:"status"`
+	Message string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("addr-alloc: %d: %s", e.Status, e.Message)
+}
+
+// Returns a client for the allocator at base, authenticating with the
+// client certificate and key in PEM files, and trusting the CA in caFile
+// for the server's certificate, or the system's CAs if that's empty.
+func New(base, certFile, keyFile, caFile string) (*Client, error) {
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New(caFile + ": no certificates")
+		}
+	}
+
+	return NewWithHTTPClient(base, &http.Client{
+		Transport: &http.Transport{TLSClientConfig: config},
+		Timeout:   30 * time.Second,
+	}), nil
+
+}
+
+// Returns a client for the allocator at base using an HTTP client already
+// set up, e.g. with its own transport.
+func NewWithHTTPClient(base string, hc *http.Client) *Client {
+	return &Client{base: strings.TrimSuffix(base, "/"), http: hc}
+}
+
+// Makes a request, returning the response if it's a success and an *Error
+// otherwise.  The caller closes the body.
+func (c *Client) do(ctx context.Context, method, path string,
+	body interface{}) (*http.Response, error) {
+
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		rd = strings.NewReader(string(b))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, rd)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		e := &Error{Status: resp.StatusCode}
+		b, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(b, e) != nil || e.Message == "" {
+			e.Message = strings.TrimSpace(string(b))
+		}
+		return nil, e
+	}
+
+	return resp, nil
+
+}
+
+// Returns the path for an endpoint about a device.
+func devicePath(endpoint, device string) string {
+	return endpoint + url.PathEscape(device)
+}
+
+// Parses an address answered as text.
+func parseAddress(r io.Reader) (net.IP, error) {
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(string(b)))
+	if ip == nil {
+		return nil, fmt.Errorf("addr-alloc: bad address %q", b)
+	}
+
+	return ip, nil
+
+}
+
+// Returns a device's address, allocating one if it's new.
+func (c *Client) Get(ctx context.Context, device string) (net.IP, error) {
+
+	resp, err := c.do(ctx, http.MethodGet, devicePath("/get/", device), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var v struct {
+		Address net.IP `json:"address"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.Address, nil
+
+}
+
+// Allocates addresses for several devices at once, all or none, returning
+// each device's address.  Devices which already have one keep it.
+func (c *Client) Allocate(ctx context.Context, devices []string) (
+	map[string]net.IP, error) {
+
+	resp, err := c.do(ctx, http.MethodPost, "/allocate-batch", devices)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	addrs := map[string]net.IP{}
+	err = json.NewDecoder(resp.Body).Decode(&addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return addrs, nil
+
+}
+
+// Releases a device's address, returning the address released.
+func (c *Client) Release(ctx context.Context, device string) (net.IP,
+	error) {
+
+	resp, err := c.do(ctx, http.MethodPost,
+		devicePath("/release/", device), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return parseAddress(resp.Body)
+
+}
+
+// Returns every device's address, following the allocator's continuation
+// if it limits how many it lists at once.
+func (c *Client) All(ctx context.Context) (map[string]net.IP, error) {
+
+	all := map[string]net.IP{}
+	after := ""
+
+	for {
+
+		path := "/all"
+		if after != "" {
+			path += "?after=" + url.QueryEscape(after)
+		}
+
+		resp, err := c.do(ctx, http.MethodGet, path, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		page := map[string]net.IP{}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for device, ip := range page {
+			all[device] = ip
+		}
+
+		after = resp.Header.Get("X-Next-After")
+		if after == "" {
+			return all, nil
+		}
+
+	}
+
+}
+
+// Returns the device holding an address.  An address not allocated gives
+// an *Error with status 404.
+func (c *Client) Lookup(ctx context.Context, ip net.IP) (string, error) {
+
+	resp, err := c.do(ctx, http.MethodGet, "/lookup/"+ip.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var v struct {
+		Device string `json:"device"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	if err != nil {
+		return "", err
+	}
+
+	return v.Device, nil
+
+}
+
+// Assigns a particular address to a device which doesn't have one, or
+// has that one already.  An address held by another device gives an
+// *Error with status 409.
+func (c *Client) Reserve(ctx context.Context, device string,
+	ip net.IP) (net.IP, error) {
+
+	resp, err := c.do(ctx, http.MethodPost, devicePath("/reserve/",
+		device)+"?address="+url.QueryEscape(ip.String()), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return parseAddress(resp.Body)
+
+}
+
+// Writes a consistent snapshot of the allocator's database to w,
+// returning the number of bytes written.
+func (c *Client) Backup(ctx context.Context, w io.Writer) (int64, error) {
+
+	resp, err := c.do(ctx, http.MethodGet, "/backup", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	return io.Copy(w, resp.Body)
+
+}
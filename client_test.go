@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cybermaggedon/addr-alloc/client"
+)
+
+// Writes a self-signed client certificate for cn, and its key, to PEM
+// files in dir, returning their names.
+func writeClientCert(t *testing.T, dir, cn string) (string, string) {
+
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, cn+".crt")
+	keyFile := filepath.Join(dir, cn+".key")
+	for f, b := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: kder},
+	} {
+		err = os.WriteFile(f, pem.EncodeToMemory(b), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return certFile, keyFile
+
+}
+
+// Returns a client, set up by client.New from certificate files, talking
+// mutual TLS to an httptest server running the handler.
+func newTestClient(t *testing.T, h *Handler) *client.Client {
+
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(h)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	certFile, keyFile := writeClientCert(t, dir, "svc")
+	caFile := filepath.Join(dir, "ca.crt")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: srv.Certificate().Raw,
+	}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := client.New(srv.URL, certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+
+}
+
+// The client package works against the real handler: each call's result,
+// and an error's status, are what the server answers.
+func TestClient(t *testing.T) {
+
+	h := newTestHandler(t, func(h *Handler) {
+		h.maxScan = 2
+	})
+	c := newTestClient(t, h)
+	ctx := context.Background()
+
+	a, err := c.Get(ctx, "host")
+	if err != nil || !a.Equal(net.ParseIP("10.1.0.1")) {
+		t.Fatalf("Get: got %v, %v", a, err)
+	}
+	b, err := c.Get(ctx, "host")
+	if err != nil || !b.Equal(a) {
+		t.Errorf("Get again: got %v, %v, want %v", b, err, a)
+	}
+
+	batch, err := c.Allocate(ctx, []string{"host", "p", "q"})
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	want := map[string]string{"host": "10.1.0.1", "p": "10.1.0.2",
+		"q": "10.1.0.3"}
+	for d, ip := range want {
+		if !batch[d].Equal(net.ParseIP(ip)) {
+			t.Errorf("Allocate: %s: got %v, want %s", d, batch[d], ip)
+		}
+	}
+
+	// More than -max-scan, so All follows the continuation.
+	all, err := c.All(ctx)
+	if err != nil || len(all) != len(want) {
+		t.Fatalf("All: got %v, %v", all, err)
+	}
+	for d, ip := range want {
+		if !all[d].Equal(net.ParseIP(ip)) {
+			t.Errorf("All: %s: got %v, want %s", d, all[d], ip)
+		}
+	}
+
+	d, err := c.Lookup(ctx, net.ParseIP("10.1.0.2"))
+	if err != nil || d != "p" {
+		t.Errorf("Lookup: got %q, %v", d, err)
+	}
+
+	r, err := c.Release(ctx, "p")
+	if err != nil || !r.Equal(net.ParseIP("10.1.0.2")) {
+		t.Errorf("Release: got %v, %v", r, err)
+	}
+
+	// Errors carry the status and message the server gave.
+	tests := []struct {
+		call func() error
+		code int
+	}{
+		{func() error {
+			_, err := c.Lookup(ctx, net.ParseIP("10.1.0.2"))
+			return err
+		}, http.StatusNotFound},
+		{func() error {
+			_, err := c.Lookup(ctx, net.ParseIP("2001:db8::1"))
+			return err
+		}, http.StatusBadRequest},
+		{func() error {
+			_, err := c.Get(ctx, "a/b")
+			return err
+		}, http.StatusBadRequest},
+		{func() error {
+			_, err := c.Release(ctx, "p")
+			return err
+		}, http.StatusNotFound},
+	}
+	for i, tc := range tests {
+		var e *client.Error
+		err := tc.call()
+		if !errors.As(err, &e) || e.Status != tc.code ||
+			e.Message == "" {
+			t.Errorf("%d: got %v, want status %d", i, err, tc.code)
+		}
+	}
+
+}
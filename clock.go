@@ -0,0 +1,36 @@
+package main
+
+//
+// The time source.  Lease expiry, cooldowns and record timestamps all take
+// the time from the handler's clock rather than calling time.Now, so that
+// it can be replaced by one which is set by hand, to step past an expiry
+// without waiting for it.
+//
+
+import (
+	"time"
+)
+
+// A source of the current time.
+type clock interface {
+	Now() time.Time
+}
+
+// The real time.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// Returns the current time by the handler's clock, or the real time if
+// it has none.
+func (h *Handler) now() time.Time {
+
+	if h.clock == nil {
+		return time.Now()
+	}
+
+	return h.clock.Now()
+
+}
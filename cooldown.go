@@ -0,0 +1,155 @@
+package main
+
+//
+// Reuse cooldown.  With -reuse-cooldown set, an address freed by a release,
+// lease expiry, certificate reclaim or a move isn't handed out again until
+// the cooldown has passed, so stale traffic for the old device doesn't
+// reach a new one.  Meanwhile its bit stays set in the bitmap, which makes
+// claim pass it over, though it isn't counted as allocated, and the time
+// it becomes free is kept in the cooldown bucket so a restart doesn't cut
+// the cooldown short.
+//
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// How often to look for addresses whose cooldown has passed.
+const coolInterval = time.Second
+
+// Records in the cooldown bucket that an address freed at now may not be
+// reused until the cooldown has passed.  Called in the transaction
+// removing its allocation; retire must be called once that commits.
+func (h *Handler) cool(tx *bolt.Tx, ip net.IP, now time.Time) error {
+
+	if h.reuseCooldown <= 0 {
+		return nil
+	}
+
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v,
+		uint64(now.Add(h.reuseCooldown).UnixNano()))
+
+	return tx.Bucket(h.buckets.cooldown).Put(ip, v)
+
+}
+
+// Returns an address freed at now to the pool, once the cooldown passes.
+func (h *Handler) retire(ip net.IP, now time.Time) {
+
+	if h.reuseCooldown <= 0 {
+		h.free(ip)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.pool.contains(ip) {
+		h.cooling[h.pool.index(ip)] = now.Add(h.reuseCooldown)
+	}
+
+}
+
+// Frees addresses whose cooldown has passed, forever.
+func (h *Handler) cooler() {
+
+	for range time.Tick(coolInterval) {
+		err := h.warm(h.now())
+		if err != nil {
+			log.Printf("Reuse cooldown: %s", err)
+		}
+	}
+
+}
+
+// Frees addresses whose cooldown passed before now.  An address which has
+// been assigned meanwhile, by a move or reservation, stays allocated.
+func (h *Handler) warm(now time.Time) error {
+
+	due := []net.IP{}
+	h.mu.Lock()
+	for i, until := range h.cooling {
+		if until.Before(now) {
+			due = append(due, h.pool.address(i))
+		}
+	}
+	h.mu.Unlock()
+
+	if len(due) == 0 {
+		return nil
+	}
+
+	assigned := map[string]bool{}
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		for _, ip := range due {
+			if h.lookupIP(tx, ip) != "" {
+				assigned[ip.String()] = true
+			}
+			err := tx.Bucket(h.buckets.cooldown).Delete(ip)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, ip := range due {
+		delete(h.cooling, h.pool.index(ip))
+		if !assigned[ip.String()] {
+			h.unuse(h.pool.index(ip))
+		}
+	}
+
+	return nil
+
+}
+
+// Loads addresses still cooling down, on startup, setting their bits in
+// used.  Entries for addresses since allocated are dropped.
+func (h *Handler) loadCooling(tx *bolt.Tx, p *pool,
+	used *bitmap) (map[uint32]time.Time, error) {
+
+	cooling := map[uint32]time.Time{}
+	b := tx.Bucket(h.buckets.cooldown)
+	if b == nil {
+		return cooling, nil
+	}
+
+	drop := [][]byte{}
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		ip := net.IP(k)
+		if len(v) != 8 || !p.contains(ip) || used.isSet(p.index(ip)) {
+			drop = append(drop, k)
+			continue
+		}
+		used.set(p.index(ip))
+		cooling[p.index(ip)] = time.Unix(0,
+			int64(binary.BigEndian.Uint64(v)))
+	}
+
+	for _, k := range drop {
+		if !tx.Writable() {
+			break
+		}
+		err := b.Delete(k)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cooling, nil
+
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Addresses cooling down after a release aren't counted as allocated, nor
+// towards the high-water mark.
+func TestCooldownCapacity(t *testing.T) {
+
+	h := newTestHandler(t, func(h *Handler) {
+		h.reuseCooldown = time.Hour
+	})
+
+	for _, d := range []string{"a", "b", "c"} {
+		expect(t, h, "GET", "/get/"+d, "dev1", http.StatusOK)
+	}
+	expect(t, h, "POST", "/release/a", "dev1", http.StatusOK)
+	expect(t, h, "POST", "/release/b", "dev1", http.StatusOK)
+	expect(t, h, "GET", "/get/d", "dev1", http.StatusOK)
+
+	c := map[string]uint32{}
+	err := json.Unmarshal([]byte(expect(t, h, "GET", "/capacity", "dev1",
+		http.StatusOK)), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uint32{"size": 254, "allocated": 2, "cooling": 2,
+		"free": 250, "high_water": 3}
+	for k, v := range want {
+		if c[k] != v {
+			t.Errorf("%s: got %d, want %d", k, c[k], v)
+		}
+	}
+
+	// And likewise after the state is rebuilt from the database.
+	err = h.scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.mu.Lock()
+	n, hw := h.deviceCount(), h.highWater
+	h.mu.Unlock()
+	if n != 2 || hw != 3 {
+		t.Errorf("after scan: allocated %d, high water %d", n, hw)
+	}
+
+}
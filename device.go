@@ -0,0 +1,103 @@
+package main
+
+//
+// Device name checks.
+//
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// A DNS label: lower-case letters, digits and hyphens, not starting or
+// ending with a hyphen, at most 63 characters.
+var dnsLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Canonicalises a device name taken from a request path: /get/host/ is
+// the same device as /get/host.
+func canonicalDevice(arg string) string {
+	return strings.TrimSuffix(arg, "/")
+}
+
+// Checks a device name can't escape a directory when used as a file
+// name, as the OpenVPN client-config-dir does: it has no slashes,
+// backslashes or control characters, and isn't . or ...
+func fileSafe(device string) error {
+
+	if strings.ContainsAny(device, `/\`) {
+		return errors.New("device names can't contain / or \\")
+	}
+	if device == "." || device == ".." {
+		return errors.New("device names can't be . or ..")
+	}
+
+	return nil
+
+}
+
+// Checks a device name is acceptable for a new allocation.  With -tenant,
+// it's the name without the tenant which is checked.
+func (h *Handler) checkDevice(device string) error {
+
+	device = h.bareDevice(device)
+
+	// Names end up in file paths, as the OpenVPN client-config-dir and
+	// the zone and hosts files have them, so they can't contain a slash,
+	// be . or .., or contain NUL or other control characters; something
+	// writing a file per device shouldn't have to check.
+	if strings.Contains(device, "/") {
+		return errors.New("device names can't contain /")
+	}
+	if device == "." || device == ".." {
+		return errors.New("device names can't be . or ..")
+	}
+	if strings.IndexFunc(device, func(c rune) bool {
+		return c < 0x20 || c == 0x7f
+	}) >= 0 {
+		return errors.New("device names can't contain control " +
+			"characters")
+	}
+
+	// -path-safe-device refuses backslashes too, for Windows paths.
+	if h.pathSafeDevice {
+		err := fileSafe(device)
+		if err != nil {
+			return err
+		}
+	}
+
+	// With -pools, the name chooses the pool.
+	if h.set != nil {
+		if p := h.set.forDevice(device); p != h {
+			return fmt.Errorf("the name belongs to pool %s", p.name)
+		}
+	}
+
+	if h.strictDevice && !dnsLabel.MatchString(device) {
+		return errors.New("device names must be DNS labels: a-z, 0-9 " +
+			"and -, at most 63 characters, not starting or ending " +
+			"with -")
+	}
+
+	return nil
+
+}
+
+// Checks a device name, answering 400 if it's unacceptable.  Returns false
+// if a response has been written.
+func (h *Handler) deviceOK(w http.ResponseWriter, r *http.Request,
+	device string) bool {
+
+	err := h.checkDevice(device)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest,
+			"Bad device name: "+err.Error()+".")
+		return false
+	}
+
+	return true
+
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Device names which could escape a directory, however they're encoded,
+// are refused before anything is allocated.
+func TestDeviceNames(t *testing.T) {
+
+	tests := []struct {
+		method string
+		target string
+		code   int
+	}{
+		{"GET", "/get/host", http.StatusOK},
+		{"GET", "/get/host/", http.StatusOK},
+		{"GET", "/get/a-b.c", http.StatusOK},
+		{"GET", "/get/..%252f", http.StatusOK},
+		{"GET", "/get/a/b", http.StatusBadRequest},
+		{"GET", "/get/a%2fb", http.StatusBadRequest},
+		{"GET", "/get//a", http.StatusBadRequest},
+		{"GET", "/get/..%2fetc%2fpasswd", http.StatusBadRequest},
+		{"GET", "/get/%2e%2e/etc/passwd", http.StatusBadRequest},
+		{"GET", "/get/%2e%2e%2fetc", http.StatusBadRequest},
+		{"GET", "/get/%2e%2e", http.StatusBadRequest},
+		{"GET", "/get/.", http.StatusBadRequest},
+		{"GET", "/get/a%00b", http.StatusBadRequest},
+		{"GET", "/get/a%00", http.StatusBadRequest},
+		{"GET", "/get/a%0ab", http.StatusBadRequest},
+		{"GET", "/openvpn-ccd/..%2f..%2fx", http.StatusBadRequest},
+		{"POST", "/reserve/..%2fx?address=10.1.0.9", http.StatusBadRequest},
+	}
+
+	h := newTestHandler(t, nil)
+	for _, tc := range tests {
+		expect(t, h, tc.method, tc.target, "dev1", tc.code)
+	}
+
+	// Nothing refused was allocated.
+	h.mu.Lock()
+	n := h.deviceCount()
+	h.mu.Unlock()
+	if n != 3 {
+		t.Errorf("got %d devices, want 3", n)
+	}
+
+}
+
+// -path-safe-device refuses backslashes as well.
+func TestDevicePathSafe(t *testing.T) {
+
+	h := newTestHandler(t, func(h *Handler) {
+		h.pathSafeDevice = true
+	})
+	expect(t, h, "GET", "/get/host", "dev1", http.StatusOK)
+	expect(t, h, "GET", "/get/..%5cx", "dev1", http.StatusBadRequest)
+
+	h = newTestHandler(t, nil)
+	expect(t, h, "GET", "/get/..%5cx", "dev1", http.StatusOK)
+
+}
+
+// A trailing slash names the same device on every endpoint, and empty
+// segments are refused rather than making odd keys.
+func TestDeviceCanonical(t *testing.T) {
+
+	h := newTestHandler(t, func(h *Handler) {
+		h.ttl = time.Hour
+	})
+	addr := expect(t, h, "GET", "/get/host", "dev1", http.StatusOK)
+
+	tests := []struct {
+		method string
+		target string
+		code   int
+	}{
+		{"GET", "/get/host/", http.StatusOK},
+		{"GET", "/verify/host/?expect=" + addr, http.StatusOK},
+		{"GET", "/get//host", http.StatusBadRequest},
+		{"GET", "/get/host//", http.StatusBadRequest},
+		{"GET", "/get/a//b", http.StatusBadRequest},
+		{"POST", "/renew/host/", http.StatusOK},
+		{"POST", "/release/host/", http.StatusOK},
+		{"GET", "/verify/host?expect=" + addr, http.StatusNotFound},
+	}
+
+	for _, tc := range tests {
+		body := expect(t, h, tc.method, tc.target, "dev1", tc.code)
+		if tc.target == "/get/host/" && body != addr {
+			t.Errorf("/get/host/: got %q, want %q", body, addr)
+		}
+	}
+
+	h.mu.Lock()
+	n := h.deviceCount()
+	h.mu.Unlock()
+	if n != 0 {
+		t.Errorf("got %d devices, want none", n)
+	}
+
+}
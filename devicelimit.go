@@ -0,0 +1,98 @@
+package main
+
+//
+// Device limit.  With -max-devices, allocations stop at that many devices
+// however many addresses are free, e.g. for licensing, and a new device
+// gets 403 rather than the pool exhaustion error.  Addresses are only
+// claimed in write transactions, one at a time, so checking the count
+// just before claiming can't let two allocations past the limit.
+//
+// With -max-devices-per-client, which needs -claim, a client certificate
+// CN may own at most that many devices in a pool, so a runaway script
+// can't use the pool up with junk names, and a new device past the limit
+// gets 403.  Counting a client's devices means reading every allocation,
+// so it's only done for new devices.
+//
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	errTooMany       = errors.New("device limit reached")
+	errClientTooMany = errors.New("client device limit reached")
+)
+
+// Number of devices with addresses in the pool: the addresses used, less
+// those cooling down or in reserved blocks.  Called with h.mu held.
+func (h *Handler) deviceCount() uint32 {
+	return h.used.count - uint32(len(h.cooling)) - h.blocked
+}
+
+// Returns errTooMany if another device would pass -max-devices.  Called
+// inside the write transaction which claims its address.
+func (h *Handler) checkLimit() error {
+
+	if h.maxDevices == 0 {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.deviceCount() >= h.maxDevices {
+		return errTooMany
+	}
+
+	return nil
+
+}
+
+// Number of devices in the pool owned by a client CN.
+func (h *Handler) clientDevices(tx *bolt.Tx, cn string) (uint32, error) {
+
+	n := uint32(0)
+	c := tx.Bucket(h.buckets.addresses).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		rec, err := decodeRecord(v)
+		if err != nil {
+			return 0, err
+		}
+		if rec.Owner == cn {
+			n++
+		}
+	}
+
+	return n, nil
+
+}
+
+// Returns errClientTooMany if another device for the client would pass
+// -max-devices-per-client, given the devices it already owns.
+func (h *Handler) checkClientLimit(owned uint32) error {
+
+	if h.maxPerClient > 0 && owned >= h.maxPerClient {
+		return errClientTooMany
+	}
+
+	return nil
+
+}
+
+// Answers 403 for an allocation refused by -max-devices.
+func (h *Handler) writeTooMany(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusForbidden,
+		"The limit of "+strconv.FormatUint(uint64(h.maxDevices), 10)+
+			" devices has been reached.")
+}
+
+// Answers 403 for an allocation refused by -max-devices-per-client.
+func (h *Handler) writeClientTooMany(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusForbidden,
+		"The limit of "+strconv.FormatUint(uint64(h.maxPerClient), 10)+
+			" devices per client has been reached.")
+}
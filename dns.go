@@ -0,0 +1,266 @@
+package main
+
+//
+// An embedded DNS responder.  With -dns-listen, A and AAAA queries for
+// <device>.<-domain> are answered over UDP from the database, so a resolver
+// forwarding the domain here always sees current allocations: a device's
+// records appear when it's allocated and go when it's released, with no
+// hosts file to regenerate.  Devices are found in the pool their name
+// selects, and only names which are DNS labels can be looked up, as for
+// /hosts.  With -tenant, a tenant's devices are <device>.<tenant>.<-domain>,
+// for tenants whose names are DNS labels too.  Names outside the domain
+// are refused, and negative answers carry an SOA for the domain so that
+// resolvers cache them, for the TTL, as RFC 2308 has it.
+//
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// DNS header flags, types and response codes used.
+const (
+	dnsFlagResponse      = 1 << 15
+	dnsFlagAuthoritative = 1 << 10
+	dnsFlagRecursion     = 1 << 8
+
+	dnsTypeA    = 1
+	dnsTypeSOA  = 6
+	dnsTypeAAAA = 28
+	dnsTypeAny  = 255
+
+	dnsClassIN  = 1
+	dnsClassAny = 255
+
+	dnsNoError  = 0
+	dnsFormErr  = 1
+	dnsServFail = 2
+	dnsNXDomain = 3
+	dnsNotImp   = 4
+	dnsRefused  = 5
+
+	// Largest query read; queries are a single question.
+	dnsMaxQuery = 512
+)
+
+// Names of the response codes, for metrics.
+var dnsRcodes = map[int]string{
+	dnsNoError:  "NOERROR",
+	dnsFormErr:  "FORMERR",
+	dnsServFail: "SERVFAIL",
+	dnsNXDomain: "NXDOMAIN",
+	dnsNotImp:   "NOTIMP",
+	dnsRefused:  "REFUSED",
+}
+
+// Answers DNS queries on a UDP socket for names under domain, with records
+// of the TTL given in seconds, until the socket is closed.
+func serveDNS(conn net.PacketConn, ps *poolSet, domain string,
+	ttl uint32) {
+
+	buf := make([]byte, dnsMaxQuery)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("DNS: %s", err)
+			return
+		}
+		resp := ps.answerDNS(buf[:n], strings.ToLower(domain), ttl)
+		if resp == nil {
+			continue
+		}
+		_, err = conn.WriteTo(resp, addr)
+		if err != nil {
+			log.Printf("DNS: %s: %s", addr, err)
+		}
+	}
+
+}
+
+// Appends a name, as labels, to a DNS message.
+func appendDNSName(b []byte, name string) []byte {
+
+	for _, l := range strings.Split(name, ".") {
+		b = append(append(b, byte(len(l))), l...)
+	}
+
+	return append(b, 0)
+
+}
+
+// Appends a resource record, given its name already encoded, to a DNS
+// message.
+func appendDNSRecord(b, name []byte, rtype uint16, ttl uint32,
+	data []byte) []byte {
+
+	b = append(b, name...)
+	b = binary.BigEndian.AppendUint16(b, rtype)
+	b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+
+	return append(b, data...)
+
+}
+
+// Returns the domain's SOA record data, with the serial given.  The
+// minimum, which resolvers cache negative answers for, is the TTL.
+func dnsSOA(domain string, serial, ttl uint32) []byte {
+
+	b := appendDNSName(nil, domain)
+	b = appendDNSName(b, "hostmaster."+domain)
+	b = binary.BigEndian.AppendUint32(b, serial)
+	b = binary.BigEndian.AppendUint32(b, 3600)
+	b = binary.BigEndian.AppendUint32(b, 600)
+	b = binary.BigEndian.AppendUint32(b, 86400)
+
+	return binary.BigEndian.AppendUint32(b, ttl)
+
+}
+
+// Returns the response to a query, or nil if it's not worth answering.
+func (ps *poolSet) answerDNS(q []byte, domain string, ttl uint32) []byte {
+
+	if len(q) < 12 {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(q[2:])
+	if flags&dnsFlagResponse != 0 {
+		return nil
+	}
+
+	// The answer's header: the query's ID and recursion desired bit, and
+	// no counts until the question's been understood.
+	resp := make([]byte, 12, dnsMaxQuery)
+	copy(resp, q[:2])
+	rflags := uint16(dnsFlagResponse | dnsFlagAuthoritative)
+	rflags |= flags & dnsFlagRecursion
+	reply := func(rcode int, answers uint16) []byte {
+		dnsQueries.WithLabelValues(dnsRcodes[rcode]).Inc()
+		binary.BigEndian.PutUint16(resp[2:], rflags|uint16(rcode))
+		binary.BigEndian.PutUint16(resp[6:], answers)
+		return resp
+	}
+
+	// Negative answers carry the SOA, so resolvers can cache them.  The
+	// serial is the time, as records change with every allocation.
+	serial := uint32(ps.handlers[0].now().Unix())
+	soa := func(rcode int) []byte {
+		resp = appendDNSRecord(resp, appendDNSName(nil, domain),
+			dnsTypeSOA, ttl, dnsSOA(domain, serial, ttl))
+		binary.BigEndian.PutUint16(resp[8:], 1)
+		return reply(rcode, 0)
+	}
+
+	if (flags>>11)&0xf != 0 {
+		return reply(dnsNotImp, 0)
+	}
+	if binary.BigEndian.Uint16(q[4:]) != 1 {
+		return reply(dnsFormErr, 0)
+	}
+
+	// The question: the name, as labels with no compression, then the
+	// type and class.
+	labels := []string{}
+	i := 12
+	for {
+		if i >= len(q) {
+			return reply(dnsFormErr, 0)
+		}
+		l := int(q[i])
+		if l == 0 {
+			i++
+			break
+		}
+		if l > 63 || i+1+l > len(q) {
+			return reply(dnsFormErr, 0)
+		}
+		labels = append(labels, strings.ToLower(string(q[i+1:i+1+l])))
+		i += 1 + l
+	}
+	if i+4 > len(q) {
+		return reply(dnsFormErr, 0)
+	}
+	qtype := binary.BigEndian.Uint16(q[i:])
+	qclass := binary.BigEndian.Uint16(q[i+2:])
+	resp = append(resp, q[12:i+4]...)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+
+	if qclass != dnsClassIN && qclass != dnsClassAny {
+		return reply(dnsRefused, 0)
+	}
+
+	// Answers point back to the question's name.
+	qname := []byte{0xc0, 12}
+
+	name := strings.Join(labels, ".")
+	if name == domain {
+		if qtype != dnsTypeSOA && qtype != dnsTypeAny {
+			return soa(dnsNoError)
+		}
+		resp = appendDNSRecord(resp, qname, dnsTypeSOA, ttl,
+			dnsSOA(domain, serial, ttl))
+		return reply(dnsNoError, 1)
+	}
+	rest, ok := strings.CutSuffix(name, "."+domain)
+	if !ok {
+		return reply(dnsRefused, 0)
+	}
+
+	// With -tenant, names are <device>.<tenant>.<domain>.
+	device, key := rest, rest
+	if ps.handlers[0].tenantFrom != "" {
+		var tenant string
+		device, tenant, ok = strings.Cut(rest, ".")
+		if !ok || !dnsLabel.MatchString(tenant) {
+			return soa(dnsNXDomain)
+		}
+		key = tenant + ":" + device
+	}
+	if !dnsLabel.MatchString(device) {
+		return soa(dnsNXDomain)
+	}
+
+	h := ps.forDevice(device)
+	if !h.isActive() {
+		return reply(dnsServFail, 0)
+	}
+	var rec *record
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		rec, err = h.getAllocation(tx, key)
+		return err
+	})
+	if err != nil {
+		return reply(dnsServFail, 0)
+	}
+	if rec == nil {
+		return soa(dnsNXDomain)
+	}
+
+	answers := uint16(0)
+	for _, ip := range []net.IP{rec.Address, rec.Address6} {
+		if ip == nil {
+			continue
+		}
+		rtype, data := uint16(dnsTypeAAAA), ip.To16()
+		if ip4 := ip.To4(); ip4 != nil {
+			rtype, data = dnsTypeA, ip4
+		}
+		if qtype != rtype && qtype != dnsTypeAny {
+			continue
+		}
+		resp = appendDNSRecord(resp, qname, rtype, ttl, data)
+		answers++
+	}
+	if answers == 0 {
+		return soa(dnsNoError)
+	}
+
+	return reply(dnsNoError, answers)
+
+}
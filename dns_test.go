@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Returns a query for a name and type.
+func dnsQuery(name string, qtype uint16) []byte {
+
+	q := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	q = appendDNSName(q, name)
+	q = binary.BigEndian.AppendUint16(q, qtype)
+
+	return binary.BigEndian.AppendUint16(q, dnsClassIN)
+
+}
+
+// What a test reads from a response: the response code, the answer and
+// authority counts, and the first answer's type and data.
+type dnsResult struct {
+	rcode     int
+	answers   int
+	authority int
+	rtype     uint16
+	data      []byte
+}
+
+func parseDNSResponse(t *testing.T, q, resp []byte) dnsResult {
+
+	t.Helper()
+
+	if len(resp) < len(q) || resp[0] != q[0] || resp[1] != q[1] {
+		t.Fatalf("bad response %x", resp)
+	}
+
+	r := dnsResult{
+		rcode:     int(resp[3] & 0xf),
+		answers:   int(binary.BigEndian.Uint16(resp[6:])),
+		authority: int(binary.BigEndian.Uint16(resp[8:])),
+	}
+	if r.answers > 0 {
+		rr := resp[len(q):]
+		r.rtype = binary.BigEndian.Uint16(rr[2:])
+		n := binary.BigEndian.Uint16(rr[10:])
+		r.data = rr[12 : 12+n]
+	}
+
+	return r
+
+}
+
+func TestDNS(t *testing.T) {
+
+	h := newTestHandler(t, func(h *Handler) {
+		h.domain = "vpn.example.com"
+	})
+	ip := net.ParseIP(strings.TrimSpace(
+		expect(t, h, "GET", "/get/laptop", "dev1", http.StatusOK)))
+	expect(t, h, "GET", "/get/phone", "dev1", http.StatusOK)
+	expect(t, h, "POST", "/release/phone", "dev1", http.StatusOK)
+
+	for _, c := range []struct {
+		name      string
+		qtype     uint16
+		rcode     int
+		answers   int
+		authority int
+		rtype     uint16
+	}{
+		{"laptop.vpn.example.com", dnsTypeA, dnsNoError, 1, 0, dnsTypeA},
+		{"LAPTOP.Vpn.Example.com", dnsTypeA, dnsNoError, 1, 0, dnsTypeA},
+		{"laptop.vpn.example.com", dnsTypeAny, dnsNoError, 1, 0,
+			dnsTypeA},
+		{"laptop.vpn.example.com", dnsTypeAAAA, dnsNoError, 0, 1, 0},
+		{"phone.vpn.example.com", dnsTypeA, dnsNXDomain, 0, 1, 0},
+		{"nobody.vpn.example.com", dnsTypeA, dnsNXDomain, 0, 1, 0},
+		{"a.b.vpn.example.com", dnsTypeA, dnsNXDomain, 0, 1, 0},
+		{"vpn.example.com", dnsTypeSOA, dnsNoError, 1, 0, dnsTypeSOA},
+		{"vpn.example.com", dnsTypeA, dnsNoError, 0, 1, 0},
+		{"laptop.example.org", dnsTypeA, dnsRefused, 0, 0, 0},
+	} {
+		q := dnsQuery(c.name, c.qtype)
+		r := parseDNSResponse(t, q,
+			h.set.answerDNS(q, h.domain, 60))
+		if r.rcode != c.rcode || r.answers != c.answers ||
+			r.authority != c.authority || r.rtype != c.rtype {
+			t.Errorf("%s type %d: got %+v", c.name, c.qtype, r)
+			continue
+		}
+		if r.rtype == dnsTypeA && !net.IP(r.data).Equal(ip) {
+			t.Errorf("%s: got %s, want %s", c.name,
+				net.IP(r.data), ip)
+		}
+	}
+
+	// Responses and malformed queries aren't answered, or get FORMERR.
+	q := dnsQuery("laptop.vpn.example.com", dnsTypeA)
+	q[2] |= 0x80
+	if resp := h.set.answerDNS(q, h.domain, 60); resp != nil {
+		t.Errorf("answered a response: %x", resp)
+	}
+	q = dnsQuery("laptop.vpn.example.com", dnsTypeA)
+	r := parseDNSResponse(t, q[:12],
+		h.set.answerDNS(q[:len(q)-3], h.domain, 60))
+	if r.rcode != dnsFormErr {
+		t.Errorf("truncated query: got %+v", r)
+	}
+
+}
+
+// With -tenant, a tenant's devices are under a label of its own.
+func TestDNSTenant(t *testing.T) {
+
+	h := newTestHandler(t, func(h *Handler) {
+		h.domain = "vpn.example.com"
+		h.tenantFrom = "header"
+	})
+	for _, tenant := range []string{"red", "blue"} {
+		r := httptest.NewRequest("GET", "/get/gw", nil)
+		r.Header.Set("X-Tenant", tenant)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d", tenant, w.Code)
+		}
+	}
+
+	addrs := map[string]string{}
+	for _, name := range []string{"gw.red.vpn.example.com",
+		"gw.blue.vpn.example.com"} {
+		q := dnsQuery(name, dnsTypeA)
+		r := parseDNSResponse(t, q, h.set.answerDNS(q, h.domain, 60))
+		if r.rcode != dnsNoError || r.answers != 1 {
+			t.Fatalf("%s: got %+v", name, r)
+		}
+		addrs[net.IP(r.data).String()] = name
+	}
+	if len(addrs) != 2 {
+		t.Errorf("tenants' gw resolve to the same address: %v", addrs)
+	}
+
+	for _, name := range []string{"gw.vpn.example.com",
+		"gw.green.vpn.example.com"} {
+		q := dnsQuery(name, dnsTypeA)
+		r := parseDNSResponse(t, q, h.set.answerDNS(q, h.domain, 60))
+		if r.rcode != dnsNXDomain {
+			t.Errorf("%s: got %+v", name, r)
+		}
+	}
+
+}
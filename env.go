@@ -0,0 +1,47 @@
+package main
+
+//
+// Settings from the environment.  Any flag not given on the command line
+// can be set by an environment variable named for it, ADDR_ALLOC_ then the
+// flag name in upper case with - as _, e.g. ADDR_ALLOC_POOL for -pool or
+// ADDR_ALLOC_CA_CERT for -ca-cert, which suits container deployments.
+//
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Environment variable setting a flag.
+func flagEnv(name string) string {
+	return "ADDR_ALLOC_" +
+		strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Sets flags not given on the command line from the environment.
+func flagsFromEnv() error {
+
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] {
+			return
+		}
+		v, ok := os.LookupEnv(flagEnv(f.Name))
+		if !ok {
+			return
+		}
+		if e := f.Value.Set(v); e != nil {
+			err = fmt.Errorf("%s: %s", flagEnv(f.Name), e)
+		}
+	})
+
+	return err
+
+}
@@ -0,0 +1,135 @@
+package main
+
+//
+// Event log file.  With -event-log, every allocation event is also written
+// to a file as a line of JSON, in log/slog's JSON format, so a deployment
+// which keeps the database but not stdout still has a trail of changes.
+// The file is rotated by size: at -event-log-max-size it's renamed to
+// .1, the previous .1 to .2 and so on, keeping -event-log-backups of them.
+//
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// A file which rotates itself once it reaches a size.
+type rotator struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+// Opens a rotating file, appending to it if it exists.
+func newRotator(path string, maxSize int64, backups int) (*rotator, error) {
+
+	r := &rotator{path: path, maxSize: maxSize, backups: backups}
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+
+}
+
+func (r *rotator) open() error {
+
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f = f
+	r.size = st.Size()
+
+	return nil
+
+}
+
+// Shifts backups along, dropping the oldest, and starts a new file.
+func (r *rotator) rotate() error {
+
+	err := r.f.Close()
+	if err != nil {
+		return err
+	}
+
+	for i := r.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i),
+			fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.backups > 0 {
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+
+	return r.open()
+
+}
+
+// Writes to the file, rotating it first if the write would take it over
+// the maximum size.  A write is never split across files.
+func (r *rotator) Write(p []byte) (int, error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+
+	return n, err
+
+}
+
+// Writes an event to the event log, if there is one, timestamped with the
+// time of the event.
+func (h *Handler) logEvent(ev *event) {
+
+	if h.eventLog == nil {
+		return
+	}
+
+	rec := slog.NewRecord(ev.Time, slog.LevelInfo, ev.Type, 0)
+	if ev.Type == eventPoolLow {
+		rec.AddAttrs(slog.String("pool", ev.Pool),
+			slog.Float64("utilisation", ev.Utilisation))
+		h.eventLog.Handle(context.Background(), rec)
+		return
+	}
+	rec.AddAttrs(slog.String("device", ev.Device),
+		slog.String("address", ev.Address.String()))
+	if ev.PreviousAddress != nil {
+		rec.AddAttrs(slog.String("previous_address",
+			ev.PreviousAddress.String()))
+	}
+	if ev.PreviousDevice != "" {
+		rec.AddAttrs(slog.String("previous_device", ev.PreviousDevice))
+	}
+	if ev.Reason != "" {
+		rec.AddAttrs(slog.String("reason", ev.Reason))
+	}
+
+	h.eventLog.Handle(context.Background(), rec)
+
+}
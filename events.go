@@ -0,0 +1,176 @@
+package main
+
+//
+// Allocation events.  Everything which changes an allocation calls emit
+// once the change is committed, and emit passes the event on to whatever
+// has asked to hear about changes.
+//
+// Hook commands (-on-allocate, -on-release) run with the device name and
+// address as arguments, and also in ADDR_ALLOC_EVENT, ADDR_ALLOC_DEVICE and
+// ADDR_ALLOC_ADDRESS.  They run in the background, so a slow hook never
+// holds up an allocation, and are killed after -hook-timeout.  The
+// -on-pool-low command runs with the pool name and percentage allocated,
+// also in ADDR_ALLOC_POOL and ADDR_ALLOC_UTILISATION.
+//
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Event types.
+const (
+	eventAllocate = "allocate"
+	eventRelease  = "release"
+	eventExpire   = "expire"
+	eventMove     = "move"
+	eventRename   = "rename"
+	eventPoolLow  = "pool_low"
+)
+
+// A change to an allocation.
+type event struct {
+
+	// Event type.
+	Type string `json:"type"`
+
+	// Device name.
+	Device string `json:"device"`
+
+	// Address allocated, or released.
+	Address net.IP `json:"address"`
+
+	// For a move, the old address.
+	PreviousAddress net.IP `json:"previous_address,omitempty"`
+
+	// For a rename, the old device name.
+	PreviousDevice string `json:"previous_device,omitempty"`
+
+	// Reason given for an allocation.
+	Reason string `json:"reason,omitempty"`
+
+	// For pool_low, the pool and the percentage of it allocated.
+	Pool        string  `json:"pool,omitempty"`
+	Utilisation float64 `json:"utilisation,omitempty"`
+
+	// For an event a request caused, the client certificate CN and the
+	// address the request came from.
+	Client string `json:"client,omitempty"`
+	Source string `json:"source,omitempty"`
+
+	// When it happened.
+	Time time.Time `json:"time"`
+}
+
+// Records the request that caused an event, and returns the event.
+func (ev *event) by(r *http.Request) *event {
+
+	ev.Client = clientCN(r)
+	ev.Source = remoteHost(r)
+
+	return ev
+
+}
+
+// Passes on an event.
+func (h *Handler) emit(ev *event) {
+
+	if ev.Time.IsZero() {
+		ev.Time = h.now()
+	}
+
+	h.logEvent(ev)
+	if h.eventStream != nil {
+		h.eventStream.write(ev)
+	}
+	if h.webhooks != nil {
+		h.webhooks.send(ev)
+	}
+	if h.auditing && !h.isReadOnly() {
+		h.audit(ev)
+	}
+
+	if ev.Type != eventPoolLow {
+		h.checkThreshold()
+	}
+
+	switch ev.Type {
+	case eventAllocate:
+		allocations.WithLabelValues(h.name).Inc()
+	case eventRelease:
+		releases.WithLabelValues(h.name).Inc()
+	}
+
+	switch ev.Type {
+	case eventAllocate:
+		h.runHook(h.onAllocate, ev.Type, ev.Device, ev.Address)
+	case eventRelease, eventExpire:
+		h.runHook(h.onRelease, ev.Type, ev.Device, ev.Address)
+	case eventMove:
+		h.runHook(h.onRelease, ev.Type, ev.Device, ev.PreviousAddress)
+		h.runHook(h.onAllocate, ev.Type, ev.Device, ev.Address)
+	case eventRename:
+		h.runHook(h.onRelease, ev.Type, ev.PreviousDevice, ev.Address)
+		h.runHook(h.onAllocate, ev.Type, ev.Device, ev.Address)
+	case eventPoolLow:
+		h.runCommand(h.onPoolLow, ev.Type+" "+ev.Pool,
+			[]string{ev.Pool, fmt.Sprintf("%.1f", ev.Utilisation)},
+			[]string{
+				"ADDR_ALLOC_EVENT=" + ev.Type,
+				"ADDR_ALLOC_POOL=" + ev.Pool,
+				fmt.Sprintf("ADDR_ALLOC_UTILISATION=%.1f",
+					ev.Utilisation),
+			})
+	}
+
+}
+
+// Runs a hook command in the background, logging failures.
+func (h *Handler) runHook(command, kind, device string, addr net.IP) {
+
+	h.runCommand(command, kind+" "+device,
+		[]string{device, addr.String()},
+		[]string{
+			"ADDR_ALLOC_EVENT=" + kind,
+			"ADDR_ALLOC_DEVICE=" + device,
+			"ADDR_ALLOC_ADDRESS=" + addr.String(),
+		})
+
+}
+
+// Runs a command in the background with the arguments and extra
+// environment given, killing it after -hook-timeout and logging failures.
+func (h *Handler) runCommand(command, desc string, args, env []string) {
+
+	if command == "" {
+		return
+	}
+
+	go func() {
+
+		ctx, cancel := context.WithTimeout(context.Background(),
+			h.hookTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, command, args...)
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		err := cmd.Run()
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Printf("Hook %s for %s: timed out after %s",
+				command, desc, h.hookTimeout)
+		} else if err != nil {
+			log.Printf("Hook %s for %s: %s", command, desc, err)
+		}
+
+	}()
+
+}
@@ -0,0 +1,73 @@
+package main
+
+//
+// Event stream.  With -event-stream, every event is written as a line of
+// JSON, the event as hooks and /audit see it, to stdout, an inherited file
+// descriptor (fd:3) or a file, so a sidecar such as a DNS updater can
+// follow it without an HTTP receiver or parsing the human-readable
+// output.  Streaming to stdout moves that output to stderr, so the stream
+// carries nothing but events.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A stream of events as JSON lines.
+type eventStream struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Opens the stream -event-stream names: stdout, fd:<n>, or a file path,
+// appended to.
+func openEventStream(dest string) (*eventStream, error) {
+
+	switch {
+	case dest == "stdout":
+		s := &eventStream{w: os.Stdout}
+		os.Stdout = os.Stderr
+		return s, nil
+	case strings.HasPrefix(dest, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(dest, "fd:"))
+		if err != nil || fd < 1 {
+			return nil, fmt.Errorf("bad descriptor %s", dest)
+		}
+		return &eventStream{w: os.NewFile(uintptr(fd), dest)}, nil
+	}
+
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &eventStream{w: f}, nil
+
+}
+
+// Writes an event to the stream, as a single write so lines from
+// concurrent events never interleave.
+func (s *eventStream) write(ev *event) {
+
+	b, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Event stream: %s", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(append(b, '\n'))
+	if err != nil {
+		log.Printf("Event stream: %s", err)
+	}
+
+}
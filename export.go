@@ -0,0 +1,236 @@
+package main
+
+//
+// Exporting allocations.  An export carries the time it was taken, which a
+// client keeping a copy in sync passes back as ?since= next time to get
+// only the allocations written since, plus tombstones for those removed.
+// It's a JSON document, which /import takes back:
+//
+//   {"generated": "2026-01-02T15:04:05Z",
+//    "allocations": [{"device": "host1", "address": "10.8.0.2",
+//                     "allocated": "2026-01-01T09:00:00Z",
+//                     "expires": "2026-02-01T09:00:00Z",
+//                     "reason": "INC-123", "lease": "..."}],
+//    "removed": [{"device": "host2", "address": "10.8.0.3",
+//                 "removed": "2026-01-02T10:00:00Z", "cause": "release"}]}
+//
+// Each allocation has the fields of its record, those not set left out.
+//
+// The time is that of the last write the export includes, kept in the
+// meta bucket, so that a write under way as the export is taken, stamped
+// a moment before it but committed after, comes in the next one.
+// Tombstones are kept for -tombstone-ttl, so a client syncing less often
+// than that should take a whole export instead.
+//
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// An export.
+type export struct {
+
+	// When the export was taken.
+	Generated time.Time `json:"generated"`
+
+	// Allocations, all of them or those written since ?since=.
+	Allocations []allocation `json:"allocations"`
+
+	// With ?since=, allocations removed since.
+	Removed []tombstone `json:"removed,omitempty"`
+}
+
+// Returns the time of the last write to allocations or tombstones, or the
+// zero time if none has been noted.
+func (h *Handler) getModified(tx *bolt.Tx) time.Time {
+
+	b := tx.Bucket(h.buckets.meta)
+	if b == nil {
+		return time.Time{}
+	}
+
+	v := b.Get([]byte("modified"))
+	if len(v) != 8 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, int64(binary.BigEndian.Uint64(v))).UTC()
+
+}
+
+// Notes a write to allocations or tombstones, stamped t, in the
+// transaction making it.
+func (h *Handler) noteModified(tx *bolt.Tx, t time.Time) error {
+
+	if !t.After(h.getModified(tx)) {
+		return nil
+	}
+
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(t.UnixNano()))
+
+	return tx.Bucket(h.buckets.meta).Put([]byte("modified"), v)
+
+}
+
+// Drops tombstones older than -tombstone-ttl.  With -after-release=gone,
+// releases are kept for -gone-ttl instead, as they refuse the device.
+func (h *Handler) pruneTombstones(now time.Time) error {
+
+	cutoff := now.Add(-h.tombstoneTTL)
+	pruned := 0
+
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(h.buckets.removed)
+		old := [][]byte{}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			t := &tombstone{}
+			err := json.Unmarshal(v, t)
+			if err == nil && h.afterRelease == "gone" &&
+				t.Cause == eventRelease {
+				if h.goneTTL == 0 ||
+					now.Sub(t.Removed) < h.goneTTL {
+					continue
+				}
+			} else if err == nil && !t.Removed.Before(cutoff) {
+				continue
+			}
+			old = append(old, k)
+		}
+		for _, k := range old {
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		pruned = len(old)
+		return nil
+	})
+	if err == nil && pruned > 0 {
+		log.Printf("Pruned %d tombstones", pruned)
+	}
+
+	return err
+
+}
+
+// Calls alloc for each allocation written after since, or every one if
+// since is zero, then unless since is zero calls removed for each
+// allocation removed after it.
+func (h *Handler) exportEach(tx *bolt.Tx, since time.Time,
+	alloc func(*allocation) error, removed func(*tombstone) error) error {
+
+	c := tx.Bucket(h.buckets.addresses).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		rec, err := decodeRecord(v)
+		if err != nil {
+			return err
+		}
+		if !since.IsZero() && !rec.modified().After(since) {
+			continue
+		}
+		err = alloc(&allocation{Device: string(k), record: *rec})
+		if err != nil {
+			return err
+		}
+	}
+
+	if since.IsZero() {
+		return nil
+	}
+
+	c = tx.Bucket(h.buckets.removed).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		t := &tombstone{}
+		err := json.Unmarshal(v, t)
+		if err != nil {
+			return err
+		}
+		if !t.Removed.After(since) {
+			continue
+		}
+		err = removed(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// Exports allocations as JSON, or with ?format=jsonl as JSON Lines: one
+// allocation per line, then with ?since= one tombstone per line, told
+// apart by their "removed" time.  JSON Lines are streamed from a single
+// read transaction rather than built up in memory, so a failure part way
+// through truncates the output.  ?format=hosts and zone are for DNS; see
+// hosts.go.
+func (h *Handler) ServeExport(w http.ResponseWriter, r *http.Request) {
+
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest,
+				"Bad ?since=, expected an RFC 3339 time.")
+			return
+		}
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+	case "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		enc := json.NewEncoder(w)
+		h.db.View(func(tx *bolt.Tx) error {
+			return h.exportEach(tx, since,
+				func(a *allocation) error { return enc.Encode(a) },
+				func(t *tombstone) error { return enc.Encode(t) })
+		})
+		return
+	case "hosts", "zone":
+		h.serveHosts(w, r, r.URL.Query().Get("format"))
+		return
+	default:
+		writeError(w, r, http.StatusBadRequest,
+			"Bad ?format=, use json, jsonl, hosts or zone.")
+		return
+	}
+
+	exp := &export{Allocations: []allocation{}}
+
+	err := h.db.View(func(tx *bolt.Tx) error {
+		exp.Generated = h.getModified(tx)
+		if exp.Generated.IsZero() {
+			exp.Generated = h.now()
+		}
+		return h.exportEach(tx, since,
+			func(a *allocation) error {
+				exp.Allocations = append(exp.Allocations, *a)
+				return nil
+			},
+			func(t *tombstone) error {
+				exp.Removed = append(exp.Removed, *t)
+				return nil
+			})
+	})
+	if err != nil {
+		writeLookupFailed(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(exp)
+	return
+
+}
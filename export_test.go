@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Takes an export, with ?since= if it's not zero.
+func getExport(t *testing.T, h *Handler, since time.Time) *export {
+
+	t.Helper()
+
+	target := "/export"
+	if !since.IsZero() {
+		target += "?since=" + url.QueryEscape(
+			since.Format(time.RFC3339Nano))
+	}
+
+	exp := &export{}
+	err := json.Unmarshal([]byte(expect(t, h, "GET", target, "admin",
+		http.StatusOK)), exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return exp
+
+}
+
+// An export's time is that of the last write it includes, so passing it
+// back as ?since= gets exactly the writes after.
+func TestExportGenerated(t *testing.T) {
+
+	start := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	clk := &testClock{t: start}
+	h := newTestHandler(t, func(h *Handler) {
+		h.clock = clk
+	})
+
+	expect(t, h, "GET", "/get/a", "dev1", http.StatusOK)
+	clk.advance(time.Hour)
+
+	exp := getExport(t, h, time.Time{})
+	if !exp.Generated.Equal(start) || len(exp.Allocations) != 1 {
+		t.Fatalf("got %s, %d allocations, want %s, 1", exp.Generated,
+			len(exp.Allocations), start)
+	}
+
+	clk.advance(time.Minute)
+	expect(t, h, "GET", "/get/b", "dev1", http.StatusOK)
+	expect(t, h, "POST", "/release/a", "dev1", http.StatusOK)
+
+	inc := getExport(t, h, exp.Generated)
+	want := start.Add(time.Hour + time.Minute)
+	if !inc.Generated.Equal(want) {
+		t.Errorf("since: generated %s, want %s", inc.Generated, want)
+	}
+	if len(inc.Allocations) != 1 || inc.Allocations[0].Device != "b" ||
+		len(inc.Removed) != 1 || inc.Removed[0].Device != "a" {
+		t.Errorf("since: got %+v", inc)
+	}
+
+	again := getExport(t, h, inc.Generated)
+	if len(again.Allocations) != 0 || len(again.Removed) != 0 {
+		t.Errorf("since the last: got %+v", again)
+	}
+
+}
+
+// Tombstones go after -tombstone-ttl, but releases refused with
+// -after-release=gone stay for -gone-ttl.
+func TestPruneTombstones(t *testing.T) {
+
+	tests := []struct {
+		afterRelease string
+		goneTTL      time.Duration
+		after        time.Duration
+		kept         bool
+	}{
+		{"reallocate", 0, 23 * time.Hour, true},
+		{"reallocate", 0, 25 * time.Hour, false},
+		{"gone", 0, 1000 * time.Hour, true},
+		{"gone", 48 * time.Hour, 25 * time.Hour, true},
+		{"gone", 48 * time.Hour, 49 * time.Hour, false},
+	}
+
+	for _, tc := range tests {
+
+		clk := &testClock{t: time.Date(2026, 1, 2, 0, 0, 0, 0,
+			time.UTC)}
+		h := newTestHandler(t, func(h *Handler) {
+			h.clock = clk
+			h.tombstoneTTL = 24 * time.Hour
+			h.afterRelease = tc.afterRelease
+			h.goneTTL = tc.goneTTL
+		})
+		expect(t, h, "GET", "/get/a", "dev1", http.StatusOK)
+		expect(t, h, "POST", "/release/a", "dev1", http.StatusOK)
+
+		clk.advance(tc.after)
+		if err := h.pruneTombstones(h.now()); err != nil {
+			t.Fatal(err)
+		}
+
+		var kept bool
+		err := h.db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket(h.buckets.removed)
+			kept = b.Get([]byte("a")) != nil
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kept != tc.kept {
+			t.Errorf("%s, gone-ttl %s, after %s: kept %v",
+				tc.afterRelease, tc.goneTTL, tc.after, kept)
+		}
+
+	}
+
+}
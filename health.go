@@ -0,0 +1,60 @@
+package main
+
+//
+// Health checks, e.g. for Kubernetes probes.  /healthz answers 200 while
+// the process is serving at all, even as a cold standby.  /readyz answers
+// 200 only once the database is open and takes a write transaction, so a
+// cold standby, a read-only instance or one whose database has failed is
+// taken out of service.  The transaction is rolled back, so a probe writes
+// nothing.  Both are also served on -metrics-listen, for probes which have
+// no client certificate.
+//
+
+import (
+	"io"
+	"net/http"
+)
+
+// Answers 200 while the server is up.
+func (h *Handler) ServeHealth(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, "OK.")
+	return
+
+}
+
+// Answers 200 if the allocator can serve and write allocations, else 503.
+func (h *Handler) ServeReady(w http.ResponseWriter, r *http.Request) {
+
+	if !h.isActive() {
+		w.Header().Set("Retry-After", "5")
+		writeError(w, r, http.StatusServiceUnavailable,
+			"Cold standby, another instance is active.")
+		return
+	}
+	if h.isReadOnly() {
+		writeFailed(w, r, errReadOnly)
+		return
+	}
+
+	tx, err := h.db.Begin(true)
+	if err == nil {
+		err = tx.Rollback()
+	}
+	if err != nil {
+		if !isReadOnly(err) {
+			databaseErrors.WithLabelValues("write").Inc()
+		}
+		writeError(w, r, http.StatusServiceUnavailable,
+			"Database can't be written.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, "Ready.")
+	return
+
+}
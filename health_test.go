@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// /readyz checks the database can be written without writing to it, and
+// answers 503 once it can't be.
+func TestReady(t *testing.T) {
+
+	h := newTestHandler(t, nil)
+	expect(t, h, "GET", "/get/host", "dev1", http.StatusOK)
+
+	before := lastWrite(t, h)
+	for i := 0; i < 3; i++ {
+		expect(t, h, "GET", "/readyz", "dev1", http.StatusOK)
+	}
+	if after := lastWrite(t, h); after != before {
+		t.Errorf("probes wrote up to transaction %d, from %d", after,
+			before)
+	}
+
+	h.db.Close()
+	expect(t, h, "GET", "/readyz", "dev1", http.StatusServiceUnavailable)
+
+}
@@ -0,0 +1,57 @@
+package main
+
+//
+// High-water mark: the most addresses ever allocated at once, kept in the
+// meta bucket so it survives restarts.  A pool which has been near full
+// needs enlarging; one which has merely accumulated records may not.
+//
+
+import (
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+)
+
+// Returns the stored high-water mark.
+func (h *Handler) getHighWater(tx *bolt.Tx) uint32 {
+
+	b := tx.Bucket(h.buckets.meta)
+	if b == nil {
+		return 0
+	}
+
+	v := b.Get([]byte("high-water"))
+	if len(v) != 4 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(v)
+
+}
+
+// Stores the high-water mark.
+func (h *Handler) putHighWater(tx *bolt.Tx, n uint32) error {
+
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, n)
+
+	return tx.Bucket(h.buckets.meta).Put([]byte("high-water"), v)
+
+}
+
+// Raises the high-water mark if more addresses are allocated than ever
+// before.  Called in the transaction writing new allocations.
+func (h *Handler) notePeak(tx *bolt.Tx) error {
+
+	h.mu.Lock()
+	n := h.deviceCount()
+	if n <= h.highWater {
+		h.mu.Unlock()
+		return nil
+	}
+	h.highWater = n
+	h.mu.Unlock()
+
+	return h.putHighWater(tx, n)
+
+}
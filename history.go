@@ -0,0 +1,134 @@
+package main
+
+//
+// Allocation history.  With -history set, each allocation a device loses,
+// by release, expiry or a move, is kept in the history bucket under the
+// device name, with when it was allocated and released, so its past
+// addresses can be traced.  The oldest entries are dropped beyond
+// -history per device.
+//
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// A past allocation.
+type pastAllocation struct {
+	Address   net.IP    `json:"address"`
+	Allocated time.Time `json:"allocated,omitzero"`
+	Released  time.Time `json:"released,omitzero"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// Returns a device's history, oldest first.
+func (h *Handler) getHistory(tx *bolt.Tx, device string) ([]pastAllocation,
+	error) {
+
+	past := []pastAllocation{}
+	v := tx.Bucket(h.buckets.history).Get([]byte(device))
+	if v == nil {
+		return past, nil
+	}
+
+	err := json.Unmarshal(v, &past)
+	if err != nil {
+		return nil, err
+	}
+
+	return past, nil
+
+}
+
+// Adds an allocation being removed to the device's history.  Called in the
+// transaction removing it.
+func (h *Handler) noteHistory(tx *bolt.Tx, device string,
+	rec *record) error {
+
+	if h.historyLen <= 0 {
+		return nil
+	}
+
+	past, err := h.getHistory(tx, device)
+	if err != nil {
+		return err
+	}
+
+	past = append(past, pastAllocation{
+		Address:   rec.Address,
+		Allocated: rec.Allocated,
+		Released:  h.now(),
+		Reason:    rec.Reason,
+	})
+	if len(past) > h.historyLen {
+		past = past[len(past)-h.historyLen:]
+	}
+
+	v, err := json.Marshal(past)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(h.buckets.history).Put([]byte(device), v)
+
+}
+
+// Returns a device's past allocations as a JSON array, oldest first,
+// ending with its current allocation, if it has one, which has no release
+// time.  Answers 404 if the device has neither, and 403 if it's another
+// client's, as mayView has it.
+func (h *Handler) ServeHistory(w http.ResponseWriter, r *http.Request,
+	device string) {
+
+	if device == "" {
+		writeError(w, r, http.StatusBadRequest,
+			"No device name given, use /history/<device>.")
+		return
+	}
+
+	var past []pastAllocation
+	err := h.db.View(func(tx *bolt.Tx) error {
+		rec, err := h.getAllocation(tx, device)
+		if err != nil {
+			return err
+		}
+		if !h.mayView(r, device, rec) {
+			return errNotOwner
+		}
+		past, err = h.getHistory(tx, device)
+		if err != nil {
+			return err
+		}
+		if rec != nil {
+			past = append(past, pastAllocation{
+				Address:   rec.Address,
+				Allocated: rec.Allocated,
+				Reason:    rec.Reason,
+			})
+		}
+		return nil
+	})
+	if err == errNotOwner {
+		writeError(w, r, http.StatusForbidden,
+			"Admin access required for another device's history.")
+		return
+	}
+	if err != nil {
+		writeLookupFailed(w, r)
+		return
+	}
+	if len(past) == 0 {
+		writeError(w, r, http.StatusNotFound, "Device not found.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(past)
+	return
+
+}
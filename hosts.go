@@ -0,0 +1,83 @@
+package main
+
+//
+// Exporting allocations for name resolution, as /etc/hosts lines or a BIND
+// zone file fragment of A records, so DNS can be regenerated from the
+// allocator whenever it changes.  Names must be DNS labels; others are
+// left out, and counted in a comment at the end and the
+// X-Skipped-Devices header.  With -domain, names are qualified with it.
+//
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+// Writes the allocations in hosts or zone format.
+func (h *Handler) serveHosts(w http.ResponseWriter, r *http.Request,
+	format string) {
+
+	type entry struct {
+		device  string
+		address string
+	}
+	entries := []entry{}
+	skipped := 0
+
+	err := h.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(h.buckets.addresses).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if !dnsLabel.Match(k) {
+				skipped++
+				continue
+			}
+			rec, err := decodeRecord(v)
+			if err != nil {
+				return err
+			}
+			entries = append(entries,
+				entry{string(k), rec.Address.String()})
+		}
+		return nil
+	})
+	if err != nil {
+		writeLookupFailed(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Skipped-Devices", strconv.Itoa(skipped))
+	w.WriteHeader(http.StatusOK)
+
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	for _, e := range entries {
+		switch {
+		case format == "zone" && h.domain != "":
+			fmt.Fprintf(out, "%s.%s.\tIN\tA\t%s\n", e.device,
+				h.domain, e.address)
+		case format == "zone":
+			fmt.Fprintf(out, "%s\tIN\tA\t%s\n", e.device, e.address)
+		case h.domain != "":
+			fmt.Fprintf(out, "%s\t%s.%s %s\n", e.address, e.device,
+				h.domain, e.device)
+		default:
+			fmt.Fprintf(out, "%s\t%s\n", e.address, e.device)
+		}
+	}
+
+	if skipped > 0 {
+		comment := "#"
+		if format == "zone" {
+			comment = ";"
+		}
+		fmt.Fprintf(out, "%s %d devices skipped, their names aren't "+
+			"DNS labels\n", comment, skipped)
+	}
+
+}
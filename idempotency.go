@@ -0,0 +1,254 @@
+package main
+
+//
+// Idempotency keys.  A client which sends Idempotency-Key with a request
+// which changes state can safely retry it: the first answer is kept, in
+// the idempotency bucket for -idempotency-ttl, and a repeat with the same
+// key from the same client identity, tenant and pool gets that answer
+// again, with Idempotent-Replayed: true, rather than running the request
+// twice.  The headers the handler set are kept with it, X-Lease-ID, ETag
+// and the rest, but not hop-by-hop ones, nor those set for every
+// request.  A repeat while the first is still running gets 409, and reusing a key for
+// a different request gets 422.  Server errors aren't kept, so a retry
+// after one runs the request again.
+//
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// A stored answer.
+type idempotentAnswer struct {
+
+	// The request answered: method, path and query, and a hash of the
+	// body.
+	Request string `json:"request"`
+
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body"`
+
+	// Content-Type, as answers stored before Header was kept have it.
+	ContentType string `json:"content_type,omitempty"`
+
+	// When it's forgotten.
+	Expires time.Time `json:"expires"`
+}
+
+// Wraps a ResponseWriter, keeping a copy of the answer.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// Headers which describe the connection rather than the answer, or which
+// are worked out afresh for each response, so aren't replayed.
+var unreplayed = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Content-Length":      true,
+	"Date":                true,
+}
+
+// Returns the headers of after which are replayed and weren't already
+// set as they are in before, i.e. those the handler set.
+func answerHeaders(before, after http.Header) http.Header {
+
+	hdr := http.Header{}
+	for k, v := range after {
+		if unreplayed[k] || strings.Join(before[k], "\x00") ==
+			strings.Join(v, "\x00") {
+			continue
+		}
+		hdr[k] = append([]string(nil), v...)
+	}
+
+	return hdr
+
+}
+
+// Reports whether a route changes state, and so honours Idempotency-Key.
+// /get/ and /openvpn-ccd/ allocate on first sight of a device.
+func (rt *route) changesState() bool {
+	return rt.allows(http.MethodPost) || rt.path == "/get/" ||
+		rt.path == "/openvpn-ccd/" || rt.path == "/ifconfig/" ||
+		rt.path == "/wireguard/"
+}
+
+// Returns the key an answer is stored under: the client identity and the
+// Idempotency-Key, scoped by pool and tenant, as several tenants may share
+// a proxy's identity and pick the same key.
+func (h *Handler) idempotencyID(r *http.Request, key string) string {
+	return h.name + "\x00" + h.tenantOf(r) + "\x00" + clientCN(r) +
+		"\x00" + key
+}
+
+// Serves a request carrying an Idempotency-Key, replaying the stored
+// answer if there is one.
+func (h *Handler) serveIdempotent(w http.ResponseWriter, r *http.Request,
+	rt *route, arg, key string) {
+
+	// The request is identified by its body as well as its URL, so
+	// the body is read here, and handed on to the handler.
+	body, ok := h.readBody(w, r)
+	if !ok {
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+
+	id := h.idempotencyID(r, key)
+	request := r.Method + " " + r.URL.RequestURI() + " " +
+		hex.EncodeToString(sum[:])
+
+	h.idemMu.Lock()
+	if h.idemRunning == nil {
+		h.idemRunning = map[string]bool{}
+	}
+	if h.idemRunning[id] {
+		h.idemMu.Unlock()
+		writeError(w, r, http.StatusConflict,
+			"A request with this Idempotency-Key is in progress.")
+		return
+	}
+	h.idemRunning[id] = true
+	h.idemMu.Unlock()
+
+	defer func() {
+		h.idemMu.Lock()
+		delete(h.idemRunning, id)
+		h.idemMu.Unlock()
+	}()
+
+	var prev *idempotentAnswer
+	err := h.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(h.buckets.idempotency).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		a := &idempotentAnswer{}
+		err := json.Unmarshal(v, a)
+		if err != nil {
+			return err
+		}
+		if a.Expires.After(h.now()) {
+			prev = a
+		}
+		return nil
+	})
+	if err != nil {
+		writeLookupFailed(w, r)
+		return
+	}
+
+	if prev != nil {
+		if prev.Request != request {
+			writeError(w, r, http.StatusUnprocessableEntity,
+				"Idempotency-Key was used for a different "+
+					"request.")
+			return
+		}
+		if prev.ContentType != "" {
+			w.Header().Set("Content-Type", prev.ContentType)
+		}
+		for k, v := range prev.Header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(prev.Status)
+		w.Write(prev.Body)
+		return
+	}
+
+	before := w.Header().Clone()
+	rw := &recordingWriter{ResponseWriter: w}
+	rt.serve(h, rw, r, arg)
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	if rw.status >= 500 {
+		return
+	}
+
+	v, err := json.Marshal(&idempotentAnswer{
+		Request: request,
+		Status:  rw.status,
+		Header:  answerHeaders(before, rw.Header()),
+		Body:    rw.body.Bytes(),
+		Expires: h.now().Add(h.idempotencyTTL),
+	})
+	if err == nil {
+		err = h.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(h.buckets.idempotency).Put([]byte(id), v)
+		})
+	}
+	if err != nil {
+		log.Printf("Storing answer for Idempotency-Key: %s", err)
+	}
+
+}
+
+// Drops expired answers, forever.
+func (h *Handler) purgeIdempotency() {
+
+	for {
+		time.Sleep(reapInterval)
+		now := h.now()
+		err := h.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(h.buckets.idempotency)
+			expired := [][]byte{}
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				a := &idempotentAnswer{}
+				if json.Unmarshal(v, a) != nil ||
+					!a.Expires.After(now) {
+					expired = append(expired, k)
+				}
+			}
+			for _, k := range expired {
+				err := b.Delete(k)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Purging idempotency keys failed: %s", err)
+		}
+	}
+
+}
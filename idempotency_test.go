@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Makes a request as dev1 with an Idempotency-Key.
+func doIdempotent(t *testing.T, h *Handler, method, target,
+	key string) *httptest.ResponseRecorder {
+
+	t.Helper()
+
+	r := httptest.NewRequest(method, target, nil)
+	r.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{
+			Subject: pkix.Name{CommonName: "dev1"},
+		}},
+	}
+	r.Header.Set("Idempotency-Key", key)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return w
+
+}
+
+// A replayed answer has the status, body and headers of the first, as
+// well as Idempotent-Replayed.
+func TestIdempotentReplay(t *testing.T) {
+
+	h := newTestHandler(t, func(h *Handler) {
+		h.ttl = time.Hour
+	})
+
+	tests := []struct {
+		method string
+		target string
+		key    string
+		header []string
+	}{
+		{"GET", "/get/host", "k1", []string{"X-Lease-Id", "Etag",
+			"Cache-Control", "Content-Type"}},
+		{"POST", "/renew/host", "k2", []string{"Content-Type"}},
+		{"POST", "/release/host", "k3", []string{"Content-Type"}},
+	}
+
+	for _, tc := range tests {
+
+		first := doIdempotent(t, h, tc.method, tc.target, tc.key)
+		if first.Code != http.StatusOK {
+			t.Fatalf("%s %s: got %d", tc.method, tc.target,
+				first.Code)
+		}
+		for _, k := range tc.header {
+			if first.Header().Get(k) == "" {
+				t.Errorf("%s %s: no %s", tc.method, tc.target, k)
+			}
+		}
+
+		again := doIdempotent(t, h, tc.method, tc.target, tc.key)
+		if again.Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("%s %s: not replayed", tc.method, tc.target)
+		}
+		again.Header().Del("Idempotent-Replayed")
+		if again.Code != first.Code ||
+			again.Body.String() != first.Body.String() ||
+			!reflect.DeepEqual(again.Header(), first.Header()) {
+			t.Errorf("%s %s: replayed %d %q %v, first %d %q %v",
+				tc.method, tc.target, again.Code, again.Body,
+				again.Header(), first.Code, first.Body,
+				first.Header())
+		}
+
+	}
+
+	// Answers stored before headers were kept still have their
+	// Content-Type.
+	v, err := json.Marshal(map[string]interface{}{
+		"request":      "GET /get/old " + emptyBodyHash,
+		"status":       200,
+		"content_type": "text/plain; charset=utf-8",
+		"body":         []byte("10.1.0.9"),
+		"expires":      time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(h.buckets.idempotency).Put(
+			[]byte(h.name+"\x00\x00dev1\x00old"), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := doIdempotent(t, h, "GET", "/get/old", "old")
+	if w.Body.String() != "10.1.0.9" ||
+		w.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("stored answer: got %q, %v", w.Body, w.Header())
+	}
+
+}
+
+// SHA-256 of an empty body, as request identities have it.
+const emptyBodyHash = "e3b0c44298fc1c149afbf4c8996fb924" +
+	"27ae41e4649b934ca495991b7852b855"
+
+// Tenants sharing a client identity and an Idempotency-Key each get their
+// own answer, not a replay of the other's.
+func TestIdempotentTenants(t *testing.T) {
+
+	h := newTestHandler(t, func(h *Handler) {
+		h.tenantFrom = "header"
+	})
+
+	get := func(tenant string) *httptest.ResponseRecorder {
+		return doWith(t, h, "GET", "/get/gw", "dev1", "", http.Header{
+			"X-Tenant":        {tenant},
+			"Idempotency-Key": {"k1"},
+		})
+	}
+
+	a, b := get("a"), get("b")
+	if a.Code != http.StatusOK || b.Code != http.StatusOK {
+		t.Fatalf("got %d and %d", a.Code, b.Code)
+	}
+	if b.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("tenant b got tenant a's answer")
+	}
+	if a.Body.String() == b.Body.String() {
+		t.Errorf("both tenants got %s", a.Body)
+	}
+	if l := a.Header().Get("X-Lease-ID"); l != "" &&
+		l == b.Header().Get("X-Lease-ID") {
+		t.Error("both tenants got one lease")
+	}
+
+	// Each tenant's own retry is still replayed.
+	for _, tenant := range []string{"a", "b"} {
+		if get(tenant).Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("tenant %s: not replayed", tenant)
+		}
+	}
+
+}
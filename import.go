@@ -0,0 +1,254 @@
+package main
+
+//
+// Importing allocations, e.g. an /export from another allocator.  Imported
+// records keep their allocation time, expiry and reason.  All of an
+// import is written in one transaction, so it lands entirely or not at
+// all.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+var errConflict = errors.New("import conflict")
+
+// A clash between an imported record and an allocation already present,
+// either in the database or earlier in the same import.
+type conflict struct {
+
+	// The imported record.
+	Device  string `json:"device"`
+	Address net.IP `json:"address"`
+
+	// address: the address belongs to Holder.  device: the device
+	// already has Existing.  pending: the address is being allocated
+	// by another request or cooling down, and can't be
+	// overwritten.
+	Type     string `json:"type"`
+	Holder   string `json:"holder,omitempty"`
+	Existing net.IP `json:"existing,omitempty"`
+
+	// The other allocation came from this import, not the database.
+	InImport bool `json:"in_import,omitempty"`
+}
+
+// Imports allocations, given as an /export document or a JSON array of
+// its allocations.  ?on_conflict= says what to do when one clashes with an
+// existing allocation: fail (the default) imports nothing and answers
+// 409, skip keeps the existing allocation, overwrite replaces it.
+// Conflicts are listed in the response either way.
+func (h *Handler) ServeImport(w http.ResponseWriter, r *http.Request) {
+
+	mode := r.URL.Query().Get("on_conflict")
+	if mode == "" {
+		mode = "fail"
+	}
+	if mode != "fail" && mode != "skip" && mode != "overwrite" {
+		writeError(w, r, http.StatusBadRequest,
+			"Bad ?on_conflict=, use fail, skip or overwrite.")
+		return
+	}
+
+	body, ok := h.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var exp export
+	var err error
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		err = json.Unmarshal(body, &exp.Allocations)
+	} else {
+		err = json.Unmarshal(body, &exp)
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest,
+			"Expected an /export document or a JSON array of "+
+				"allocations.")
+		return
+	}
+
+	p := h.currentPool()
+	for i := range exp.Allocations {
+		a := &exp.Allocations[i]
+		a.Address = canonicalIP(a.Address)
+		if a.Device == "" {
+			writeError(w, r, http.StatusBadRequest,
+				"Empty device name.")
+			return
+		}
+		if !h.deviceOK(w, r, a.Device) {
+			return
+		}
+		if a.Address == nil || !p.contains(a.Address) {
+			writeError(w, r, http.StatusBadRequest,
+				fmt.Sprintf("Address for %s is missing or outside "+
+					"the pool.", a.Device))
+			return
+		}
+	}
+
+	// Bitmap changes, undone if the transaction fails.
+	var took, freed []net.IP
+
+	conflicts := []conflict{}
+	imported := map[string]*record{}
+	removed := map[string]*record{}
+	skipped := 0
+
+	// Removes an allocation being overwritten, freeing its address
+	// unless it passes straight to the imported record.
+	displace := func(tx *bolt.Tx, device string, rec *record,
+		free bool) error {
+		err := h.deleteAllocation(tx, device, rec, "import")
+		if err != nil {
+			return err
+		}
+		if free {
+			h.free(rec.Address)
+			freed = append(freed, rec.Address)
+		}
+		if _, ok := imported[device]; ok {
+			delete(imported, device)
+		} else {
+			removed[device] = rec
+		}
+		return nil
+	}
+
+	err = h.db.Update(func(tx *bolt.Tx) error {
+
+		for i := range exp.Allocations {
+
+			a := &exp.Allocations[i]
+			c := conflict{Device: a.Device, Address: a.Address}
+
+			existing, err := h.getAllocation(tx, a.Device)
+			if err != nil {
+				return err
+			}
+			if existing != nil && !existing.Address.Equal(a.Address) {
+				c.Type = "device"
+				c.Existing = existing.Address
+				_, c.InImport = imported[a.Device]
+			}
+
+			holder := h.lookupIP(tx, a.Address)
+			if holder != "" && holder != a.Device {
+				c.Type = "address"
+				c.Holder = holder
+				_, c.InImport = imported[holder]
+			}
+
+			if c.Type != "" {
+				conflicts = append(conflicts, c)
+				if mode == "fail" {
+					return errConflict
+				}
+				if mode == "skip" {
+					skipped++
+					continue
+				}
+			}
+
+			// Unless a device already holds it, the address must
+			// be free in the bitmap too; if not, another request
+			// is allocating it right now.  That's checked before
+			// anything is overwritten, so the entry is refused
+			// with the existing allocations left as they were.
+			if holder == "" {
+				if !h.take(a.Address) {
+					conflicts = append(conflicts, conflict{
+						Device:  a.Device,
+						Address: a.Address,
+						Type:    "pending",
+					})
+					if mode == "fail" {
+						return errConflict
+					}
+					skipped++
+					continue
+				}
+				took = append(took, a.Address)
+			}
+
+			if c.Type == "address" {
+				held, err := h.getAllocation(tx, holder)
+				if err != nil {
+					return err
+				}
+				err = displace(tx, holder, held, false)
+				if err != nil {
+					return err
+				}
+			}
+			if existing != nil && !existing.Address.Equal(a.Address) {
+				err = displace(tx, a.Device, existing, true)
+				if err != nil {
+					return err
+				}
+			}
+
+			rec := a.record
+			err = h.putAllocation(tx, a.Device, &rec)
+			if err != nil {
+				return err
+			}
+			imported[a.Device] = &rec
+
+		}
+
+		return h.notePeak(tx)
+
+	})
+
+	if err != nil {
+		for _, ip := range took {
+			h.free(ip)
+		}
+		for _, ip := range freed {
+			h.take(ip)
+		}
+		if err != errConflict {
+			writeFailed(w, r, err)
+			return
+		}
+		imported = map[string]*record{}
+		skipped = 0
+	}
+
+	for device, rec := range removed {
+		fmt.Printf("Device %s: releasing %s, overwritten by import\n",
+			device, rec.Address)
+		h.emit((&event{Type: eventRelease, Device: device,
+			Address: rec.Address, Reason: "import"}).by(r))
+	}
+	for device, rec := range imported {
+		fmt.Printf("Device %s: imported: %s\n", device, rec.Address)
+		h.emit((&event{Type: eventAllocate, Device: device,
+			Address: rec.Address, Reason: rec.Reason}).by(r))
+	}
+
+	code := http.StatusOK
+	if err == errConflict {
+		code = http.StatusConflict
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"imported":  len(imported),
+		"skipped":   skipped,
+		"conflicts": conflicts,
+	})
+	return
+
+}
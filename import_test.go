@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Bodies over -max-body are refused with 413, and nothing is imported.
+func TestImportBodyLimit(t *testing.T) {
+
+	const limit = 256
+	const tooBig = http.StatusRequestEntityTooLarge
+
+	h := newTestHandler(t, func(h *Handler) {
+		h.maxBody = limit
+	})
+
+	// An import of one device, padded with white space to size bytes.
+	body := func(device, addr string, size int) string {
+		b := fmt.Sprintf(`[{"device": %q, "address": %q}]`, device,
+			addr)
+		return b + strings.Repeat(" ", size-len(b))
+	}
+
+	tests := []struct {
+		target string
+		device string
+		addr   string
+		size   int
+		code   int
+	}{
+		{"/import", "small", "10.1.0.10", 100, http.StatusOK},
+		{"/import", "exact", "10.1.0.11", limit, http.StatusOK},
+		{"/import", "over", "10.1.0.12", limit + 1, tooBig},
+		{"/import", "huge", "10.1.0.13", 64 * limit, tooBig},
+		{"/lookup-bulk", "bulk", "10.1.0.14", limit + 1, tooBig},
+	}
+
+	for _, tc := range tests {
+		w := do(t, h, "POST", tc.target, "admin",
+			body(tc.device, tc.addr, tc.size))
+		if w.Code != tc.code {
+			t.Errorf("%s of %d bytes: got %d %q, want %d", tc.target,
+				tc.size, w.Code, strings.TrimSpace(w.Body.String()),
+				tc.code)
+		}
+		want := http.StatusOK
+		if tc.code != http.StatusOK {
+			want = http.StatusNotFound
+		}
+		expect(t, h, "GET", "/lookup/"+tc.addr, "admin", want)
+	}
+
+}
+
+// With ?on_conflict=overwrite, an entry whose address is still being
+// allocated, or cooling down, is refused as pending, and the device's
+// existing allocation is left alone rather than released.  One whose
+// address another device holds takes it over.
+func TestImportOverwritePending(t *testing.T) {
+
+	h := newTestHandler(t, nil)
+	expect(t, h, "GET", "/get/host", "dev1", http.StatusOK)
+	expect(t, h, "GET", "/get/other", "dev1", http.StatusOK)
+
+	// In the bitmap, as a concurrent allocation would be, but not in
+	// the database.
+	if !h.take(net.ParseIP("10.1.0.20")) {
+		t.Fatal("test address already used")
+	}
+
+	w := do(t, h, "POST", "/import?on_conflict=overwrite", "admin",
+		`[{"device": "host", "address": "10.1.0.20"}]`)
+	var resp struct {
+		Imported  int        `json:"imported"`
+		Skipped   int        `json:"skipped"`
+		Conflicts []conflict `json:"conflicts"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || resp.Imported != 0 ||
+		resp.Skipped != 1 || len(resp.Conflicts) != 2 ||
+		resp.Conflicts[1].Type != "pending" {
+		t.Errorf("pending: got %d %s", w.Code, w.Body)
+	}
+	if got := expect(t, h, "GET", "/lookup/10.1.0.1", "admin",
+		http.StatusOK); got != "host" {
+		t.Errorf("10.1.0.1: held by %q, want host", got)
+	}
+
+	// Moving host to other's address frees host's own, and other's
+	// passes to host, still used.
+	w = do(t, h, "POST", "/import?on_conflict=overwrite", "admin",
+		`[{"device": "host", "address": "10.1.0.2"}]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("overwrite: got %d %s", w.Code, w.Body)
+	}
+	expect(t, h, "GET", "/lookup/10.1.0.1", "admin", http.StatusNotFound)
+	if got := expect(t, h, "GET", "/lookup/10.1.0.2", "admin",
+		http.StatusOK); got != "host" {
+		t.Errorf("10.1.0.2: held by %q, want host", got)
+	}
+	for _, want := range []string{"10.1.0.1", "10.1.0.3"} {
+		if got := expect(t, h, "GET", "/get/new"+want, "dev1",
+			http.StatusOK); got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+
+}
@@ -0,0 +1,98 @@
+package main
+
+//
+// IPv6 addresses.  With -pool6, each device also gets an IPv6 address from
+// that network, e.g. fd00:8::/64, for dual-stack VPNs.  They're handed out
+// in order, from a counter kept in the meta bucket, and aren't reused when
+// freed, as a network of the size these are given out from can't
+// realistically run out.  A device allocated before -pool6 was set gets
+// one the next time it asks.  /get/ still answers with the IPv4 address
+// unless given ?family=6, and its JSON answer has both.
+//
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+
+	"github.com/boltdb/bolt"
+)
+
+var errExhausted6 = errors.New("IPv6 pool exhausted")
+
+// Parses an IPv6 network for -pool6.
+func parsePool6(s string) (*net.IPNet, error) {
+
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if n.IP.To4() != nil {
+		return nil, fmt.Errorf("%s isn't an IPv6 network", s)
+	}
+	if ones, _ := n.Mask.Size(); ones > 126 {
+		return nil, fmt.Errorf("%s is too small", s)
+	}
+
+	return n, nil
+
+}
+
+// The IPv6 network, or "" without -pool6.
+func (h *Handler) pool6String() string {
+
+	if h.pool6 == nil {
+		return ""
+	}
+
+	return h.pool6.String()
+
+}
+
+// Number of addresses which can be given out from an IPv6 network, after
+// the network address itself, capped at what a uint64 counter reaches.
+func pool6Size(n *net.IPNet) uint64 {
+
+	ones, bits := n.Mask.Size()
+	if bits-ones >= 64 {
+		return math.MaxUint64
+	}
+
+	return 1<<(bits-ones) - 1
+
+}
+
+// Reports whether a record should have an IPv6 address but hasn't.
+func (h *Handler) lacks6(rec *record) bool {
+	return h.pool6 != nil && rec.Address6 == nil
+}
+
+// Gives a record an IPv6 address, with -pool6, if it hasn't one.  Called
+// in the transaction writing the record.
+func (h *Handler) assign6(tx *bolt.Tx, rec *record) error {
+
+	if h.pool6 == nil || rec.Address6 != nil {
+		return nil
+	}
+
+	meta := tx.Bucket(h.buckets.meta)
+	n := uint64(1)
+	if v := meta.Get([]byte("next6")); len(v) == 8 {
+		n = binary.BigEndian.Uint64(v)
+	}
+	if n > pool6Size(h.pool6) {
+		return errExhausted6
+	}
+
+	a := make(net.IP, net.IPv6len)
+	copy(a, h.pool6.IP.To16())
+	binary.BigEndian.PutUint64(a[8:],
+		binary.BigEndian.Uint64(a[8:])+n)
+	rec.Address6 = a
+
+	return meta.Put([]byte("next6"), binary.BigEndian.AppendUint64(nil,
+		n+1))
+
+}
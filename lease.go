@@ -0,0 +1,233 @@
+package main
+
+//
+// Lease expiry.  With -ttl set, each allocation carries an absolute expiry
+// time, set when it's allocated or renewed with /renew/, and a background
+// goroutine reclaims the addresses of expired leases.  A request can ask for
+// a shorter lease with ?ttl=, e.g. for a guest device, up to -max-ttl, and
+// /get/ with ?ttl= renews an existing lease for that long.
+//
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// How often to look for expired leases.
+const reapInterval = time.Minute
+
+// Returns the lease length asked for as ?ttl=, or 0 if none was.  It can't
+// exceed -max-ttl, or -ttl if that's not set, and needs one of them set
+// for expired leases to be reclaimed at all.  Answers 400 otherwise, and
+// returns false if a response has been written.
+func (h *Handler) requestTTL(w http.ResponseWriter, r *http.Request) (
+	time.Duration, bool) {
+
+	s := r.URL.Query().Get("ttl")
+	if s == "" {
+		return 0, true
+	}
+
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl <= 0 {
+		writeError(w, r, http.StatusBadRequest,
+			"Bad ?ttl=, expected a positive duration e.g. 2h.")
+		return 0, false
+	}
+
+	limit := h.maxTTL
+	if limit == 0 {
+		limit = h.ttl
+	}
+	if limit == 0 {
+		writeError(w, r, http.StatusBadRequest,
+			"Leases aren't enabled, so ?ttl= can't be used.")
+		return 0, false
+	}
+	if ttl > limit {
+		writeError(w, r, http.StatusBadRequest,
+			"?ttl= is above the maximum of "+limit.String()+".")
+		return 0, false
+	}
+
+	return ttl, true
+
+}
+
+// Works out when a lease starting now expires: after ttl if that's
+// given, as from ?ttl=, else after -ttl.  The -ttl length is varied by up
+// to ttlJitter percent either way, and the result stored with the record,
+// so the jitter is applied once.
+func (h *Handler) leaseExpiry(now time.Time, ttl time.Duration) time.Time {
+
+	if ttl > 0 {
+		return now.Add(ttl)
+	}
+
+	if h.ttl == 0 {
+		return time.Time{}
+	}
+
+	jitter := (rand.Float64()*2 - 1) * h.ttlJitter / 100
+	return now.Add(h.ttl + time.Duration(float64(h.ttl)*jitter))
+
+}
+
+// Reclaims expired leases, and with -tombstone-ttl drops old tombstones,
+// forever.
+func (h *Handler) reap() {
+
+	for {
+		time.Sleep(reapInterval)
+		now := h.now()
+		if h.ttl > 0 || h.maxTTL > 0 {
+			err := h.expire(now)
+			if err != nil {
+				log.Printf("Lease expiry failed: %s", err)
+			}
+		}
+		if h.tombstoneTTL > 0 {
+			err := h.pruneTombstones(now)
+			if err != nil {
+				log.Printf("Pruning tombstones failed: %s", err)
+			}
+		}
+	}
+
+}
+
+// Removes allocations whose lease expired before now, freeing their
+// addresses.
+func (h *Handler) expire(now time.Time) error {
+
+	type expiry struct {
+		device string
+		rec    *record
+	}
+	expired := []expiry{}
+
+	err := h.db.Update(func(tx *bolt.Tx) error {
+
+		c := tx.Bucket(h.buckets.addresses).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			rec, err := decodeRecord(v)
+			if err != nil {
+				return err
+			}
+			if !rec.Expires.IsZero() && rec.Expires.Before(now) {
+				expired = append(expired,
+					expiry{string(k), rec})
+			}
+		}
+
+		for _, e := range expired {
+			err := h.deleteAllocation(tx, e.device, e.rec,
+				eventExpire)
+			if err != nil {
+				return err
+			}
+			err = h.cool(tx, e.rec.Address, now)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range expired {
+		h.retire(e.rec.Address, now)
+		fmt.Printf("Device %s: lease on %s expired\n", e.device,
+			e.rec.Address)
+		h.emit(&event{Type: eventExpire, Device: e.device,
+			Address: e.rec.Address, Time: now})
+	}
+
+	return nil
+
+}
+
+// Renews a device's lease, from now, answering with the new expiry time.
+// With -claim, only the device's owner may, and a lease ID given in
+// X-Lease-ID has to be the device's current one.
+func (h *Handler) ServeRenew(w http.ResponseWriter, r *http.Request,
+	device string) {
+
+	if device == "" {
+		writeError(w, r, http.StatusBadRequest,
+			"No device name given, use /renew/<device>.")
+		return
+	}
+
+	ttl, ok := h.requestTTL(w, r)
+	if !ok {
+		return
+	}
+
+	now := h.now()
+	expires := h.leaseExpiry(now, ttl)
+	if expires.IsZero() {
+		writeError(w, r, http.StatusBadRequest,
+			"Leases aren't enabled, so there's nothing to renew.")
+		return
+	}
+
+	err := h.db.Update(func(tx *bolt.Tx) error {
+
+		rec, err := h.getAllocation(tx, device)
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			return errNoDevice
+		}
+
+		err = h.checkOwner(tx, r, device, rec)
+		if err != nil {
+			return err
+		}
+
+		err = h.checkLease(r, rec)
+		if err != nil {
+			return err
+		}
+
+		rec.Expires = expires
+		return h.putAllocation(tx, device, rec)
+
+	})
+
+	switch {
+	case err == errNoDevice:
+		writeError(w, r, http.StatusNotFound, "Device not found.")
+		return
+	case err == errNotOwner:
+		writeError(w, r, http.StatusForbidden,
+			"Device belongs to another identity.")
+		return
+	case !writeLeaseError(w, r, err):
+		return
+	case err != nil:
+		writeFailed(w, r, err)
+		return
+	}
+
+	fmt.Printf("Device %s: lease renewed until %s\n", device,
+		expires.UTC().Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, expires.UTC().Format(time.RFC3339))
+	return
+
+}
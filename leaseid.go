@@ -0,0 +1,90 @@
+package main
+
+//
+// Lease IDs.  Each new allocation gets an opaque ID, rotated whenever the
+// device is allocated afresh, and returned in the X-Lease-ID header.  A
+// client giving it back on /release/ or /renew/ acts only on the lease it
+// was handed: if the device has since been released and allocated again,
+// perhaps by another client, the ID no longer matches and the answer is
+// 409, so a late release can't free the new lease's address.
+//
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+)
+
+// Header carrying the lease ID.
+const leaseHeader = "X-Lease-ID"
+
+var (
+	errStaleLease = errors.New("lease ID doesn't match")
+	errNoLease    = errors.New("lease ID required")
+)
+
+// Returns a new lease ID.
+func newLeaseID() string {
+
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+
+}
+
+// Sets the lease ID header for an allocation, if the request may see it,
+// as mayView has it: with admins configured, another client's lease ID
+// would let it release or renew the device.  Records from before lease
+// IDs have none.
+func (h *Handler) setLease(w http.ResponseWriter, r *http.Request,
+	device string, rec *record) {
+
+	if rec.Lease != "" && h.mayView(r, device, rec) {
+		w.Header().Set(leaseHeader, rec.Lease)
+	}
+
+}
+
+// Checks the lease ID a request gives against the device's.  Returns
+// errStaleLease if it's for another lease, and with -require-lease
+// errNoLease if none is given.  A record from before lease IDs matches
+// any.
+func (h *Handler) checkLease(r *http.Request, rec *record) error {
+
+	id := r.Header.Get(leaseHeader)
+	if id == "" {
+		if h.requireLease {
+			return errNoLease
+		}
+		return nil
+	}
+
+	if rec.Lease != "" && id != rec.Lease {
+		return errStaleLease
+	}
+
+	return nil
+
+}
+
+// Answers for a lease ID error, returning false if there was one.
+func writeLeaseError(w http.ResponseWriter, r *http.Request,
+	err error) bool {
+
+	switch err {
+	case errStaleLease:
+		writeError(w, r, http.StatusConflict,
+			"Lease ID doesn't match; the device has been allocated "+
+				"again since.")
+		return false
+	case errNoLease:
+		writeError(w, r, http.StatusPreconditionRequired,
+			"Give the lease ID in the "+leaseHeader+" header.")
+		return false
+	}
+
+	return true
+
+}
@@ -0,0 +1,75 @@
+package main
+
+//
+// Pools served on listeners of their own.  A pool in the -pools file with
+// a "listen" address is served there, and only there, so tenants can be
+// kept apart at the network level.  The listener can have its own server
+// certificate and client CA; otherwise it uses those of -listen.  Other
+// settings, timeouts included, are shared, and the credentials are
+// reloaded on SIGHUP with those of -listen.
+//
+
+import (
+	"net/http"
+)
+
+// A pool's own listener, as configured.
+type poolListener struct {
+
+	// Address listened on.
+	addr string
+
+	// Server certificate, key and client CA files, empty for those of
+	// -listen.
+	cert string
+	key  string
+	ca   string
+}
+
+// Returns the address a pool is served on, empty for -listen.
+func (h *Handler) listenAddr() string {
+
+	if h.listener == nil {
+		return ""
+	}
+
+	return h.listener.addr
+
+}
+
+// Loads the credentials for a pool's listener: those of -listen, main,
+// but with the listener's own certificate and CA if it has them.
+func (l *poolListener) credentials(main *tlsFiles) (*tlsFiles, error) {
+
+	certFile, keyFile, caFile := main.cert, main.key, main.ca
+	if l.cert != "" {
+		certFile = l.cert
+	}
+	if l.key != "" {
+		keyFile = l.key
+	}
+	if l.ca != "" {
+		caFile = l.ca
+	}
+
+	return newTLSFiles(main.base, certFile, keyFile, caFile, main.check)
+
+}
+
+// Returns a handler serving one pool on its own listener.  Requests naming
+// another pool, by ?pool= or by device prefix, get 404; those which would
+// go to the default pool go to this one.
+func (ps *poolSet) only(h *Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := ps.choose(r)
+		if p == nil || (p != h && (p != ps.handlers[0] ||
+			r.URL.Query().Get("pool") != "")) {
+			writeError(w, r, http.StatusNotFound,
+				"No such pool on this listener.")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+
+}
@@ -0,0 +1,164 @@
+package main
+
+//
+// Sorting, paging and formats for /all.  The allocations a scan covers are
+// sorted by ?sort=device, the default, or ?sort=address, and ?offset= and
+// ?limit= select a page of them; X-Total-Count gives how many there were
+// before paging.  With -max-scan, paging applies to the allocations the
+// scan reached, and ?after= still continues a truncated scan.
+// ?format=json, the default, gives a JSON object in the order sorted,
+// ?format=csv a CSV table with a header row, and ?format=text an aligned
+// table, streamed in device order; see alltext.go.
+//
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// How /all is to be answered.
+type listing struct {
+	sort   string
+	offset int
+	limit  int
+	format string
+	detail bool
+}
+
+// Returns the listing a request asks for.  Answers 400 and returns nil if
+// the request is bad.
+func listingFor(w http.ResponseWriter, r *http.Request) *listing {
+
+	q := r.URL.Query()
+	l := &listing{
+		sort:   q.Get("sort"),
+		format: q.Get("format"),
+		detail: q.Get("detail") == "true",
+	}
+
+	switch l.sort {
+	case "":
+		l.sort = "device"
+	case "device", "address":
+	default:
+		writeError(w, r, http.StatusBadRequest,
+			"Bad ?sort=, use device or address.")
+		return nil
+	}
+
+	switch l.format {
+	case "":
+		l.format = "json"
+	case "json", "csv", "text":
+	default:
+		writeError(w, r, http.StatusBadRequest,
+			"Bad ?format=, use json, csv or text.")
+		return nil
+	}
+
+	for _, p := range []struct {
+		name  string
+		value *int
+	}{{"offset", &l.offset}, {"limit", &l.limit}} {
+		s := q.Get(p.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeError(w, r, http.StatusBadRequest,
+				"Bad ?"+p.name+"=, expected a whole number.")
+			return nil
+		}
+		*p.value = n
+	}
+
+	return l
+
+}
+
+// Sorts allocations, which the scan gave in device order, and returns the
+// page asked for.
+func (l *listing) page(all []allocation) []allocation {
+
+	if l.sort == "address" {
+		sort.SliceStable(all, func(i, j int) bool {
+			return bytes.Compare(all[i].Address.To16(),
+				all[j].Address.To16()) < 0
+		})
+	}
+
+	if l.offset >= len(all) {
+		return nil
+	}
+	all = all[l.offset:]
+	if l.limit > 0 && l.limit < len(all) {
+		all = all[:l.limit]
+	}
+
+	return all
+
+}
+
+// Writes allocations as a JSON object of device name to address, or to the
+// whole record with ?detail=true, with its keys in the order given.
+func (l *listing) writeJSON(w http.ResponseWriter, all []allocation) {
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i := range all {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(all[i].Device)
+		var v []byte
+		if l.detail {
+			v, _ = json.Marshal(&all[i].record)
+		} else {
+			v, _ = json.Marshal(all[i].Address.String())
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteString("}\n")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b.Bytes())
+
+}
+
+// Writes allocations as CSV: device, address, IPv6 address, and allocation
+// and expiry times, empty if unknown or never.
+func (l *listing) writeCSV(w http.ResponseWriter, all []allocation) {
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	stamp := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"device", "address", "address6", "allocated",
+		"expires"})
+	for _, a := range all {
+		addr6 := ""
+		if a.Address6 != nil {
+			addr6 = a.Address6.String()
+		}
+		out.Write([]string{a.Device, a.Address.String(), addr6,
+			stamp(a.Allocated), stamp(a.Expires)})
+	}
+	out.Flush()
+
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+// The streamed text table has the rows, widths and headers that building
+// it in memory from the JSON listing of the same page gives.
+func TestAllText(t *testing.T) {
+
+	h := newTestHandler(t, func(h *Handler) {
+		h.maxScan = 5
+	})
+	for _, d := range []string{"a", "bb", "ccc", "cc", "dddd", "e", "f"} {
+		expect(t, h, "GET", "/get/"+d, "dev1", http.StatusOK)
+	}
+
+	for _, q := range []string{"", "offset=1&limit=2", "limit=1",
+		"prefix=c", "glob=?", "offset=10", "after=cc",
+		"after=dddd&limit=1"} {
+
+		got := do(t, h, "GET", "/all?format=text&"+q, "dev1", "")
+
+		js := do(t, h, "GET", "/all?detail=true&"+q, "dev1", "")
+		recs := map[string]*record{}
+		err := json.Unmarshal(js.Body.Bytes(), &recs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := []allocation{}
+		for d, rec := range recs {
+			page = append(page, allocation{d, *rec})
+		}
+		sort.Slice(page, func(i, j int) bool {
+			return page[i].Device < page[j].Device
+		})
+		want := httptest.NewRecorder()
+		writeAllText(want, page)
+
+		if got.Body.String() != want.Body.String() {
+			t.Errorf("%s: got\n%s\nwant\n%s", q, got.Body,
+				want.Body)
+		}
+		for _, k := range []string{"Content-Type", "X-Total-Count",
+			"X-Truncated", "X-Next-After"} {
+			g, w := got.Header().Get(k), js.Header().Get(k)
+			if k == "Content-Type" {
+				w = want.Header().Get(k)
+			}
+			if g != w {
+				t.Errorf("%s: %s: got %q, want %q", q, k, g, w)
+			}
+		}
+
+	}
+
+}
@@ -0,0 +1,304 @@
+package main
+
+//
+// Reverse lookup, address to device, using the byip index.  With
+// -verify-index, each entry a lookup uses is checked against the record of
+// the device it names, which is the authority: if that device doesn't hold
+// the address, the lookup answers as the records do, and the mismatch is
+// logged and counted.  -verify-index=heal also repairs the entry.
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Index entries found not to match the records, with -verify-index.
+var indexMismatches = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "addr_alloc_index_mismatches_total",
+	Help: "Reverse index entries found pointing at a device which " +
+		"doesn't hold the address.",
+})
+
+func init() {
+	prometheus.MustRegister(indexMismatches)
+}
+
+// Parses an IPv4 address in dotted decimal, returning nil if it isn't one.
+// IPv6 literals are refused, even those embedding an IPv4 address, as the
+// pool has none.
+func parseIPv4(s string) net.IP {
+
+	if strings.Contains(s, ":") {
+		return nil
+	}
+
+	return net.ParseIP(s).To4()
+
+}
+
+// Returns the device holding an address, or "" if it's not allocated.
+func (h *Handler) lookupIP(tx *bolt.Tx, ip net.IP) string {
+
+	b := tx.Bucket(h.buckets.byip)
+	if b == nil {
+		return ""
+	}
+
+	return string(b.Get(canonicalIP(ip)))
+
+}
+
+// Returns the device holding an address, as the index has it, or "" if
+// none does.  With -verify-index, the device's record is checked to hold the
+// address too, and if it doesn't, the entry is reported stale and ""
+// returned.
+func (h *Handler) indexLookup(tx *bolt.Tx, ip net.IP) (string, bool,
+	error) {
+
+	device := h.lookupIP(tx, ip)
+	if device == "" || h.verifyIndex == "" {
+		return device, false, nil
+	}
+
+	rec, err := h.getAllocation(tx, device)
+	if err != nil {
+		return "", false, err
+	}
+	if rec != nil && rec.Address.Equal(ip) {
+		return device, false, nil
+	}
+
+	indexMismatches.Inc()
+	log.Printf("Index: %s points at device %s, which doesn't hold it",
+		ip, device)
+
+	return "", true, nil
+
+}
+
+// Points a stale index entry at the device whose record holds the
+// address, found by scanning, or deletes it if none does, returning that
+// device.
+func (h *Handler) healIndex(ip net.IP) (string, error) {
+
+	var holder string
+	err := h.db.Update(func(tx *bolt.Tx) error {
+
+		device, stale, err := h.indexLookup(tx, ip)
+		if err != nil || !stale {
+			holder = device
+			return err
+		}
+
+		c := tx.Bucket(h.buckets.addresses).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			rec, err := decodeRecord(v)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(rec.Address, canonicalIP(ip)) {
+				holder = string(k)
+				break
+			}
+		}
+
+		idx := tx.Bucket(h.buckets.byip)
+		if holder == "" {
+			log.Printf("Index: deleted the entry for %s", ip)
+			return idx.Delete(canonicalIP(ip))
+		}
+		log.Printf("Index: pointed %s at device %s", ip, holder)
+		return idx.Put(canonicalIP(ip), []byte(holder))
+
+	})
+
+	return holder, err
+
+}
+
+// Returns the device of the request's tenant holding an address, or "" if
+// none does, and whether the index entry was stale.  An address held by
+// another tenant's device looks free.
+func (h *Handler) tenantLookup(tx *bolt.Tx, r *http.Request,
+	ip net.IP) (string, bool, error) {
+
+	key, stale, err := h.indexLookup(tx, ip)
+	if err != nil {
+		return "", false, err
+	}
+
+	device, ok := h.unscoped(r, key)
+	if !ok {
+		return "", stale, nil
+	}
+
+	return device, stale, nil
+
+}
+
+// Repairs the index entry for an address with -verify-index=heal,
+// returning the device of the request's tenant which holds it, if any.
+func (h *Handler) tenantHeal(r *http.Request, ip net.IP) (string, error) {
+
+	if h.verifyIndex != "heal" || h.isReadOnly() {
+		return "", nil
+	}
+
+	key, err := h.healIndex(ip)
+	if err != nil {
+		return "", err
+	}
+
+	device, _ := h.unscoped(r, key)
+
+	return device, nil
+
+}
+
+// Returns the device holding an address, as plain text, or as a JSON
+// object of address and device if the client asks for JSON.
+func (h *Handler) ServeLookup(w http.ResponseWriter, r *http.Request,
+	addr string) {
+
+	ip := parseIPv4(addr)
+	if ip == nil {
+		writeError(w, r, http.StatusBadRequest,
+			"Not an IPv4 address, use /lookup/<address>.")
+		return
+	}
+	if !h.currentPool().contains(ip) {
+		writeError(w, r, http.StatusBadRequest,
+			"Address is outside the pool.")
+		return
+	}
+
+	var device string
+	var stale bool
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		device, stale, err = h.tenantLookup(tx, r, ip)
+		return err
+	})
+	if err == nil && stale {
+		device, err = h.tenantHeal(r, ip)
+	}
+	if err != nil {
+		writeLookupFailed(w, r)
+		return
+	}
+
+	if device == "" {
+		writeError(w, r, http.StatusNotFound, "Address not allocated.")
+		return
+	}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"address": ip.String(),
+			"device":  device,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, device)
+	return
+
+}
+
+// Maps a JSON array of addresses to devices.  Unallocated addresses map to
+// null.  Malformed entries, and those outside the pool, are reported under
+// "errors" with a 400, but the valid ones are still answered.
+func (h *Handler) ServeLookupBulk(w http.ResponseWriter, r *http.Request) {
+
+	body, ok := h.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var addrs []string
+	err := json.Unmarshal(body, &addrs)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest,
+			"Expected a JSON array of addresses.")
+		return
+	}
+
+	result := struct {
+		Devices map[string]*string `json:"devices"`
+		Errors  map[string]string  `json:"errors,omitempty"`
+	}{
+		Devices: map[string]*string{},
+	}
+
+	p := h.currentPool()
+	stale := []net.IP{}
+	err = h.db.View(func(tx *bolt.Tx) error {
+		for _, addr := range addrs {
+			ip := parseIPv4(addr)
+			problem := ""
+			switch {
+			case ip == nil:
+				problem = "not an IPv4 address"
+			case !p.contains(ip):
+				problem = "outside the pool"
+			}
+			if problem != "" {
+				if result.Errors == nil {
+					result.Errors = map[string]string{}
+				}
+				result.Errors[addr] = problem
+				continue
+			}
+			result.Devices[addr] = nil
+			device, bad, err := h.tenantLookup(tx, r, ip)
+			if err != nil {
+				return err
+			}
+			if bad {
+				stale = append(stale, ip)
+			}
+			if device != "" {
+				result.Devices[addr] = &device
+			}
+		}
+		return nil
+	})
+	for _, ip := range stale {
+		if err != nil {
+			break
+		}
+		var device string
+		device, err = h.tenantHeal(r, ip)
+		if device != "" {
+			result.Devices[ip.String()] = &device
+		}
+	}
+	if err != nil {
+		writeLookupFailed(w, r)
+		return
+	}
+
+	status := http.StatusOK
+	if result.Errors != nil {
+		status = http.StatusBadRequest
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+	return
+
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// Addresses which aren't IPv4, or aren't in the pool, are refused with 400
+// by the endpoints taking one, rather than looked up or stored.
+func TestAddressInput(t *testing.T) {
+
+	h := newTestHandler(t, nil)
+	expect(t, h, "GET", "/get/host", "dev1", http.StatusOK)
+
+	tests := []struct {
+		method string
+		target string
+		code   int
+	}{
+		{"GET", "/lookup/10.1.0.1", http.StatusOK},
+		{"GET", "/lookup/10.1.0.2", http.StatusNotFound},
+		{"GET", "/lookup/::ffff:10.1.0.1", http.StatusBadRequest},
+		{"GET", "/lookup/not-an-ip", http.StatusBadRequest},
+		{"GET", "/lookup/10.1.0", http.StatusBadRequest},
+		{"GET", "/lookup/10.1.0.256", http.StatusBadRequest},
+		{"GET", "/lookup/", http.StatusBadRequest},
+		{"GET", "/lookup/2001:db8::1", http.StatusBadRequest},
+		{"GET", "/lookup/::1", http.StatusBadRequest},
+		{"GET", "/lookup/10.2.0.1", http.StatusBadRequest},
+		{"GET", "/lookup/10.1.0.255", http.StatusBadRequest},
+		{"POST", "/reserve/r1?address=not-an-ip", http.StatusBadRequest},
+		{"POST", "/reserve/r1?address=2001:db8::1", http.StatusBadRequest},
+		{"POST", "/reserve/r1?address=10.2.0.1", http.StatusBadRequest},
+		{"POST", "/reserve/r1?address=10.1.0.255", http.StatusBadRequest},
+		{"POST", "/reserve/r1?address=10.1.0.9", http.StatusOK},
+		{"GET", "/lookup/10.1.0.9", http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		expect(t, h, tc.method, tc.target, "admin", tc.code)
+	}
+
+}
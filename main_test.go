@@ -0,0 +1,143 @@
+package main
+
+//
+// Shared test setup: a handler serving a small pool from a fresh database
+// in a temporary directory, configured as main's flag defaults configure
+// it, and requests made to it through httptest.
+//
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Pool the test handler allocates from unless configured otherwise.
+const testPool = "10.1.0.1-10.1.0.254"
+
+// A clock set by hand.
+type testClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+// Moves the clock on by d.
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// Returns a handler for testPool on a new database, started as main
+// starts it once configure has adjusted its options.  The database is
+// closed when the test ends.
+func newTestHandler(t *testing.T, configure func(h *Handler)) *Handler {
+
+	t.Helper()
+
+	p, err := parsePool(testPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &Handler{}
+	h.clock = realClock{}
+	h.pool = p
+	h.buckets = newBuckets(defaultNamespace)
+	h.admins = map[string]bool{}
+	h.adminOUs = map[string]bool{}
+	h.maxBody = 1 << 20
+	h.fillHoles = true
+	h.outOfPool = "serve"
+	h.afterRelease = "reallocate"
+	h.onReadOnly = "serve"
+	h.hookTimeout = 30 * time.Second
+	h.idempotencyTTL = 24 * time.Hour
+	h.cacheControl = "private, no-cache"
+	if configure != nil {
+		configure(h)
+	}
+
+	ps := newPoolSet(h)
+	err = ps.open(filepath.Join(t.TempDir(), "addr.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.db.Close() })
+
+	return h
+
+}
+
+// Makes a request to a handler as the client with certificate CN cn, or
+// with no certificate if cn is empty, returning the response.
+func do(t *testing.T, h http.Handler, method, target, cn string,
+	body string) *httptest.ResponseRecorder {
+
+	t.Helper()
+
+	return doWith(t, h, method, target, cn, body, nil)
+
+}
+
+// Makes a request as do does, with the headers given.
+func doWith(t *testing.T, h http.Handler, method, target, cn string,
+	body string, hdr http.Header) *httptest.ResponseRecorder {
+
+	t.Helper()
+
+	var rd io.Reader
+	if body != "" {
+		rd = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, target, rd)
+	for k, vs := range hdr {
+		for _, v := range vs {
+			r.Header.Add(k, v)
+		}
+	}
+	if cn != "" {
+		r.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{
+				Subject: pkix.Name{CommonName: cn},
+			}},
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return w
+
+}
+
+// Makes a request and fails the test unless it's answered with status
+// code, returning the body.
+func expect(t *testing.T, h http.Handler, method, target, cn string,
+	code int) string {
+
+	t.Helper()
+
+	w := do(t, h, method, target, cn, "")
+	if w.Code != code {
+		t.Fatalf("%s %s: got %d %q, want %d", method, target, w.Code,
+			strings.TrimSpace(w.Body.String()), code)
+	}
+
+	return w.Body.String()
+
+}
@@ -0,0 +1,163 @@
+package main
+
+//
+// In-memory operation.  With -in-memory, the database is opened as usual,
+// and held so no other instance can, but served from a copy in a
+// memory-backed file which is never synced.  Every -flush-interval, and on
+// a clean shutdown, the copy is written back to the database in one
+// transaction.  A crash loses whatever was allocated since the last flush,
+// and those addresses may be handed out again, so this is for short-lived
+// and test deployments, or where throughput matters more than durability.
+//
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// A database served from memory and written back to disk.
+type writeBack struct {
+
+	// The database on disk, held open for its lock.
+	disk *bolt.DB
+
+	// The copy served from.
+	mem *bolt.DB
+
+	// Serialises flushes, so the last one on shutdown can't overlap a
+	// periodic one.
+	mu sync.Mutex
+}
+
+// Directory for the in-memory copy: /dev/shm if there is one, so it's
+// backed by memory, else the temporary directory.
+func memoryDir() string {
+
+	if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+		return "/dev/shm"
+	}
+
+	return os.TempDir()
+
+}
+
+// Copies every bucket of src into dst, replacing whatever dst held, in one
+// transaction.
+func copyDatabase(dst, src *bolt.DB) error {
+
+	return src.View(func(stx *bolt.Tx) error {
+		return dst.Update(func(dtx *bolt.Tx) error {
+
+			names := [][]byte{}
+			err := dtx.ForEach(func(k []byte, _ *bolt.Bucket) error {
+				names = append(names, append([]byte(nil), k...))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				err = dtx.DeleteBucket(name)
+				if err != nil {
+					return err
+				}
+			}
+
+			return stx.ForEach(func(k []byte, b *bolt.Bucket) error {
+				d, err := dtx.CreateBucket(k)
+				if err != nil {
+					return err
+				}
+				return copyBucket(d, b)
+			})
+
+		})
+	})
+
+}
+
+// Copies the contents of a bucket, nested buckets included.
+func copyBucket(dst, src *bolt.Bucket) error {
+
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		d, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(d, src.Bucket(k))
+	})
+
+}
+
+// Returns a write-back over a database, with a fresh in-memory copy of it.
+func newWriteBack(disk *bolt.DB) (*writeBack, error) {
+
+	f, err := os.CreateTemp(memoryDir(), "addr-alloc-*.db")
+	if err != nil {
+		return nil, err
+	}
+	path := f.Name()
+	f.Close()
+
+	mem, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	mem.NoSync = true
+
+	err = copyDatabase(mem, disk)
+	if err != nil {
+		mem.Close()
+		os.Remove(path)
+		return nil, err
+	}
+
+	return &writeBack{disk: disk, mem: mem}, nil
+
+}
+
+// Writes the in-memory copy back to disk.
+func (wb *writeBack) flush() error {
+
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	return copyDatabase(wb.disk, wb.mem)
+
+}
+
+// Flushes every interval, forever.
+func (wb *writeBack) flusher(interval time.Duration) {
+
+	for range time.Tick(interval) {
+		err := wb.flush()
+		if err != nil {
+			log.Printf("Flush to disk failed: %s", err)
+		}
+	}
+
+}
+
+// Flushes a last time, then closes both databases, removing the in-memory
+// copy.
+func (wb *writeBack) Close() error {
+
+	err := wb.flush()
+	if err != nil {
+		log.Printf("Flush to disk failed: %s", err)
+	}
+
+	path := wb.mem.Path()
+	wb.mem.Close()
+	os.Remove(path)
+
+	return wb.disk.Close()
+
+}
@@ -0,0 +1,161 @@
+package main
+
+//
+// Allocation metadata: a free-text description and key=value tags, given
+// as ?description= and ?tag=key=value (repeated) when a device is
+// allocated, or later with /describe/.  They're kept with the record and
+// written as comments into generated VPN configs, so those say what the
+// device is.
+//
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// A tag key.
+var tagKey = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// Longest description or tag value accepted.
+const maxMetadata = 256
+
+// Returns the description and tags a request gives.  Answers 400 if
+// they're bad, and returns false if a response has been written.
+func requestMetadata(w http.ResponseWriter, r *http.Request) (string,
+	map[string]string, bool) {
+
+	desc := r.URL.Query().Get("description")
+	if len(desc) > maxMetadata {
+		writeError(w, r, http.StatusBadRequest,
+			"?description= is too long.")
+		return "", nil, false
+	}
+
+	var tags map[string]string
+	for _, t := range r.URL.Query()["tag"] {
+		k, v, ok := strings.Cut(t, "=")
+		if !ok || !tagKey.MatchString(k) || len(v) > maxMetadata {
+			writeError(w, r, http.StatusBadRequest,
+				"Bad ?tag=, expected key=value with a key of "+
+					"letters, digits, _, . and -.")
+			return "", nil, false
+		}
+		if tags == nil {
+			tags = map[string]string{}
+		}
+		tags[k] = v
+	}
+
+	return desc, tags, true
+
+}
+
+// Makes text safe for a config file comment: control characters and line
+// separators, which could end the comment and inject directives, become
+// spaces.
+func sanitiseComment(s string) string {
+
+	return strings.TrimSpace(strings.Map(func(c rune) rune {
+		if c < 0x20 || c == 0x7f || c == '\u2028' ||
+			c == '\u2029' {
+			return ' '
+		}
+		return c
+	}, s))
+
+}
+
+// Returns comment lines describing an allocation, each starting with
+// marker, for a generated config.
+func configComments(marker string, rec *record) string {
+
+	var b strings.Builder
+
+	if rec.Description != "" {
+		fmt.Fprintf(&b, "%s %s\n", marker,
+			sanitiseComment(rec.Description))
+	}
+
+	if len(rec.Tags) > 0 {
+		keys := []string{}
+		for k := range rec.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		parts := []string{}
+		for _, k := range keys {
+			parts = append(parts, k+": "+rec.Tags[k])
+		}
+		fmt.Fprintf(&b, "%s %s\n", marker,
+			sanitiseComment(strings.Join(parts, ", ")))
+	}
+
+	return b.String()
+
+}
+
+// Replaces a device's description and tags with those given.  With
+// -claim, only the device's owner may.
+func (h *Handler) ServeDescribe(w http.ResponseWriter, r *http.Request,
+	device string) {
+
+	if device == "" {
+		writeError(w, r, http.StatusBadRequest,
+			"No device name given, use /describe/<device>.")
+		return
+	}
+
+	desc, tags, ok := requestMetadata(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.db.Update(func(tx *bolt.Tx) error {
+
+		rec, err := h.getAllocation(tx, device)
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			return errNoDevice
+		}
+
+		err = h.checkOwner(tx, r, device, rec)
+		if err != nil {
+			return err
+		}
+
+		rec.Description = desc
+		rec.Tags = tags
+
+		return h.putAllocation(tx, device, rec)
+
+	})
+
+	switch {
+	case err == errNoDevice:
+		writeError(w, r, http.StatusNotFound, "Device not found.")
+		return
+	case err == errNotOwner:
+		writeError(w, r, http.StatusForbidden,
+			"Device belongs to another identity.")
+		return
+	case err != nil:
+		writeFailed(w, r, err)
+		return
+	}
+
+	fmt.Printf("Device %s: description updated\n", device)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, "Description updated.")
+	return
+
+}
@@ -0,0 +1,300 @@
+package main
+
+//
+// Prometheus instrumentation.  Every request passes through instrument(),
+// which records its latency and final status code, labelled by route.
+// The route label is the matching entry in the routes table, so arbitrary
+// device names can't blow up label cardinality.  Metrics are served at
+// /metrics, and with -metrics-listen also over plain HTTP on a port of
+// their own, along with the health checks, for scrapers and probes without
+// a client certificate.
+//
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+
+	// Request latency, by route.
+	requestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "addr_alloc_request_duration_seconds",
+			Help:    "HTTP request latency in seconds, by route.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"route"},
+	)
+
+	// Requests being served, by protocol.  Over HTTP/2 that's the
+	// streams open.
+	inFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "addr_alloc_in_flight_requests",
+			Help: "Requests being served, by protocol; over " +
+				"HTTP/2, the streams open.",
+		},
+		[]string{"proto"},
+	)
+
+	// Requests served, by route and status code.
+	requestStatus = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "addr_alloc_requests_total",
+			Help: "HTTP requests served, by route and status code.",
+		},
+		[]string{"route", "code"},
+	)
+
+	// Addresses allocated, released and run out of, by pool.
+	allocations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "addr_alloc_allocations_total",
+			Help: "Addresses allocated, by pool.",
+		},
+		[]string{"pool"},
+	)
+	releases = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "addr_alloc_releases_total",
+			Help: "Addresses released, by pool.",
+		},
+		[]string{"pool"},
+	)
+	exhaustions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "addr_alloc_exhausted_total",
+			Help: "Allocations refused for want of a free " +
+				"address, by pool.",
+		},
+		[]string{"pool"},
+	)
+
+	// Requests failed by the database, reading or writing.
+	databaseErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "addr_alloc_database_errors_total",
+			Help: "Requests failed by a database error, by " +
+				"operation, read or write.",
+		},
+		[]string{"op"},
+	)
+
+	// Queries answered by the DNS responder.
+	dnsQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "addr_alloc_dns_queries_total",
+			Help: "DNS queries answered, by response code.",
+		},
+		[]string{"rcode"},
+	)
+
+	// Requests refused by -rate-limit.
+	rateLimited = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "addr_alloc_rate_limited_total",
+			Help: "Requests refused for exceeding -rate-limit.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(requestDuration, requestStatus, inFlight,
+		allocations, releases, exhaustions, databaseErrors,
+		dnsQueries, rateLimited,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "addr_alloc_open_connections",
+			Help: "Client connections open.",
+		}, func() float64 {
+			return float64(openConns.Load())
+		}))
+}
+
+// Registers gauges computed from the handler's bitmap when scraped,
+// labelled with the pool name.
+func registerPoolMetrics(h *Handler) {
+
+	labels := prometheus.Labels{"pool": h.name}
+
+	// Calls f with the bitmap held, or returns 0 in standby.
+	fromBitmap := func(f func(b *bitmap) float64) func() float64 {
+		return func() float64 {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			if h.used == nil {
+				return 0
+			}
+			return f(h.used)
+		}
+	}
+
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "addr_alloc_pool_addresses",
+			ConstLabels: labels,
+			Help:        "Addresses in the pool.",
+		}, fromBitmap(func(b *bitmap) float64 {
+			return float64(b.size)
+		})),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "addr_alloc_allocated_addresses",
+			ConstLabels: labels,
+			Help:        "Addresses in the pool allocated to devices.",
+		}, fromBitmap(func(b *bitmap) float64 {
+			return float64(h.deviceCount())
+		})),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "addr_alloc_cooling_addresses",
+			ConstLabels: labels,
+			Help: "Addresses in the pool freed but waiting out " +
+				"-reuse-cooldown.",
+		}, fromBitmap(func(b *bitmap) float64 {
+			return float64(len(h.cooling))
+		})),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "addr_alloc_free_addresses",
+			ConstLabels: labels,
+			Help:        "Addresses in the pool not allocated.",
+		}, fromBitmap(func(b *bitmap) float64 {
+			return float64(b.free())
+		})),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "addr_alloc_free_runs",
+			ConstLabels: labels,
+			Help: "Runs of consecutive free addresses; more runs " +
+				"means a more fragmented pool.",
+		}, fromBitmap(func(b *bitmap) float64 {
+			runs, _ := b.freeRuns()
+			return float64(runs)
+		})),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "addr_alloc_largest_free_block",
+			ConstLabels: labels,
+			Help:        "Longest run of consecutive free addresses.",
+		}, fromBitmap(func(b *bitmap) float64 {
+			_, longest := b.freeRuns()
+			return float64(longest)
+		})),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "addr_alloc_high_water_addresses",
+			ConstLabels: labels,
+			Help:        "Most addresses ever allocated at once.",
+		}, fromBitmap(func(b *bitmap) float64 {
+			return float64(h.highWater)
+		})),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "addr_alloc_pool_near_exhaustion",
+			ConstLabels: labels,
+			Help: "1 while more of the pool is allocated than " +
+				"-warn-threshold, else 0.",
+		}, fromBitmap(func(b *bitmap) float64 {
+			if h.nearExhaustion {
+				return 1
+			}
+			return 0
+		})),
+	)
+
+}
+
+// Wraps a ResponseWriter, remembering the status code sent and counting
+// the body bytes written.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Maps a request path to its route label, e.g. /get/foo -> /get.  Paths
+// matching no route are "other".
+func routeOf(path string) string {
+
+	rt, _ := findRoute(path)
+	if rt == nil {
+		return "other"
+	}
+	if rt.path == "/" {
+		return rt.path
+	}
+	return strings.TrimSuffix(rt.path, "/")
+
+}
+
+// Middleware recording latency and status code for each request.
+func instrument(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+
+		streams := inFlight.WithLabelValues(r.Proto)
+		streams.Inc()
+		next.ServeHTTP(sw, r)
+		streams.Dec()
+
+		// Handler wrote nothing at all, net/http sends a 200.
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		route := routeOf(r.URL.Path)
+		requestDuration.WithLabelValues(route).
+			Observe(time.Since(start).Seconds())
+		requestStatus.WithLabelValues(route,
+			strconv.Itoa(sw.status)).Inc()
+
+	})
+
+}
+
+// Serves /metrics and the handler's health checks over plain HTTP on a
+// listener.
+func serveMetrics(ln net.Listener, h *Handler,
+	timeout time.Duration) *http.Server {
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", h.ServeHealth)
+	mux.HandleFunc("/readyz", h.ServeReady)
+
+	s := &http.Server{
+		Addr:              ln.Addr().String(),
+		Handler:           mux,
+		ReadHeaderTimeout: timeout,
+		ConnState:         trackConn,
+	}
+	go func() {
+		err := s.Serve(ln)
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	return s
+
+}
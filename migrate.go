@@ -0,0 +1,179 @@
+package main
+
+//
+// The migrate subcommand: an offline copy of allocations from one database
+// file to another,
+//
+//   addr_alloc migrate -from a.db -to b.db [-range 10.20.0.0/16]
+//
+// keeping device names and allocation times, and optionally renumbering
+// into a new range.  Nothing is written unless every allocation fits.
+// Both files must be free of running allocators, which hold them locked.
+//
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var errMisfit = errors.New("allocations don't fit the destination")
+
+// Runs the migrate subcommand.
+func migrate(args []string) error {
+
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fromPath := fs.String("from", "", "Database file to copy from")
+	toPath := fs.String("to", "", "Database file to copy to, created if "+
+		"it doesn't exist")
+	fromNS := fs.String("from-namespace", defaultNamespace,
+		"Namespace to copy from")
+	toNS := fs.String("to-namespace", defaultNamespace,
+		"Namespace to copy to")
+	within := fs.String("range", "", "Pool to renumber allocations "+
+		"into, in address order, given as for -pool; if empty they "+
+		"keep their addresses, which must be in the compiled-in pool")
+	fs.Parse(args)
+
+	if *fromPath == "" || *toPath == "" {
+		return errors.New("migrate: -from and -to are required")
+	}
+
+	dest := defaultPool(false)
+	if *within != "" {
+		var err error
+		dest, err = parsePool(*within)
+		if err != nil {
+			return fmt.Errorf("migrate: -range: %s", err)
+		}
+	}
+
+	opts := &bolt.Options{Timeout: lockWait}
+	src, err := bolt.Open(*fromPath, 0600,
+		&bolt.Options{Timeout: lockWait, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("migrate: %s: %s", *fromPath, err)
+	}
+	defer src.Close()
+	dst, err := bolt.Open(*toPath, 0600, opts)
+	if err != nil {
+		return fmt.Errorf("migrate: %s: %s", *toPath, err)
+	}
+	defer dst.Close()
+
+	from := &Handler{db: src, buckets: newBuckets(*fromNS)}
+	to := &Handler{db: dst, buckets: newBuckets(*toNS)}
+
+	allocs := []allocation{}
+	err = src.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(from.buckets.addresses) == nil {
+			return fmt.Errorf("no namespace %s", *fromNS)
+		}
+		return from.exportEach(tx, time.Time{},
+			func(a *allocation) error {
+				allocs = append(allocs, *a)
+				return nil
+			}, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("migrate: %s: %s", *fromPath, err)
+	}
+
+	// Renumbering keeps allocations in the same order.
+	sort.Slice(allocs, func(i, j int) bool {
+		return bytes.Compare(allocs[i].Address,
+			allocs[j].Address) < 0
+	})
+
+	misfits := []string{}
+	var next uint32
+	err = dst.Update(func(tx *bolt.Tx) error {
+
+		err := to.createBuckets(tx)
+		if err != nil {
+			return err
+		}
+
+		for i := range allocs {
+
+			a := &allocs[i]
+			old := a.Address
+
+			if *within != "" {
+				for next < dest.size() &&
+					to.lookupIP(tx, dest.address(next)) != "" {
+					next++
+				}
+				if next >= dest.size() {
+					misfits = append(misfits, fmt.Sprintf(
+						"%s: %s: range is full",
+						a.Device, old))
+					continue
+				}
+				a.Address = dest.address(next)
+				next++
+			}
+
+			if !dest.contains(a.Address) {
+				misfits = append(misfits, fmt.Sprintf(
+					"%s: %s: outside the pool", a.Device,
+					old))
+				continue
+			}
+			holder := to.lookupIP(tx, a.Address)
+			if holder != "" && holder != a.Device {
+				misfits = append(misfits, fmt.Sprintf(
+					"%s: %s: allocated to %s", a.Device,
+					a.Address, holder))
+				continue
+			}
+			existing, err := to.getAllocation(tx, a.Device)
+			if err != nil {
+				return err
+			}
+			if existing != nil && !existing.Address.Equal(a.Address) {
+				misfits = append(misfits, fmt.Sprintf(
+					"%s: already has %s", a.Device,
+					existing.Address))
+				continue
+			}
+
+			rec := a.record
+			err = to.putAllocation(tx, a.Device, &rec)
+			if err != nil {
+				return err
+			}
+
+		}
+
+		if len(misfits) > 0 {
+			return errMisfit
+		}
+
+		return nil
+
+	})
+
+	if err == errMisfit {
+		for _, m := range misfits {
+			fmt.Fprintln(os.Stderr, m)
+		}
+		return fmt.Errorf("migrate: %d of %d allocations don't fit, "+
+			"nothing copied", len(misfits), len(allocs))
+	}
+	if err != nil {
+		return fmt.Errorf("migrate: %s: %s", *toPath, err)
+	}
+
+	fmt.Printf("Copied %d allocations from %s to %s\n", len(allocs),
+		*fromPath, *toPath)
+
+	return nil
+
+}
@@ -0,0 +1,285 @@
+package main
+
+//
+// Moving a device to a new address, swapping two devices' addresses, and
+// renaming a device, each keeping the rest of its record.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+)
+
+// Errors from the move transaction.
+var (
+	errNoDevice = errors.New("no such device")
+	errTaken    = errors.New("address taken")
+	errExists   = errors.New("device exists")
+)
+
+// Moves a device to the address given as ?to=.  The old address is freed
+// and the new one assigned in a single transaction.  Answers 404 for an
+// unknown device, 409 if the address belongs to another device.
+func (h *Handler) ServeMove(w http.ResponseWriter, r *http.Request,
+	device string) {
+
+	if device == "" {
+		writeError(w, r, http.StatusBadRequest,
+			"No device name given, use /move/<device>?to=<address>.")
+		return
+	}
+
+	to := parseIPv4(r.URL.Query().Get("to"))
+	if to == nil {
+		writeError(w, r, http.StatusBadRequest,
+			"Give the new address as ?to=<address>.")
+		return
+	}
+	if !h.currentPool().contains(to) {
+		writeError(w, r, http.StatusBadRequest,
+			"Address is outside the pool.")
+		return
+	}
+
+	now := h.now()
+	var old *record
+	var holder string
+	var took bool
+	err := h.db.Update(func(tx *bolt.Tx) error {
+
+		rec, err := h.getAllocation(tx, device)
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			return errNoDevice
+		}
+
+		holder = h.lookupIP(tx, to)
+		if holder == device {
+			old = rec
+			return nil
+		}
+		if holder != "" {
+			return errTaken
+		}
+
+		// The target has to be free in the bitmap too: it may be
+		// cooling down.
+		took = h.take(to)
+		if !took {
+			return errTaken
+		}
+
+		err = h.deleteAllocation(tx, device, rec, eventMove)
+		if err != nil {
+			return err
+		}
+
+		old = &record{}
+		*old = *rec
+		rec.Address = to
+
+		err = h.putAllocation(tx, device, rec)
+		if err != nil {
+			return err
+		}
+
+		return h.cool(tx, old.Address, now)
+
+	})
+
+	if err != nil {
+		if took {
+			h.free(to)
+		}
+		switch err {
+		case errNoDevice:
+			writeError(w, r, http.StatusNotFound, "Device not found.")
+		case errTaken:
+			if holder == "" {
+				writeError(w, r, http.StatusConflict,
+					h.whyUnavailable(to))
+				break
+			}
+			writeError(w, r, http.StatusConflict,
+				"Address is allocated to "+holder+".")
+		default:
+			writeFailed(w, r, err)
+		}
+		return
+	}
+
+	if holder != device {
+		h.retire(old.Address, now)
+		fmt.Printf("Device %s: moved from %s to %s\n", device,
+			old.Address, to)
+		h.emit((&event{Type: eventMove, Device: device, Address: to,
+			PreviousAddress: old.Address}).by(r))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, to.String())
+	return
+
+}
+
+// Swaps the addresses of the devices given as ?a= and ?b=, in a single
+// transaction, so neither address is ever free or held by both.  Answers a
+// JSON object of device name to its new address, or 404 if either device
+// doesn't exist.  The swap is two move events.
+func (h *Handler) ServeSwap(w http.ResponseWriter, r *http.Request) {
+
+	nameA := r.URL.Query().Get("a")
+	nameB := r.URL.Query().Get("b")
+	if nameA == "" || nameB == "" || nameA == nameB {
+		writeError(w, r, http.StatusBadRequest,
+			"Give two different devices as ?a=<device>&b=<device>.")
+		return
+	}
+	a, b := h.scoped(r, nameA), h.scoped(r, nameB)
+	if h.set != nil && h.set.forDevice(h.bareDevice(b)) != h {
+		writeError(w, r, http.StatusBadRequest,
+			"Devices in different pools can't swap addresses.")
+		return
+	}
+
+	var recA, recB *record
+	err := h.db.Update(func(tx *bolt.Tx) error {
+
+		var err error
+		recA, err = h.getAllocation(tx, a)
+		if err != nil {
+			return err
+		}
+		recB, err = h.getAllocation(tx, b)
+		if err != nil {
+			return err
+		}
+		if recA == nil || recB == nil {
+			return errNoDevice
+		}
+
+		for _, d := range []struct {
+			device string
+			rec    *record
+		}{{a, recA}, {b, recB}} {
+			err = h.noteHistory(tx, d.device, d.rec)
+			if err != nil {
+				return err
+			}
+		}
+
+		recA.Address, recB.Address = recB.Address, recA.Address
+
+		err = h.putAllocation(tx, a, recA)
+		if err != nil {
+			return err
+		}
+
+		return h.putAllocation(tx, b, recB)
+
+	})
+
+	if err != nil {
+		switch err {
+		case errNoDevice:
+			writeError(w, r, http.StatusNotFound, "Device not found.")
+		default:
+			writeFailed(w, r, err)
+		}
+		return
+	}
+
+	fmt.Printf("Device %s: swapped %s for %s with %s\n", a, recB.Address,
+		recA.Address, b)
+	h.emit((&event{Type: eventMove, Device: a, Address: recA.Address,
+		PreviousAddress: recB.Address, Reason: "swap with " + b}).by(r))
+	h.emit((&event{Type: eventMove, Device: b, Address: recB.Address,
+		PreviousAddress: recA.Address, Reason: "swap with " + a}).by(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		nameA: recA.Address.String(),
+		nameB: recB.Address.String(),
+	})
+	return
+
+}
+
+// Renames the device given as ?from= to ?to=, keeping its address and the
+// rest of its record.  Answers 404 if from doesn't exist, 409 if to does.
+func (h *Handler) ServeRename(w http.ResponseWriter, r *http.Request) {
+
+	fromName := r.URL.Query().Get("from")
+	toName := r.URL.Query().Get("to")
+	if fromName == "" || toName == "" {
+		writeError(w, r, http.StatusBadRequest,
+			"Give the device names as ?from=<device>&to=<device>.")
+		return
+	}
+	from, to := h.scoped(r, fromName), h.scoped(r, toName)
+	if !h.deviceOK(w, r, to) {
+		return
+	}
+
+	var addr net.IP
+	err := h.db.Update(func(tx *bolt.Tx) error {
+
+		rec, err := h.getAllocation(tx, from)
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			return errNoDevice
+		}
+
+		existing, err := h.getAllocation(tx, to)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return errExists
+		}
+
+		err = h.deleteAllocation(tx, from, rec, eventRename)
+		if err != nil {
+			return err
+		}
+		addr = rec.Address
+
+		return h.putAllocation(tx, to, rec)
+
+	})
+
+	if err != nil {
+		switch err {
+		case errNoDevice:
+			writeError(w, r, http.StatusNotFound, "Device not found.")
+		case errExists:
+			writeError(w, r, http.StatusConflict,
+				"Device "+toName+" already exists.")
+		default:
+			writeFailed(w, r, err)
+		}
+		return
+	}
+
+	fmt.Printf("Device %s: renamed to %s\n", from, to)
+	h.emit((&event{Type: eventRename, Device: to, Address: addr,
+		PreviousDevice: from}).by(r))
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, toName)
+	return
+
+}
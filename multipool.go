@@ -0,0 +1,272 @@
+package main
+
+//
+// Multiple pools.  With -pools, further pools are configured from a JSON
+// file, each with its own address range and buckets in the shared
+// database, and chosen by a prefix of the device name:
+//
+//   [{"name": "team-a", "prefix": "teamA-", "pool": "10.100.0.0/16"},
+//    {"name": "team-b", "prefix": "teamB-", "pool": "10.101.0.0/16",
+//     "namespace": "b", "subnet": "10.101.0.0/16",
+//     "reserved": ["10.101.0.0/24"]}]
+//
+// so /get/teamA-host allocates from 10.100.0.0/16.  Names matching no prefix
+// use the default pool, configured by the command line.  Endpoints not
+// about a device use the default pool unless given ?pool=<name>.  Each pool
+// shares the command line's other settings.  A pool given "listen" is
+// served on that address alone, optionally with its own certificates, and
+// not on -listen.  "reserved" blocks are held on startup, as if by
+// /reserve-block, unless they're already partly in use.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Name of the pool configured by the command line.
+const defaultPoolName = "default"
+
+// A pool, as configured in the -pools file.
+type poolConfig struct {
+
+	// Pool name, for ?pool= and metrics.
+	Name string `json:"name"`
+
+	// Device name prefix selecting the pool.
+	Prefix string `json:"prefix"`
+
+	// Address ranges, as for -pool.
+	Pool string `json:"pool"`
+
+	// Bucket namespace, as for -namespace.  Defaults to the name.
+	Namespace string `json:"namespace,omitempty"`
+
+	// Network, as for -subnet.
+	Subnet string `json:"subnet,omitempty"`
+
+	// Address to serve the pool alone on, e.g. :8443, instead of on
+	// -listen.
+	Listen string `json:"listen,omitempty"`
+
+	// Server certificate, key and client CA for the pool's listener.
+	// Default to those of -listen.
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+	CA   string `json:"ca,omitempty"`
+
+	// Blocks to hold out of the pool, as CIDRs.
+	Reserved []string `json:"reserved,omitempty"`
+}
+
+// The pools served.
+type poolSet struct {
+
+	// The default pool first, then those from -pools in the order
+	// configured.
+	handlers []*Handler
+
+	// Credentials of the listeners, reloaded on SIGHUP.
+	creds []*tlsFiles
+}
+
+// Returns a set with just the default pool.
+func newPoolSet(dflt *Handler) *poolSet {
+
+	ps := &poolSet{handlers: []*Handler{dflt}}
+	dflt.name = defaultPoolName
+	dflt.set = ps
+
+	return ps
+
+}
+
+// Adds the pools configured in a -pools file, which share the default
+// pool's options.  Prefixes must not be ambiguous, nor ranges overlap.
+func (ps *poolSet) load(path string) error {
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var configs []poolConfig
+	err = json.Unmarshal(b, &configs)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	dflt := ps.handlers[0]
+	names := map[string]bool{defaultPoolName: true}
+	namespaces := map[string]bool{string(dflt.buckets.addresses): true}
+
+	for _, c := range configs {
+
+		if c.Name == "" || names[c.Name] {
+			return fmt.Errorf("pool names must be given and "+
+				"unique, and not %s", defaultPoolName)
+		}
+		names[c.Name] = true
+
+		if c.Prefix == "" {
+			return fmt.Errorf("pool %s: no prefix", c.Name)
+		}
+		for _, o := range ps.handlers[1:] {
+			if strings.HasPrefix(c.Prefix, o.prefix) ||
+				strings.HasPrefix(o.prefix, c.Prefix) {
+				return fmt.Errorf("pool %s: prefix %s is "+
+					"ambiguous with pool %s's %s",
+					c.Name, c.Prefix, o.name, o.prefix)
+			}
+		}
+
+		p, err := parsePool(c.Pool)
+		if err != nil {
+			return fmt.Errorf("pool %s: %s", c.Name, err)
+		}
+		for _, o := range ps.handlers {
+			for i := range p.segments {
+				for j := range o.pool.segments {
+					if p.segments[i].overlaps(
+						&o.pool.segments[j]) {
+						return fmt.Errorf("pool %s "+
+							"overlaps pool %s",
+							c.Name, o.name)
+					}
+				}
+			}
+		}
+
+		if c.Namespace == "" {
+			c.Namespace = c.Name
+		}
+		if namespaces[c.Namespace] {
+			return fmt.Errorf("pool %s: namespace %s is already "+
+				"used", c.Name, c.Namespace)
+		}
+		namespaces[c.Namespace] = true
+
+		h := &Handler{
+			options: dflt.options,
+			buckets: newBuckets(c.Namespace),
+			name:    c.Name,
+			prefix:  c.Prefix,
+			set:     ps,
+			pool:    p,
+		}
+		if c.Subnet != "" {
+			_, h.subnet, err = net.ParseCIDR(c.Subnet)
+			if err != nil {
+				return fmt.Errorf("pool %s: %s", c.Name, err)
+			}
+		}
+		if c.Listen == "" && (c.Cert != "" || c.Key != "" || c.CA != "") {
+			return fmt.Errorf("pool %s: certificates need a "+
+				"listen address", c.Name)
+		}
+		if c.Listen != "" {
+			_, _, err = net.SplitHostPort(c.Listen)
+			if err != nil {
+				return fmt.Errorf("pool %s: %s", c.Name, err)
+			}
+			h.listener = &poolListener{addr: c.Listen, cert: c.Cert,
+				key: c.Key, ca: c.CA}
+		}
+		for _, cidr := range c.Reserved {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil || n.IP.To4() == nil ||
+				len(p.windows(n)) == 0 {
+				return fmt.Errorf("pool %s: reserved block %s "+
+					"isn't an IPv4 CIDR in the pool",
+					c.Name, cidr)
+			}
+			h.reserved = append(h.reserved, n)
+		}
+
+		ps.handlers = append(ps.handlers, h)
+
+	}
+
+	return nil
+
+}
+
+// Returns the pool a device name selects.
+func (ps *poolSet) forDevice(device string) *Handler {
+
+	for _, h := range ps.handlers[1:] {
+		if strings.HasPrefix(device, h.prefix) {
+			return h
+		}
+	}
+
+	return ps.handlers[0]
+
+}
+
+// Returns the pool an address lies in, or the default pool.
+func (ps *poolSet) forAddress(ip net.IP) *Handler {
+
+	for _, h := range ps.handlers {
+		if h.currentPool().contains(ip) {
+			return h
+		}
+	}
+
+	return ps.handlers[0]
+
+}
+
+// Returns the pool a request is for: the one named by ?pool=, else for
+// device endpoints the one the device name selects, else the default.
+// Returns nil for an unknown ?pool=.
+func (ps *poolSet) choose(r *http.Request) *Handler {
+
+	if name := r.URL.Query().Get("pool"); name != "" {
+		for _, h := range ps.handlers {
+			if h.name == name {
+				return h
+			}
+		}
+		return nil
+	}
+
+	rt, arg := findRoute(r.URL.Path)
+	if rt == nil {
+		return ps.handlers[0]
+	}
+
+	switch {
+	case rt.path == "/lookup/":
+		if ip := parseIPv4(canonicalDevice(arg)); ip != nil {
+			return ps.forAddress(ip)
+		}
+	case rt.path == "/rename":
+		return ps.forDevice(r.URL.Query().Get("from"))
+	case rt.path == "/swap":
+		return ps.forDevice(r.URL.Query().Get("a"))
+	case rt.path != "/" && strings.HasSuffix(rt.path, "/"):
+		return ps.forDevice(canonicalDevice(arg))
+	}
+
+	return ps.handlers[0]
+
+}
+
+// Passes a request to the pool it's for, unless that pool has a listener
+// of its own.
+func (ps *poolSet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	h := ps.choose(r)
+	if h == nil || h.listener != nil {
+		writeError(w, r, http.StatusNotFound, "No such pool.")
+		return
+	}
+
+	h.ServeHTTP(w, r)
+
+}
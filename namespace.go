@@ -0,0 +1,105 @@
+package main
+
+//
+// Bucket names.  Each allocator keeps its state in a set of buckets named
+// after its namespace, so several can share one database file.  The
+// default namespace, "addresses", keeps the names used before namespaces
+// existed.
+//
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+// Names of an allocator's buckets.
+type buckets struct {
+
+	// Device to allocation record.
+	addresses []byte
+
+	// Address to device, the reverse index.
+	byip []byte
+
+	// Device to tombstone, for allocations removed.
+	removed []byte
+
+	// Allocator-wide values, e.g. the high-water mark.
+	meta []byte
+
+	// Address to the time its reuse cooldown ends.
+	cooldown []byte
+
+	// Device to allocation record, for allocations found outside the
+	// pool with -out-of-pool=quarantine.
+	quarantine []byte
+
+	// Device to its past allocations, with -history.
+	history []byte
+
+	// Client identity and Idempotency-Key to the answer given.
+	idempotency []byte
+
+	// Time and sequence number to event, with -audit.
+	audit []byte
+
+	// Reserved block, as a CIDR, to when and why it was reserved.
+	blocks []byte
+
+	// Scratch space for the self-test.
+	selftest []byte
+}
+
+// The namespace used unless configured otherwise.
+const defaultNamespace = "addresses"
+
+// Returns the bucket names for a namespace.
+func newBuckets(ns string) *buckets {
+
+	if ns == defaultNamespace {
+		return &buckets{
+			addresses:   []byte("addresses"),
+			byip:        []byte("byip"),
+			removed:     []byte("removed"),
+			meta:        []byte("meta"),
+			cooldown:    []byte("cooldown"),
+			quarantine:  []byte("quarantine"),
+			history:     []byte("history"),
+			idempotency: []byte("idempotency"),
+			audit:       []byte("audit"),
+			blocks:      []byte("blocks"),
+			selftest:    []byte("selftest"),
+		}
+	}
+
+	return &buckets{
+		addresses:   []byte(ns),
+		byip:        []byte(ns + ".byip"),
+		removed:     []byte(ns + ".removed"),
+		meta:        []byte(ns + ".meta"),
+		cooldown:    []byte(ns + ".cooldown"),
+		quarantine:  []byte(ns + ".quarantine"),
+		history:     []byte(ns + ".history"),
+		idempotency: []byte(ns + ".idempotency"),
+		audit:       []byte(ns + ".audit"),
+		blocks:      []byte(ns + ".blocks"),
+		selftest:    []byte(ns + ".selftest"),
+	}
+
+}
+
+// Creates the allocator's buckets, if they don't exist.
+func (h *Handler) createBuckets(tx *bolt.Tx) error {
+
+	for _, name := range [][]byte{h.buckets.addresses, h.buckets.byip,
+		h.buckets.removed, h.buckets.meta, h.buckets.cooldown,
+		h.buckets.quarantine, h.buckets.history,
+		h.buckets.idempotency, h.buckets.audit, h.buckets.blocks} {
+		_, err := tx.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
@@ -0,0 +1,162 @@
+package main
+
+//
+// A machine-readable description of the API, as an OpenAPI 3 document.  It's
+// generated from the routes table, so it can't drift from the endpoints
+// actually served: each route becomes a path, a prefix route taking its
+// argument as a path parameter, and the ?name= parameters its description
+// mentions become query parameters.
+//
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Query parameters mentioned in a route description.
+var queryParam = regexp.MustCompile(`\?([a-z_]+)=`)
+
+// Returns the OpenAPI path for a route, and the name of its path parameter
+// if it's a prefix route.
+func (rt *route) openAPIPath() (string, string) {
+
+	if rt.path == "/" || !strings.HasSuffix(rt.path, "/") {
+		return rt.path, ""
+	}
+
+	name := "device"
+	switch rt.path {
+	case "/lookup/":
+		name = "address"
+	case "/debug/pprof/":
+		name = "profile"
+	}
+
+	return rt.path + "{" + name + "}", name
+
+}
+
+// Returns the OpenAPI operation for a route.
+func (rt *route) operation() map[string]interface{} {
+
+	params := []interface{}{}
+
+	_, arg := rt.openAPIPath()
+	if arg != "" {
+		params = append(params, map[string]interface{}{
+			"name":     arg,
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]string{"type": "string"},
+		})
+	}
+
+	seen := map[string]bool{}
+	for _, m := range queryParam.FindAllStringSubmatch(rt.desc, -1) {
+		if seen[m[1]] {
+			continue
+		}
+		seen[m[1]] = true
+		params = append(params, map[string]interface{}{
+			"name":   m[1],
+			"in":     "query",
+			"schema": map[string]string{"type": "string"},
+		})
+	}
+
+	errorResponse := map[string]interface{}{
+		"description": "Error, as text, or as JSON with " +
+			"Accept: application/json",
+		"content": map[string]interface{}{
+			"text/plain": map[string]interface{}{
+				"schema": map[string]string{"type": "string"},
+			},
+			"application/json": map[string]interface{}{
+				"schema": map[string]string{
+					"$ref": "#/components/schemas/error",
+				},
+			},
+		},
+	}
+
+	op := map[string]interface{}{
+		"summary":    rt.desc,
+		"parameters": params,
+		"responses": map[string]interface{}{
+			"200": map[string]interface{}{
+				"description": "Success",
+				"content": map[string]interface{}{
+					"text/plain": map[string]interface{}{
+						"schema": map[string]string{
+							"type": "string",
+						},
+					},
+					"application/json": map[string]interface{}{
+						"schema": map[string]string{},
+					},
+				},
+			},
+			"default": errorResponse,
+		},
+	}
+	if rt.admin {
+		op["x-admin"] = true
+		op["description"] = "Restricted to admin clients."
+	}
+
+	return op
+
+}
+
+// Serves the OpenAPI document describing the API.
+func (h *Handler) ServeOpenAPI(w http.ResponseWriter, r *http.Request) {
+
+	paths := map[string]interface{}{}
+	for i := range routes {
+		rt := &routes[i]
+		path, _ := rt.openAPIPath()
+		ops := map[string]interface{}{}
+		for _, m := range rt.methods {
+			ops[strings.ToLower(m)] = rt.operation()
+		}
+		paths[path] = ops
+	}
+
+	doc := map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]string{
+			"title":   "Address allocator",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"error": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"status": map[string]string{
+							"type": "integer",
+						},
+						"error": map[string]string{
+							"type": "string",
+						},
+					},
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"mtls": map[string]string{"type": "mutualTLS"},
+			},
+		},
+		"security": []interface{}{
+			map[string][]string{"mtls": {}},
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(doc)
+	return
+
+}
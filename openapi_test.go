@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// /openapi.json describes exactly the routes served: every path and
+// method, which are admin only, and no more.
+func TestOpenAPIRoutes(t *testing.T) {
+
+	h := newTestHandler(t, nil)
+
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]map[string]struct {
+			Admin      bool `json:"x-admin"`
+			Parameters []struct {
+				Name string `json:"name"`
+				In   string `json:"in"`
+			} `json:"parameters"`
+		} `json:"paths"`
+	}
+	err := json.Unmarshal([]byte(expect(t, h, "GET", "/openapi.json",
+		"dev1", http.StatusOK)), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Errorf("openapi: got %q", doc.OpenAPI)
+	}
+
+	documented := map[string]bool{}
+	for path, ops := range doc.Paths {
+
+		documented[path] = true
+
+		// The path, with its parameter filled in, is dispatched to a
+		// route accepting just the methods documented.
+		target := path
+		if i := strings.Index(path, "{"); i >= 0 {
+			target = path[:i] + "x"
+		}
+		rt, _ := findRoute(target)
+		if rt == nil {
+			t.Errorf("%s: documented, but not served", path)
+			continue
+		}
+		methods := []string{}
+		for m, op := range ops {
+			methods = append(methods, strings.ToUpper(m))
+			if op.Admin != rt.admin {
+				t.Errorf("%s %s: x-admin %v, route admin %v",
+					m, path, op.Admin, rt.admin)
+			}
+			if rt.path != path && (len(op.Parameters) == 0 ||
+				op.Parameters[0].In != "path") {
+				t.Errorf("%s %s: no path parameter", m, path)
+			}
+		}
+		sort.Strings(methods)
+		want := append([]string(nil), rt.methods...)
+		sort.Strings(want)
+		if strings.Join(methods, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: documents %v, route accepts %v", path,
+				methods, want)
+		}
+
+	}
+
+	for _, rt := range routes {
+		path, _ := rt.openAPIPath()
+		if !documented[path] {
+			t.Errorf("%s: served, but not documented", rt.path)
+		}
+	}
+
+}
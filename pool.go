@@ -0,0 +1,519 @@
+package main
+
+//
+// The address pool: the ranges addresses are allocated from.  A pool is one
+// or more segments, non-contiguous ranges taken in the order configured, so
+// allocation fills the first before moving on to the next.  Positions in
+// the pool, as used by the bitmap and next, run through the segments in
+// that order.  A pool value is never modified; resizing it swaps in a new
+// one.
+//
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// An IPv4 range, from start up to but not including end.
+type segment struct {
+	start net.IP
+	end   net.IP
+}
+
+// Number of addresses in the segment.
+func (s *segment) size() uint32 {
+	return ipToUint(s.end) - ipToUint(s.start)
+}
+
+// Reports whether an address lies within the segment.  An IPv4 address
+// may be in either form; the segment's bounds are 4 bytes.
+func (s *segment) contains(a net.IP) bool {
+
+	a = a.To4()
+	if a == nil {
+		return false
+	}
+
+	return bytes.Compare(a, s.start) >= 0 && bytes.Compare(a, s.end) < 0
+
+}
+
+// Reports whether two segments share any addresses.
+func (s *segment) overlaps(o *segment) bool {
+	return bytes.Compare(s.start, o.end) < 0 &&
+		bytes.Compare(o.start, s.end) < 0
+}
+
+// Addresses allocated from, in order.
+type pool struct {
+	segments []segment
+}
+
+// The compiled-in pool, from ini up to fin, and including fin if inclusive
+// is set.
+func defaultPool(inclusive bool) *pool {
+
+	end := fin
+	if inclusive {
+		end = uintToIP(ipToUint(fin) + 1)
+	}
+
+	return &pool{segments: []segment{{start: ini, end: end}}}
+
+}
+
+// Parses a pool given as comma-separated segments, each a CIDR, whose
+// every address is used, or a range first-last.
+func parsePool(s string) (*pool, error) {
+
+	p := &pool{}
+
+	for _, part := range strings.Split(s, ",") {
+
+		part = strings.TrimSpace(part)
+		var seg segment
+
+		if strings.Contains(part, "/") {
+			_, n, err := net.ParseCIDR(part)
+			if err != nil || n.IP.To4() == nil {
+				return nil, fmt.Errorf("bad segment %s", part)
+			}
+			ones, _ := n.Mask.Size()
+			end := uint64(ipToUint(n.IP)) + 1<<(32-ones)
+			if end > math.MaxUint32 {
+				return nil, fmt.Errorf("segment %s can't "+
+					"reach 255.255.255.255", part)
+			}
+			seg = segment{start: n.IP.To4(),
+				end: uintToIP(uint32(end))}
+		} else {
+			first, last, ok := strings.Cut(part, "-")
+			start := parseIPv4(strings.TrimSpace(first))
+			fin := parseIPv4(strings.TrimSpace(last))
+			if !ok || start == nil || fin == nil ||
+				bytes.Compare(start, fin) > 0 {
+				return nil, fmt.Errorf("bad segment %s, "+
+					"expected a CIDR or first-last", part)
+			}
+			if ipToUint(fin) == math.MaxUint32 {
+				return nil, fmt.Errorf("segment %s can't "+
+					"reach 255.255.255.255", part)
+			}
+			seg = segment{start: start,
+				end: uintToIP(ipToUint(fin) + 1)}
+		}
+
+		for i := range p.segments {
+			if p.segments[i].overlaps(&seg) {
+				return nil, fmt.Errorf("segment %s overlaps "+
+					"another", part)
+			}
+		}
+		p.segments = append(p.segments, seg)
+
+	}
+
+	return p, nil
+
+}
+
+// Returns a pool of size addresses starting at start.
+func sizedPool(start string, size uint64) (*pool, error) {
+
+	first := parseIPv4(start)
+	if first == nil {
+		return nil, fmt.Errorf("bad start address %s", start)
+	}
+	if size == 0 {
+		return nil, errors.New("the size must be at least 1")
+	}
+
+	end := uint64(ipToUint(first)) + size
+	if end > math.MaxUint32 {
+		return nil, fmt.Errorf("%d addresses from %s would reach "+
+			"255.255.255.255", size, first)
+	}
+
+	return &pool{segments: []segment{{start: first,
+		end: uintToIP(uint32(end))}}}, nil
+
+}
+
+// The pool as comma-separated first-last ranges.
+func (p *pool) String() string {
+
+	parts := []string{}
+	for _, s := range p.segments {
+		parts = append(parts, fmt.Sprintf("%s-%s", s.start,
+			uintToIP(ipToUint(s.end)-1)))
+	}
+
+	return strings.Join(parts, ",")
+
+}
+
+// Number of addresses in the pool.
+func (p *pool) size() uint32 {
+
+	var n uint32
+	for i := range p.segments {
+		n += p.segments[i].size()
+	}
+
+	return n
+
+}
+
+// Position of an address within the pool.  Addresses outside it are
+// positioned at the end.
+func (p *pool) index(a net.IP) uint32 {
+
+	var off uint32
+	for i := range p.segments {
+		s := &p.segments[i]
+		if s.contains(a) {
+			return off + ipToUint(a) - ipToUint(s.start)
+		}
+		off += s.size()
+	}
+
+	return off
+
+}
+
+// Address at a position within the pool.  Positions past the end give the
+// address after the last.
+func (p *pool) address(i uint32) net.IP {
+
+	for j := range p.segments {
+		s := &p.segments[j]
+		if i < s.size() {
+			return uintToIP(ipToUint(s.start) + i)
+		}
+		i -= s.size()
+	}
+
+	return uintToIP(ipToUint(p.segments[len(p.segments)-1].end) + i)
+
+}
+
+// First address in the pool.
+func (p *pool) first() net.IP {
+	return p.segments[0].start
+}
+
+// Last address in the pool.
+func (p *pool) last() net.IP {
+	return p.address(p.size() - 1)
+}
+
+// Reports whether an address lies within the pool.
+func (p *pool) contains(a net.IP) bool {
+
+	for i := range p.segments {
+		if p.segments[i].contains(a) {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// Positions within the pool, from start up to but not including end.
+type span struct {
+	start uint32
+	end   uint32
+}
+
+// Returns the positions of the parts of a network which lie in the pool,
+// one span per segment it overlaps, in pool order.
+func (p *pool) windows(n *net.IPNet) []span {
+
+	lo := n.IP.Mask(n.Mask).To4()
+	if lo == nil {
+		return nil
+	}
+	ones, _ := n.Mask.Size()
+	hi := uint64(ipToUint(lo)) + 1<<(32-ones)
+
+	spans := []span{}
+	var off uint64
+	for i := range p.segments {
+		s := &p.segments[i]
+		start := uint64(ipToUint(s.start))
+		end := uint64(ipToUint(s.end))
+		from := max(uint64(ipToUint(lo)), start)
+		to := min(hi, end)
+		if from < to {
+			spans = append(spans, span{uint32(off + from - start),
+				uint32(off + to - start)})
+		}
+		off += end - start
+	}
+
+	return spans
+
+}
+
+// Smallest network containing the pool.
+func (p *pool) network() *net.IPNet {
+
+	lo, hi := p.first(), p.last()
+	for i := range p.segments {
+		s := &p.segments[i]
+		if bytes.Compare(s.start, lo) < 0 {
+			lo = s.start
+		}
+		if l := uintToIP(ipToUint(s.end) - 1); bytes.Compare(l, hi) > 0 {
+			hi = l
+		}
+	}
+
+	for ones := 32; ones >= 0; ones-- {
+		mask := net.CIDRMask(ones, 32)
+		n := &net.IPNet{IP: lo.Mask(mask), Mask: mask}
+		if n.Contains(hi) {
+			return n
+		}
+	}
+
+	return nil
+
+}
+
+// Returns the network the pool belongs to: -subnet if given, else the
+// smallest one containing the pool.
+func (h *Handler) network() *net.IPNet {
+
+	if h.subnet != nil {
+		return h.subnet
+	}
+
+	return h.currentPool().network()
+
+}
+
+// Returns the current pool.
+func (h *Handler) currentPool() *pool {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.pool
+
+}
+
+// Returns the pool with its last segment's end moved up so that last is
+// its final address.  The pool can't shrink, nor grow into another
+// segment.
+func (p *pool) extended(last net.IP) (*pool, error) {
+
+	if bytes.Compare(last, p.last()) < 0 {
+		return nil, errors.New("the pool can't be shrunk")
+	}
+	if ipToUint(last) == math.MaxUint32 {
+		return nil, errors.New("the pool can't reach 255.255.255.255")
+	}
+
+	e := &pool{segments: append([]segment(nil), p.segments...)}
+	tail := &e.segments[len(e.segments)-1]
+	tail.end = uintToIP(ipToUint(last) + 1)
+	for i := range e.segments[:len(e.segments)-1] {
+		if e.segments[i].overlaps(tail) {
+			return nil, errors.New("the pool can't grow into " +
+				"another of its segments")
+		}
+	}
+
+	return e, nil
+
+}
+
+// Returns the last address /extend moved the pool to, as kept in the meta
+// bucket, or nil if it's never been extended.
+func (h *Handler) getPoolEnd(tx *bolt.Tx) net.IP {
+
+	b := tx.Bucket(h.buckets.meta)
+	if b == nil {
+		return nil
+	}
+
+	v := b.Get([]byte("pool-end"))
+	if len(v) != 4 {
+		return nil
+	}
+
+	return net.IP(append([]byte(nil), v...))
+
+}
+
+// Extends the pool to the end stored by an earlier /extend, so the
+// allocations made in the extended range are in the pool again after a
+// restart.  An end which -pool has since reached or passed is ignored.
+func (h *Handler) loadPoolEnd() error {
+
+	var last net.IP
+	err := h.db.View(func(tx *bolt.Tx) error {
+		last = h.getPoolEnd(tx)
+		return nil
+	})
+	if err != nil || last == nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if bytes.Compare(last, h.pool.last()) <= 0 {
+		return nil
+	}
+	p, err := h.pool.extended(last)
+	if err != nil {
+		return fmt.Errorf("pool %s: can't apply the end %s set by "+
+			"/extend: %s", h.name, last, err)
+	}
+	log.Printf("Pool %s: extended to %s, as set by /extend", h.name, last)
+	h.pool = p
+
+	return nil
+
+}
+
+// Moves the end of the pool's last segment up so that last is its final
+// address, and stores it so that it outlasts a restart.  Allocations which
+// already lie in the new part of the range, from before an earlier shrink,
+// are marked used.
+func (h *Handler) extend(last net.IP) error {
+
+	return h.db.Update(func(tx *bolt.Tx) error {
+
+		// As for the scan, the swap is made in a write transaction,
+		// so no address is being claimed meanwhile.
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		p, err := h.pool.extended(last)
+		if err != nil {
+			return err
+		}
+		old := h.pool.segments[len(h.pool.segments)-1].end
+		end := p.segments[len(p.segments)-1].end
+
+		used := h.used.grow(p.size())
+		c := tx.Bucket(h.buckets.byip).Cursor()
+		for k, _ := c.Seek(old); k != nil &&
+			bytes.Compare(k, end) < 0; k, _ = c.Next() {
+			used.set(p.index(k))
+		}
+
+		err = tx.Bucket(h.buckets.meta).Put([]byte("pool-end"),
+			[]byte(last.To4()))
+		if err != nil {
+			return err
+		}
+
+		h.pool = p
+		h.used = used
+
+		return nil
+
+	})
+
+}
+
+// Removes an allocation found outside the pool, first copying it to the
+// quarantine bucket with -out-of-pool=quarantine.
+func (h *Handler) dropOutside(tx *bolt.Tx, a *allocation) error {
+
+	if h.outOfPool == "quarantine" {
+		v, err := a.record.encode()
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(h.buckets.quarantine).Put([]byte(a.Device), v)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Device %s: %s is outside the pool, quarantined\n",
+			a.Device, a.Address)
+	} else {
+		fmt.Printf("Device %s: %s is outside the pool, deleted\n",
+			a.Device, a.Address)
+	}
+
+	return h.deleteAllocation(tx, a.Device, &a.record, "outside")
+
+}
+
+// Returns the allocations stored outside the pool.
+func (h *Handler) outsidePool() ([]allocation, error) {
+
+	p := h.currentPool()
+	outside := []allocation{}
+
+	err := h.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(h.buckets.addresses)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			rec, err := decodeRecord(v)
+			if err != nil {
+				return fmt.Errorf("device %s: %s", k, err)
+			}
+			if !p.contains(rec.Address) {
+				outside = append(outside, allocation{
+					Device: string(k), record: *rec})
+			}
+		}
+		return nil
+	})
+
+	return outside, err
+
+}
+
+// Checks on startup whether stored allocations lie outside the pool, as
+// they do if it's been shrunk or moved.  With -strict-pool that's an error
+// listing them, so a mistyped range doesn't go unnoticed; otherwise it's a
+// warning, and -out-of-pool says what's done with them.
+func (h *Handler) checkPool() error {
+
+	outside, err := h.outsidePool()
+	if err != nil {
+		return err
+	}
+	if len(outside) == 0 {
+		return nil
+	}
+
+	if !h.strictPool {
+		log.Printf("Warning: pool %s: %d allocations are outside the "+
+			"pool %s", h.name, len(outside), h.currentPool())
+		return nil
+	}
+
+	const shown = 20
+	list := []string{}
+	for i, a := range outside {
+		if i == shown {
+			list = append(list, fmt.Sprintf("and %d more",
+				len(outside)-shown))
+			break
+		}
+		list = append(list, a.Device+" "+a.Address.String())
+	}
+
+	return fmt.Errorf("%d allocations are outside the pool %s: %s",
+		len(outside), h.currentPool(), strings.Join(list, ", "))
+
+}
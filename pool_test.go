@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// On a handler allocating in order, without filling holes, reserves the
+// address after, moves next past it with /reconcile, then allocates n
+// devices.  Returns the address given to each, or "" once they run out.
+func allocateAfter(t *testing.T, h *Handler, after string,
+	n int) []string {
+
+	t.Helper()
+
+	expect(t, h, "POST", "/reserve/marker?address="+after, "admin",
+		http.StatusOK)
+	expect(t, h, "POST", "/reconcile", "admin", http.StatusOK)
+
+	got := []string{}
+	for i := 0; i < n; i++ {
+		w := do(t, h, "GET", fmt.Sprintf("/get/dev%d", i), "dev1", "")
+		switch w.Code {
+		case http.StatusOK:
+			got = append(got, w.Body.String())
+		case http.StatusInternalServerError:
+			got = append(got, "")
+		default:
+			t.Fatalf("/get/dev%d: got %d", i, w.Code)
+		}
+	}
+
+	return got
+
+}
+
+// The default pool stops at the address before its end, or takes in the
+// end itself with -end-inclusive, and the exact last address is handed
+// out before the pool is exhausted.
+func TestPoolEnd(t *testing.T) {
+
+	tests := []struct {
+		inclusive bool
+		want      []string
+		end       int
+	}{
+		{false, []string{"10.92.255.253", "10.92.255.254", "", ""},
+			http.StatusBadRequest},
+		{true, []string{"10.92.255.253", "10.92.255.254",
+			"10.92.255.255", ""}, http.StatusOK},
+	}
+
+	for _, tc := range tests {
+
+		h := newTestHandler(t, func(h *Handler) {
+			h.pool = defaultPool(tc.inclusive)
+			h.fillHoles = false
+		})
+
+		got := allocateAfter(t, h, "10.92.255.252", len(tc.want))
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("inclusive %v: got %q, want %q", tc.inclusive,
+				got, tc.want)
+		}
+		expect(t, h, "GET", "/lookup/"+fin.String(), "dev1", tc.end)
+
+	}
+
+}
+
+// Allocation carries from one octet into the next, and runs up to the
+// last address of a range and no further.
+func TestPoolCarry(t *testing.T) {
+
+	tests := []struct {
+		pool  string
+		after string
+		want  []string
+	}{
+		{"", "10.8.0.253", []string{"10.8.0.254", "10.8.0.255",
+			"10.8.1.0", "10.8.1.1"}},
+		{"", "10.8.255.254", []string{"10.8.255.255", "10.9.0.0"}},
+		{"10.1.0.1-10.1.0.255", "10.1.0.253", []string{"10.1.0.254",
+			"10.1.0.255", ""}},
+		{"10.1.0.0/24,10.1.2.0/31", "10.1.0.254", []string{
+			"10.1.0.255", "10.1.2.0", "10.1.2.1", "", ""}},
+		{"10.255.255.254-10.255.255.255", "10.255.255.254", []string{
+			"10.255.255.255", ""}},
+	}
+
+	for _, tc := range tests {
+
+		h := newTestHandler(t, func(h *Handler) {
+			h.pool = defaultPool(false)
+			if tc.pool != "" {
+				var err error
+				h.pool, err = parsePool(tc.pool)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			h.fillHoles = false
+		})
+
+		got := allocateAfter(t, h, tc.after, len(tc.want))
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s after %s: got %q, want %q", tc.pool,
+				tc.after, got, tc.want)
+		}
+
+	}
+
+}
@@ -0,0 +1,46 @@
+package main
+
+//
+// Profiling.  With -pprof, the net/http/pprof handlers are served under
+// /debug/pprof/, to admins only, and mutex and blocking profiles are
+// switched on, so contention on the allocation lock can be seen in a live
+// allocator.
+//
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// Switches on the mutex and blocking profiles, which cost a little on
+// every contended lock.
+func enableProfiling() {
+	runtime.SetMutexProfileFraction(5)
+	runtime.SetBlockProfileRate(int(1e6))
+}
+
+// Serves a profile, or the index of them.
+func (h *Handler) ServePprof(w http.ResponseWriter, r *http.Request,
+	name string) {
+
+	if !h.pprof {
+		writeError(w, r, http.StatusNotFound,
+			"Profiling is off, start with -pprof.")
+		return
+	}
+
+	switch name {
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Index(w, r)
+	}
+
+}
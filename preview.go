@@ -0,0 +1,69 @@
+package main
+
+//
+// Previewing allocation: the addresses the next new devices would get.
+//
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Most addresses /preview returns.
+const maxPreview = 1000
+
+// Returns the next n addresses claim would hand out, in order, without
+// claiming them.  Addresses allocated, reserved or cooling down are
+// passed over, as claim passes over them.  Caller holds h.mu.
+func (h *Handler) peek(n int) []string {
+
+	// With fill-holes, claim takes holes below next before moving next
+	// on, which amounts to taking the lowest free addresses.
+	i := h.next
+	if h.fillHoles {
+		i = 0
+	}
+
+	addrs := []string{}
+	for len(addrs) < n {
+		var ok bool
+		i, ok = h.used.firstClearIn(i, h.used.size)
+		if !ok {
+			break
+		}
+		addrs = append(addrs, h.pool.address(i).String())
+		i++
+	}
+
+	return addrs
+
+}
+
+// Returns, as a JSON array, the next ?count= addresses which would be
+// allocated, for planning a batch.  Nothing is allocated, so two previews
+// can give the same addresses, and an allocation meanwhile can take one.
+func (h *Handler) ServePreview(w http.ResponseWriter, r *http.Request) {
+
+	n := 1
+	if c := r.URL.Query().Get("count"); c != "" {
+		var err error
+		n, err = strconv.Atoi(c)
+		if err != nil || n < 1 || n > maxPreview {
+			writeError(w, r, http.StatusBadRequest,
+				"Bad ?count=, expected 1 to "+
+					strconv.Itoa(maxPreview)+".")
+			return
+		}
+	}
+
+	h.mu.Lock()
+	addrs := h.peek(n)
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(addrs)
+	return
+
+}
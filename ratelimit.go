@@ -0,0 +1,104 @@
+package main
+
+//
+// Rate limiting.  With -rate-limit, each client certificate CN has a token
+// bucket holding up to -rate-burst requests and refilled at -rate-limit a
+// second, so one misbehaving client can't swamp the allocator, and a
+// request finding its bucket empty gets 429 with a Retry-After.  Buckets
+// which have refilled are forgotten now and then, so clients seen once
+// don't accumulate.
+//
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often full buckets are forgotten.
+const rateSweepInterval = time.Minute
+
+// Token buckets, by client CN.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// A client's tokens, as of when they were last counted.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+		swept:   time.Now(),
+	}
+}
+
+// Takes a token from a client's bucket.  If there's none, returns false
+// and how long until there will be.
+func (rl *rateLimiter) allow(cn string, now time.Time) (bool,
+	time.Duration) {
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.swept) >= rateSweepInterval {
+		for k, b := range rl.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.swept = now
+	}
+
+	b, ok := rl.buckets[cn]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[cn] = b
+	}
+
+	b.tokens = math.Min(rl.burst,
+		b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+
+	return true, 0
+
+}
+
+// Middleware answering 429 to clients over their rate.
+func rateLimit(next http.Handler, rl *rateLimiter) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		ok, wait := rl.allow(clientCN(r), time.Now())
+		if !ok {
+			rateLimited.Inc()
+			secs := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(max(secs, 1)))
+			writeError(w, r, http.StatusTooManyRequests,
+				"Too many requests, slow down.")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+
+	})
+
+}
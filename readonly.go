@@ -0,0 +1,78 @@
+package main
+
+//
+// Read-only operation.  If the database can't be opened for writing, e.g.
+// because it's on a read-only mount while recovering from a disaster, then
+// with -on-read-only=serve it's opened read-only instead: existing devices
+// get their addresses and lookups work, but anything which would write,
+// including allocating a new device, gets 503.  The self-test also puts
+// the allocator in read-only mode if its write fails that way.  With
+// -on-read-only=fail the allocator refuses to start instead.
+//
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"syscall"
+
+	"github.com/boltdb/bolt"
+)
+
+var errReadOnly = errors.New("allocator is read-only")
+
+// Reports whether an error is from writing to a read-only database or
+// filesystem.
+func isReadOnly(err error) bool {
+	return errors.Is(err, errReadOnly) ||
+		errors.Is(err, bolt.ErrDatabaseReadOnly) ||
+		errors.Is(err, syscall.EROFS)
+}
+
+// Answers 500 for a failed database read.
+func writeLookupFailed(w http.ResponseWriter, r *http.Request) {
+
+	databaseErrors.WithLabelValues("read").Inc()
+	writeError(w, r, http.StatusInternalServerError,
+		"Database lookup failed.")
+
+}
+
+// Answers for a failed database write: 503 if the database is read-only,
+// else 500.
+func writeFailed(w http.ResponseWriter, r *http.Request, err error) {
+
+	if isReadOnly(err) {
+		writeError(w, r, http.StatusServiceUnavailable,
+			"Allocator is read-only.")
+		return
+	}
+
+	databaseErrors.WithLabelValues("write").Inc()
+	writeError(w, r, http.StatusInternalServerError,
+		"Database write failed.")
+
+}
+
+// Opens the database, read-only if it can't be opened for writing and
+// onReadOnly is serve.  Reports whether it's read-only.
+func openDatabase(path string, opts *bolt.Options,
+	onReadOnly string) (*bolt.DB, bool, error) {
+
+	db, err := bolt.Open(path, 0600, opts)
+	if err == nil || onReadOnly != "serve" ||
+		!(errors.Is(err, syscall.EROFS) || errors.Is(err, fs.ErrPermission)) {
+		return db, false, err
+	}
+
+	log.Printf("Warning: %s can't be written (%s), serving read-only",
+		path, err)
+
+	ro := *opts
+	ro.ReadOnly = true
+	db, err = bolt.Open(path, 0600, &ro)
+
+	return db, true, err
+
+}
@@ -0,0 +1,169 @@
+package main
+
+//
+// Allocation records, the values in the addresses bucket, stored in the
+// binary format of recordformat.go.  Records used to be JSON, and before
+// that the bare 4-byte address; those are still read, the bare ones as
+// records which never expire, and are upgraded by the startup scan.
+//
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// An allocation.
+type record struct {
+
+	// Allocated address.
+	Address net.IP `json:"address"`
+
+	// With -pool6, the device's IPv6 address.
+	Address6 net.IP `json:"address6,omitempty"`
+
+	// The device's WireGuard public key, as given to /wireguard/.
+	PublicKey string `json:"public_key,omitempty"`
+
+	// When the address was allocated.
+	Allocated time.Time `json:"allocated,omitzero"`
+
+	// When the lease runs out.  Zero means never.
+	Expires time.Time `json:"expires,omitzero"`
+
+	// Why it was allocated, e.g. a ticket reference.
+	Reason string `json:"reason,omitempty"`
+
+	// What the device is, and key=value tags, as given with
+	// ?description= and ?tag=.
+	Description string            `json:"description,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+
+	// Lease ID, new with each allocation.
+	Lease string `json:"lease,omitempty"`
+
+	// With -claim, the client certificate CN which owns the device.
+	Owner string `json:"owner,omitempty"`
+
+	// With -claim, the serial number, in hex, and expiry of the owner's
+	// certificate, as last presented.
+	CertSerial  string    `json:"cert_serial,omitempty"`
+	CertExpires time.Time `json:"cert_expires,omitzero"`
+
+	// When the record was last written.
+	Modified time.Time `json:"modified,omitzero"`
+
+	// When the device last asked for its address with /get/.  Zero if
+	// it hasn't since the address was allocated.
+	LastSeen time.Time `json:"last_seen,omitzero"`
+}
+
+// A device's allocation, when listed alongside others.
+type allocation struct {
+	Device string `json:"device"`
+	record
+}
+
+// A removed allocation, kept so that incremental exports can report it,
+// and so that with -after-release=gone a released device can be told
+// from a new one.
+type tombstone struct {
+	Device  string    `json:"device"`
+	Address net.IP    `json:"address"`
+	Removed time.Time `json:"removed"`
+
+	// Why: release, expire, cert-expired, move, rename, import or
+	// outside; cleared for a release undone by /forget/.
+	Cause string `json:"cause,omitempty"`
+}
+
+// Returns when a record was last written.  Records from before that was
+// tracked count as written when allocated.
+func (rec *record) modified() time.Time {
+
+	if !rec.Modified.IsZero() {
+		return rec.Modified
+	}
+
+	return rec.Allocated
+
+}
+
+// Returns when the device was last seen: the last /get/ for it, or else
+// when it was allocated.
+func (rec *record) lastSeen() time.Time {
+
+	if !rec.LastSeen.IsZero() {
+		return rec.LastSeen
+	}
+
+	return rec.Allocated
+
+}
+
+// Decodes a stored record.
+func decodeRecord(v []byte) (*record, error) {
+
+	// Bare address, from before records had anything else in them.
+	// Copied, as v is only valid for the transaction.
+	if len(v) == net.IPv4len || len(v) == net.IPv6len {
+		ip := net.IP(append([]byte(nil), v...))
+		return &record{Address: canonicalIP(ip)}, nil
+	}
+
+	if len(v) > 0 && v[0] != '{' {
+		rec, err := unmarshalRecord(v)
+		if err != nil {
+			return nil, err
+		}
+		rec.Address = canonicalIP(rec.Address)
+		return rec, nil
+	}
+
+	rec := &record{}
+	err := json.Unmarshal(v, rec)
+	if err != nil {
+		return nil, err
+	}
+	rec.Address = canonicalIP(rec.Address)
+
+	return rec, nil
+
+}
+
+// Reports whether a stored record is in an older format than the one
+// written.
+func outdatedRecord(v []byte) bool {
+
+	if len(v) == net.IPv4len || len(v) == net.IPv6len {
+		return true
+	}
+
+	return len(v) == 0 || v[0] != recordVersion
+
+}
+
+// Encodes a record for storage.
+func (rec *record) encode() ([]byte, error) {
+	return rec.marshalBinary()
+}
+
+// Returns a device's allocation, or nil if it has none.
+func (h *Handler) getAllocation(tx *bolt.Tx, device string) (*record,
+	error) {
+
+	b := tx.Bucket(h.buckets.addresses)
+	if b == nil {
+		return nil, nil
+	}
+
+	v := b.Get([]byte(device))
+	if v == nil {
+		return nil, nil
+	}
+
+	return decodeRecord(v)
+
+}
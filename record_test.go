@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+
+	at := time.Date(2024, 5, 1, 12, 30, 0, 123456789, time.UTC)
+
+	for _, rec := range []*record{
+		{Address: net.IP{10, 8, 0, 2}},
+		{
+			Address:     net.IP{10, 8, 0, 3},
+			Address6:    net.ParseIP("fd00:8::3"),
+			PublicKey:   "key",
+			Allocated:   at,
+			Expires:     at.Add(time.Hour),
+			Modified:    at.Add(time.Minute),
+			LastSeen:    at.Add(2 * time.Minute),
+			Reason:      "ticket 1",
+			Description: "laptop",
+			Tags:        map[string]string{"site": "a", "rack": "4"},
+			Lease:       "lease",
+			Owner:       "dev1",
+			CertSerial:  "1f",
+			CertExpires: at.Add(24 * time.Hour),
+		},
+		{Address: net.ParseIP("fd00::1")},
+	} {
+		v, err := rec.encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outdatedRecord(v) {
+			t.Errorf("%s: encoded record counted as outdated",
+				rec.Address)
+		}
+		got, err := decodeRecord(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, rec) {
+			t.Errorf("round trip: got %+v, want %+v", got, rec)
+		}
+	}
+
+}
+
+func TestRecordLegacy(t *testing.T) {
+
+	for _, c := range []struct {
+		name string
+		v    []byte
+		want *record
+	}{
+		{"bare IPv4", []byte{10, 8, 0, 2},
+			&record{Address: net.IP{10, 8, 0, 2}}},
+		{"bare IPv4-mapped", net.ParseIP("10.8.0.2"),
+			&record{Address: net.IP{10, 8, 0, 2}}},
+		{"bare IPv6", net.ParseIP("fd00::2"),
+			&record{Address: net.ParseIP("fd00::2")}},
+		{"JSON", []byte(`{"address":"10.8.0.4","reason":"r",` +
+			`"owner":"dev1","tags":{"k":"v"}}`),
+			&record{Address: net.IP{10, 8, 0, 4}, Reason: "r",
+				Owner: "dev1", Tags: map[string]string{"k": "v"}}},
+	} {
+		if !outdatedRecord(c.v) {
+			t.Errorf("%s: not counted as outdated", c.name)
+		}
+		got, err := decodeRecord(c.v)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+
+}
+
+// A decoded address mustn't share the value's bytes, which belong to the
+// transaction.
+func TestRecordBareAddressCopied(t *testing.T) {
+
+	encoded, err := (&record{Address: net.IP{10, 8, 0, 2}}).encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range [][]byte{{10, 8, 0, 2}, net.ParseIP("10.8.0.2"),
+		encoded} {
+		rec, err := decodeRecord(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range v {
+			v[i] = 0xff
+		}
+		if !rec.Address.Equal(net.IP{10, 8, 0, 2}) {
+			t.Errorf("address changed with the value to %s",
+				rec.Address)
+		}
+	}
+
+}
+
+// Records in the older formats are rewritten in the binary format when
+// the pool is scanned.
+func TestRecordMigration(t *testing.T) {
+
+	h := newTestHandler(t, nil)
+
+	legacy := map[string][]byte{
+		"bare": {10, 1, 0, 7},
+		"json": []byte(`{"address":"10.1.0.8","reason":"old"}`),
+	}
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		for device, v := range legacy {
+			err := tx.Bucket(h.buckets.addresses).Put(
+				[]byte(device), v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = h.scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = h.db.View(func(tx *bolt.Tx) error {
+		for device, old := range legacy {
+			v := tx.Bucket(h.buckets.addresses).Get([]byte(device))
+			if outdatedRecord(v) {
+				t.Errorf("%s: still %q", device, v)
+			}
+			want, _ := decodeRecord(old)
+			got, _ := decodeRecord(v)
+			if !got.Address.Equal(want.Address) ||
+				got.Reason != want.Reason {
+				t.Errorf("%s: got %+v, want %+v", device, got,
+					want)
+			}
+			ip := tx.Bucket(h.buckets.byip).Get(want.Address)
+			if !bytes.Equal(ip, []byte(device)) {
+				t.Errorf("%s: not indexed", device)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+}
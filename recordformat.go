@@ -0,0 +1,241 @@
+package main
+
+//
+// The binary record format.  Records are stored as
+//
+//   version   1 byte, recordVersion
+//   family    1 byte, 4 or 6
+//   address   4 or 16 bytes
+//   allocated, expires, modified, last seen
+//             12 bytes each: seconds since the Unix epoch, big-endian
+//             int64, then nanoseconds, big-endian uint32; all zero for
+//             no time
+//   flags     1 byte, none defined yet
+//
+// then the variable fields: reason, description, lease, owner and
+// certificate serial, each a uvarint length and the bytes, a uvarint count
+// of tags and each tag's key and value likewise, and the certificate expiry
+// as above, then the IPv6 address, a uvarint length and 16 bytes or none,
+// and the WireGuard public key as a string.  Fields added later go on the
+// end, and may be missing from records written before them, so older code
+// reading a newer record ignores what it doesn't know; the version only
+// changes if the layout does otherwise.  Earlier records were JSON, and
+// before that the bare address, and both are still read.
+//
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"time"
+)
+
+// Version of the binary record layout written.
+const recordVersion = 1
+
+var errShortRecord = errors.New("record is truncated")
+
+// Appends a time to a binary record.
+func appendTime(b []byte, t time.Time) []byte {
+
+	if t.IsZero() {
+		return append(b, make([]byte, 12)...)
+	}
+
+	b = binary.BigEndian.AppendUint64(b, uint64(t.Unix()))
+	return binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+
+}
+
+// Appends a length-prefixed string to a binary record.
+func appendString(b []byte, s string) []byte {
+	return append(binary.AppendUvarint(b, uint64(len(s))), s...)
+}
+
+// Encodes a record in the binary format.
+func (rec *record) marshalBinary() ([]byte, error) {
+
+	b := make([]byte, 0, 64)
+	b = append(b, recordVersion)
+	if a := rec.Address.To4(); a != nil {
+		b = append(append(b, 4), a...)
+	} else if len(rec.Address) == net.IPv6len {
+		b = append(append(b, 6), rec.Address...)
+	} else {
+		return nil, fmt.Errorf("bad address %v", rec.Address)
+	}
+
+	b = appendTime(b, rec.Allocated)
+	b = appendTime(b, rec.Expires)
+	b = appendTime(b, rec.Modified)
+	b = appendTime(b, rec.LastSeen)
+	b = append(b, 0)
+
+	b = appendString(b, rec.Reason)
+	b = appendString(b, rec.Description)
+	b = appendString(b, rec.Lease)
+	b = appendString(b, rec.Owner)
+	b = appendString(b, rec.CertSerial)
+
+	keys := []string{}
+	for k := range rec.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b = binary.AppendUvarint(b, uint64(len(keys)))
+	for _, k := range keys {
+		b = appendString(appendString(b, k), rec.Tags[k])
+	}
+
+	b = appendTime(b, rec.CertExpires)
+	b = appendString(b, string(rec.Address6))
+	b = appendString(b, rec.PublicKey)
+
+	return b, nil
+
+}
+
+// Reads a binary record's fields in turn.  The first error sticks, and
+// later reads return zero values.
+type recordReader struct {
+	b   []byte
+	err error
+}
+
+// Returns the next n bytes, or nil if there aren't that many.
+func (r *recordReader) next(n int) []byte {
+
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = errShortRecord
+		return nil
+	}
+
+	v := r.b[:n]
+	r.b = r.b[n:]
+
+	return v
+
+}
+
+// Returns the next time.
+func (r *recordReader) time() time.Time {
+
+	v := r.next(12)
+	if v == nil {
+		return time.Time{}
+	}
+
+	secs := binary.BigEndian.Uint64(v)
+	nsecs := binary.BigEndian.Uint32(v[8:])
+	if secs == 0 && nsecs == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(int64(secs), int64(nsecs)).UTC()
+
+}
+
+// Reports whether there are fields left to read.
+func (r *recordReader) more() bool {
+	return r.err == nil && len(r.b) > 0
+}
+
+// Returns the next uvarint.
+func (r *recordReader) uvarint() uint64 {
+
+	if r.err != nil {
+		return 0
+	}
+	n, size := binary.Uvarint(r.b)
+	if size <= 0 {
+		r.err = errShortRecord
+		return 0
+	}
+	r.b = r.b[size:]
+
+	return n
+
+}
+
+// Returns the next length-prefixed string.
+func (r *recordReader) string() string {
+
+	n := r.uvarint()
+	if n > math.MaxInt32 {
+		r.err = errShortRecord
+		return ""
+	}
+
+	return string(r.next(int(n)))
+
+}
+
+// Decodes a record in the binary format.
+func unmarshalRecord(v []byte) (*record, error) {
+
+	if len(v) == 0 {
+		return nil, errShortRecord
+	}
+	if v[0] != recordVersion {
+		return nil, fmt.Errorf("unknown record version %d", v[0])
+	}
+	r := &recordReader{b: v[1:]}
+
+	rec := &record{}
+	switch family := r.next(1); {
+	case family == nil:
+	case family[0] == 4:
+		rec.Address = net.IP(r.next(net.IPv4len))
+	case family[0] == 6:
+		rec.Address = net.IP(r.next(net.IPv6len))
+	default:
+		return nil, fmt.Errorf("unknown address family %d", family[0])
+	}
+	rec.Address = append(net.IP(nil), rec.Address...)
+
+	rec.Allocated = r.time()
+	rec.Expires = r.time()
+	rec.Modified = r.time()
+	rec.LastSeen = r.time()
+	r.next(1)
+
+	rec.Reason = r.string()
+	rec.Description = r.string()
+	rec.Lease = r.string()
+	rec.Owner = r.string()
+	rec.CertSerial = r.string()
+
+	n := r.uvarint()
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		if rec.Tags == nil {
+			rec.Tags = map[string]string{}
+		}
+		k := r.string()
+		rec.Tags[k] = r.string()
+	}
+
+	rec.CertExpires = r.time()
+
+	// Fields which may be missing, from records written before them.
+	if r.more() {
+		if a := r.string(); a != "" {
+			rec.Address6 = net.IP(a)
+		}
+	}
+	if r.more() {
+		rec.PublicKey = r.string()
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return rec, nil
+
+}
@@ -0,0 +1,194 @@
+package main
+
+//
+// Releasing addresses.  A device gives its address back with /release/,
+// which leaves a tombstone recording the release.  With
+// -after-release=gone, a released device asking for an address again gets
+// 410 Gone rather than a new one, so a decommissioned device can't quietly
+// come back, until an admin clears the release with /forget/ or, with
+// -gone-ttl, it's old enough to be forgotten.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+)
+
+var errGone = errors.New("device released")
+
+// Cause recorded in a tombstone whose release has been cleared.
+const causeCleared = "cleared"
+
+// Returns a device's tombstone, or nil if it has none.
+func (h *Handler) getTombstone(tx *bolt.Tx, device string) (*tombstone,
+	error) {
+
+	v := tx.Bucket(h.buckets.removed).Get([]byte(device))
+	if v == nil {
+		return nil, nil
+	}
+
+	t := &tombstone{}
+	err := json.Unmarshal(v, t)
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+
+}
+
+// Returns the tombstone of a device which, with -after-release=gone, mustn't
+// get a new address because it was released, or nil if it may.
+func (h *Handler) released(tx *bolt.Tx, device string) (*tombstone, error) {
+
+	if h.afterRelease != "gone" {
+		return nil, nil
+	}
+
+	t, err := h.getTombstone(tx, device)
+	if err != nil || t == nil || t.Cause != eventRelease {
+		return nil, err
+	}
+	if h.goneTTL > 0 && h.now().Sub(t.Removed) >= h.goneTTL {
+		return nil, nil
+	}
+
+	return t, nil
+
+}
+
+// Answers 410 for a released device.
+func writeGone(w http.ResponseWriter, r *http.Request, t *tombstone) {
+	writeError(w, r, http.StatusGone,
+		fmt.Sprintf("Device was released at %s; an admin can allow it "+
+			"a new address with /forget/.",
+			t.Removed.UTC().Format("2006-01-02 15:04:05")))
+}
+
+// Releases a device's address, answering with the address freed, or 404
+// if the device has none.  With -claim, only the device's owner may.  A
+// lease ID given in X-Lease-ID has to be the device's current one.
+func (h *Handler) ServeRelease(w http.ResponseWriter, r *http.Request,
+	device string) {
+
+	if device == "" {
+		writeError(w, r, http.StatusBadRequest,
+			"No device name given, use /release/<device>.")
+		return
+	}
+
+	now := h.now()
+	var rec *record
+	err := h.db.Update(func(tx *bolt.Tx) error {
+
+		var err error
+		rec, err = h.getAllocation(tx, device)
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			return errNoDevice
+		}
+
+		err = h.checkOwner(tx, r, device, rec)
+		if err != nil {
+			return err
+		}
+
+		err = h.checkLease(r, rec)
+		if err != nil {
+			return err
+		}
+
+		err = h.deleteAllocation(tx, device, rec, eventRelease)
+		if err != nil {
+			return err
+		}
+
+		return h.cool(tx, rec.Address, now)
+
+	})
+
+	switch {
+	case err == errNoDevice:
+		writeError(w, r, http.StatusNotFound, "Device not found.")
+		return
+	case err == errNotOwner:
+		writeError(w, r, http.StatusForbidden,
+			"Device belongs to another identity.")
+		return
+	case !writeLeaseError(w, r, err):
+		return
+	case err != nil:
+		writeFailed(w, r, err)
+		return
+	}
+
+	h.retire(rec.Address, now)
+	fmt.Printf("Device %s: released %s\n", device, rec.Address)
+	h.emit((&event{Type: eventRelease, Device: device, Address: rec.Address,
+		Reason: allocationReason(r), Time: now}).by(r))
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, rec.Address.String())
+	return
+
+}
+
+// Clears a device's release, so it can be allocated again.  The tombstone
+// stays, for incremental exports, marked as cleared.  Answers 404 if the
+// device hasn't been released.
+func (h *Handler) ServeForget(w http.ResponseWriter, r *http.Request,
+	device string) {
+
+	if device == "" {
+		writeError(w, r, http.StatusBadRequest,
+			"No device name given, use /forget/<device>.")
+		return
+	}
+
+	err := h.db.Update(func(tx *bolt.Tx) error {
+
+		t, err := h.getTombstone(tx, device)
+		if err != nil {
+			return err
+		}
+		if t == nil || t.Cause != eventRelease {
+			return errNoDevice
+		}
+
+		t.Cause = causeCleared
+		v, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(h.buckets.removed).Put([]byte(device), v)
+
+	})
+
+	switch {
+	case err == errNoDevice:
+		writeError(w, r, http.StatusNotFound,
+			"Device hasn't been released.")
+		return
+	case err != nil:
+		writeFailed(w, r, err)
+		return
+	}
+
+	fmt.Printf("Device %s: release cleared\n", device)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, "Release cleared.")
+	return
+
+}
@@ -0,0 +1,50 @@
+package main
+
+//
+// Rescanning on SIGHUP.  If the database has been edited behind the
+// allocator's back, a SIGHUP rebuilds each pool's state from it, as
+// /reconcile does, without a restart or dropping requests.  The
+// listeners' TLS credentials are reloaded too; see certreload.go.
+//
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Reloads credentials and rescans the pools' databases on each SIGHUP,
+// forever.
+func (ps *poolSet) reloadOnHUP() {
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	for range sigs {
+		for _, c := range ps.creds {
+			err := c.load()
+			if err != nil {
+				log.Printf("SIGHUP: keeping the old credentials "+
+					"for %s: %s", c.cert, err)
+				continue
+			}
+			log.Printf("SIGHUP: reloaded %s", c.cert)
+		}
+		for _, h := range ps.handlers {
+			if !h.isActive() {
+				continue
+			}
+			err := h.scan()
+			if err != nil {
+				log.Printf("SIGHUP: pool %s: rescan failed: %s",
+					h.name, err)
+				continue
+			}
+			h.checkThreshold()
+			log.Printf("SIGHUP: pool %s rescanned, next free "+
+				"address is %s", h.name, h.currentNext())
+		}
+	}
+
+}
@@ -0,0 +1,285 @@
+package main
+
+//
+// Deliberate assignment of addresses by an administrator.  With
+// -explicit-allocation this is the only way a device gets an address.
+// Addresses can also be pinned at startup from a -reservations file, a
+// JSON object of device name to address:
+//
+//   {"gateway": "10.8.0.2", "dns": "10.8.0.3"}
+//
+// Reservations don't expire.  One whose device has another address, or
+// whose address another device holds, is left alone with a warning.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+// Assigns an address to a device which doesn't have one: the one given as
+// ?address= (or ?ip=), or else the next free one as /get/ would pick it.
+// Answers 409 if the device already has another address or the chosen one
+// is taken; reserving the address a device already has answers it again.
+func (h *Handler) ServeReserve(w http.ResponseWriter, r *http.Request,
+	device string) {
+
+	if device == "" {
+		writeError(w, r, http.StatusBadRequest,
+			"No device name given, use /reserve/<device>.")
+		return
+	}
+	if !h.deviceOK(w, r, device) {
+		return
+	}
+
+	a := r.URL.Query().Get("address")
+	if a == "" {
+		a = r.URL.Query().Get("ip")
+	}
+
+	var ip net.IP
+	if a != "" {
+		ip = parseIPv4(a)
+		if ip == nil {
+			writeError(w, r, http.StatusBadRequest,
+				"Bad ?address=, expected an IPv4 address.")
+			return
+		}
+		if !h.currentPool().contains(ip) {
+			writeError(w, r, http.StatusBadRequest,
+				"Address is outside the pool.")
+			return
+		}
+	}
+
+	var existing *record
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		existing, err = h.getAllocation(tx, device)
+		return err
+	})
+	if err != nil {
+		writeLookupFailed(w, r)
+		return
+	}
+	if existing != nil && !existing.Address.Equal(ip) {
+		writeError(w, r, http.StatusConflict,
+			fmt.Sprintf("Device already has %s.", existing.Address))
+		return
+	}
+
+	var rec *record
+	var ok bool
+	if ip == nil {
+		rec, ok = h.allocate(w, r, device, "")
+		if !ok {
+			return
+		}
+	} else {
+		rec, ok = h.reserveAddress(w, r, device, ip)
+		if !ok {
+			return
+		}
+	}
+
+	h.setLease(w, r, device, rec)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, rec.Address.String())
+	return
+
+}
+
+// Assigns a particular address to a device, or returns its allocation if it
+// already has that address.
+func (h *Handler) reserveAddress(w http.ResponseWriter, r *http.Request,
+	device string, ip net.IP) (*record, bool) {
+
+	ttl, ok := h.requestTTL(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	desc, tags, ok := requestMetadata(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	now := h.now()
+	rec := &record{
+		Address:     ip,
+		Allocated:   now,
+		Expires:     h.leaseExpiry(now, ttl),
+		Reason:      allocationReason(r),
+		Lease:       newLeaseID(),
+		Description: desc,
+		Tags:        tags,
+	}
+
+	found, holder, err := h.pin(device, rec)
+	if err != nil {
+		switch {
+		case err == errTooMany:
+			h.writeTooMany(w, r)
+		case err == errExists:
+			writeError(w, r, http.StatusConflict,
+				"Device already has an address.")
+		case err == errTaken && holder != "":
+			writeError(w, r, http.StatusConflict,
+				"Address is allocated to "+holder+".")
+		case err == errTaken:
+			writeError(w, r, http.StatusConflict,
+				h.whyUnavailable(ip))
+		default:
+			writeFailed(w, r, err)
+		}
+		return nil, false
+	}
+
+	if found != nil {
+		fmt.Printf("Device %s: already reserved %s\n", device, ip)
+		return found, true
+	}
+
+	fmt.Printf("Device %s: reserved %s\n", device, ip)
+	h.emit((&event{Type: eventAllocate, Device: device, Address: ip,
+		Reason: rec.Reason, Time: now}).by(r))
+
+	return rec, true
+
+}
+
+// Stores a new allocation of a particular address, unless the device
+// already has that address, when its allocation is returned.  Also
+// returns the device holding the address if that's why it can't be had.
+func (h *Handler) pin(device string, rec *record) (*record, string, error) {
+
+	ip := rec.Address
+	var holder string
+	var took bool
+	var found *record
+	err := h.db.Update(func(tx *bolt.Tx) error {
+
+		existing, err := h.getAllocation(tx, device)
+		if err != nil {
+			return err
+		}
+		if existing != nil && existing.Address.Equal(ip) {
+			found = existing
+			return nil
+		}
+		if existing != nil {
+			return errExists
+		}
+
+		err = h.checkLimit()
+		if err != nil {
+			return err
+		}
+
+		// The address has to be free in the bitmap too: it may be
+		// cooling down.
+		holder = h.lookupIP(tx, ip)
+		if holder != "" {
+			return errTaken
+		}
+		took = h.take(ip)
+		if !took {
+			return errTaken
+		}
+
+		err = h.assign6(tx, rec)
+		if err != nil {
+			return err
+		}
+		err = h.putAllocation(tx, device, rec)
+		if err != nil {
+			return err
+		}
+
+		return h.notePeak(tx)
+
+	})
+
+	if err != nil && took {
+		h.free(ip)
+	}
+
+	return found, holder, err
+
+}
+
+// Pins the addresses in the -reservations file whose devices select this
+// pool.
+func (h *Handler) loadReservations() error {
+
+	b, err := os.ReadFile(h.reservations)
+	if err != nil {
+		return err
+	}
+
+	var reservations map[string]string
+	err = json.Unmarshal(b, &reservations)
+	if err != nil {
+		return fmt.Errorf("%s: %s", h.reservations, err)
+	}
+
+	devices := []string{}
+	for name := range reservations {
+		device := canonicalDevice(name)
+		if h.set == nil || h.set.forDevice(device) == h {
+			devices = append(devices, name)
+		}
+	}
+	sort.Strings(devices)
+
+	p := h.currentPool()
+	for _, name := range devices {
+
+		device := canonicalDevice(name)
+		ip := parseIPv4(reservations[name])
+		if ip == nil || !p.contains(ip) {
+			return fmt.Errorf("%s: %s: %s isn't an address in the "+
+				"pool", h.reservations, name, reservations[name])
+		}
+
+		now := h.now()
+		rec := &record{
+			Address:   ip,
+			Allocated: now,
+			Reason:    "reservation",
+			Lease:     newLeaseID(),
+		}
+		found, holder, err := h.pin(device, rec)
+		switch {
+		case err == errExists:
+			log.Printf("Warning: device %s is reserved %s but "+
+				"already has another address", device, ip)
+		case err == errTaken && holder != "":
+			log.Printf("Warning: device %s is reserved %s but "+
+				"it's allocated to %s", device, ip, holder)
+		case err == errTaken:
+			log.Printf("Warning: device %s is reserved %s: %s",
+				device, ip, h.whyUnavailable(ip))
+		case err != nil:
+			return err
+		case found == nil:
+			fmt.Printf("Device %s: reserved %s\n", device, ip)
+			h.emit(&event{Type: eventAllocate, Device: device,
+				Address: ip, Reason: rec.Reason, Time: now})
+		}
+
+	}
+
+	return nil
+
+}
@@ -0,0 +1,443 @@
+package main
+
+//
+// Request routing.  The routes table drives dispatch, method checking and
+// the endpoint list served at "/", so adding an endpoint is one entry here.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// An API endpoint.
+type route struct {
+
+	// Path.  A trailing slash makes it a prefix, with the remainder of
+	// the request path passed to the handler.
+	path string
+
+	// Methods accepted.  HEAD is accepted wherever GET is.
+	methods []string
+
+	// Restricted to admin clients.
+	admin bool
+
+	// One-line description, for the endpoint list.
+	desc string
+
+	// Handler.
+	serve func(h *Handler, w http.ResponseWriter, r *http.Request,
+		arg string)
+}
+
+// All endpoints.  Filled in by init, as the index handler refers to it.
+var routes []route
+
+func init() {
+	routes = []route{
+		{"/", get, false, "This page: endpoints, pool range and utilisation",
+			noArg((*Handler).ServeIndex)},
+		{"/get/", get, false, "Return the address of a device, " +
+			"allocating one if it's new; ?reason= is recorded, " +
+			"?range=<cidr> constrains a new address, ?prefer= asks " +
+			"for a particular one if it's free, ?ttl= sets its " +
+			"lease, renewing an existing one, ?family=6 answers " +
+			"with the -pool6 address; raw bytes with " +
+			"Accept: application/octet-stream, age and last seen " +
+			"with Accept: application/json",
+			(*Handler).ServeGet},
+		{"/allocate-batch", post, false, "Allocate addresses for a " +
+			"JSON array of devices, all or nothing",
+			noArg((*Handler).ServeAllocateBatch)},
+		{"/openvpn-ccd/", get, false, "Return an OpenVPN client " +
+			"config fragment for a device, allocating if it's new",
+			(*Handler).ServeOpenVPN},
+		{"/ifconfig/", get, false, "Return a device's interface " +
+			"config as JSON, address, prefix, gateway, -dns and " +
+			"-mtu, allocating if it's new",
+			(*Handler).ServeIfconfig},
+		{"/wireguard/", get, false, "Return a device's WireGuard " +
+			"config, storing its ?public_key=, allocating if " +
+			"it's new", (*Handler).ServeWireGuard},
+		{"/release/", postDelete, false, "Release a device's " +
+			"address, for the lease ID in X-Lease-ID if given",
+			(*Handler).ServeRelease},
+		{"/renew/", post, false, "Extend a device's lease, by -ttl " +
+			"or ?ttl=, for the lease ID in X-Lease-ID if given",
+			(*Handler).ServeRenew},
+		{"/forget/", post, true, "Let a released device be allocated " +
+			"again, with -after-release=gone", (*Handler).ServeForget},
+		{"/describe/", post, false, "Set a device's ?description= " +
+			"and ?tag=key=value tags, also accepted on allocation",
+			(*Handler).ServeDescribe},
+		{"/reserve/", postPut, true, "Assign an address to a new " +
+			"device, ?address= or ?ip= to choose it",
+			(*Handler).ServeReserve},
+		{"/reserve-block", postDelete, true, "Hold the block given as " +
+			"?cidr= out of the pool with POST, ?reason= saying " +
+			"why, and release it with DELETE",
+			noArg((*Handler).ServeReserveBlock)},
+		{"/move/", post, true, "Move a device to the address given " +
+			"as ?to=<address>", (*Handler).ServeMove},
+		{"/swap", post, true, "Swap the addresses of devices " +
+			"?a=<device> and ?b=<device>", noArg((*Handler).ServeSwap)},
+		{"/rename", post, true, "Rename device ?from=<device> to " +
+			"?to=<device>, keeping its address",
+			noArg((*Handler).ServeRename)},
+		{"/all", get, false, "Return allocations as a JSON object; filter with " +
+			"?prefix= or ?glob=, ?sort=device or address, page with " +
+			"?offset= and ?limit=, ?detail=true for whole records, " +
+			"with lease IDs and owners for admins, " +
+			"?format=csv or text for a table, ?after= to continue " +
+			"a truncated listing",
+			noArg((*Handler).ServeAll)},
+		{"/mine", get, false, "Return the allocations owned by the " +
+			"client, with -claim; ?owner= for an admin to see " +
+			"another's", noArg((*Handler).ServeMine)},
+		{"/history/", get, false, "Return a device's past addresses " +
+			"and its current one, with -history; another's than " +
+			"the client's needs admin",
+			(*Handler).ServeHistory},
+		{"/audit", get, true, "Return events, with -audit, from " +
+			"?from= up to ?to=, for ?device= if given, ?limit= at a " +
+			"time, ?cursor= for the next page",
+			noArg((*Handler).ServeAudit)},
+		{"/verify/", get, false, "Check a device holds the address " +
+			"given as ?expect=<address>: 200, 409 or 404",
+			(*Handler).ServeVerify},
+		{"/lookup/", get, false, "Return the device holding an address",
+			(*Handler).ServeLookup},
+		{"/lookup-bulk", post, false, "Map a JSON array of addresses to the " +
+			"devices holding them", noArg((*Handler).ServeLookupBulk)},
+		{"/export", get, true, "Export allocations as JSON; " +
+			"?since=<RFC 3339 time> for changes and removals since, " +
+			"?format=jsonl for JSON Lines, hosts for /etc/hosts " +
+			"or zone for DNS A records",
+			noArg((*Handler).ServeExport)},
+		{"/import", post, true, "Import an /export document; " +
+			"?on_conflict=fail, skip or overwrite",
+			noArg((*Handler).ServeImport)},
+		{"/preview", get, false, "Return the next ?count= addresses " +
+			"which would be allocated, without allocating them",
+			noArg((*Handler).ServePreview)},
+		{"/capacity", get, false, "Return pool size and utilisation",
+			noArg((*Handler).ServeCapacity)},
+		{"/reconcile", post, true, "Rebuild allocation state from " +
+			"the database", noArg((*Handler).ServeReconcile)},
+		{"/extend", post, true, "Move the end of the pool up to " +
+			"?end=<address>, kept in the database across restarts",
+			noArg((*Handler).ServeExtend)},
+		{"/whoami", get, false, "Return the client certificate's " +
+			"identity as the server sees it",
+			noArg((*Handler).ServeWhoami)},
+		{"/backup", get, true, "Stream a snapshot of the database",
+			noArg((*Handler).ServeBackup)},
+		{"/stats", get, true, "Return database and bucket statistics",
+			noArg((*Handler).ServeStats)},
+		{"/healthz", get, false, "Answer 200 while the server is up",
+			noArg((*Handler).ServeHealth)},
+		{"/readyz", get, false, "Answer 200 if allocations can be " +
+			"served and written, else 503",
+			noArg((*Handler).ServeReady)},
+		{"/metrics", get, false, "Prometheus metrics",
+			noArg((*Handler).ServeMetrics)},
+		{"/debug/pprof/", get, true, "Profiles, with -pprof",
+			(*Handler).ServePprof},
+		{"/openapi.json", get, false, "OpenAPI 3 description of " +
+			"these endpoints", noArg((*Handler).ServeOpenAPI)},
+	}
+}
+
+var (
+	get        = []string{http.MethodGet}
+	post       = []string{http.MethodPost}
+	postDelete = []string{http.MethodPost, http.MethodDelete}
+	postPut    = []string{http.MethodPost, http.MethodPut}
+)
+
+// Adapts a handler which takes no path argument.
+func noArg(f func(*Handler, http.ResponseWriter, *http.Request)) func(
+	*Handler, http.ResponseWriter, *http.Request, string) {
+	return func(h *Handler, w http.ResponseWriter, r *http.Request,
+		_ string) {
+		f(h, w, r)
+	}
+}
+
+// Matches a request path against the route, returning the path argument.
+// A prefix route also matches its path without the trailing slash, so the
+// handler can complain about the missing argument.
+func (rt *route) match(path string) (string, bool) {
+
+	if rt.path == "/" || !strings.HasSuffix(rt.path, "/") {
+		return "", path == rt.path
+	}
+
+	if path == strings.TrimSuffix(rt.path, "/") {
+		return "", true
+	}
+
+	if strings.HasPrefix(path, rt.path) {
+		return strings.TrimPrefix(path, rt.path), true
+	}
+
+	return "", false
+
+}
+
+// Reports whether the route's path argument is a device name.
+func (rt *route) takesDevice() bool {
+	return strings.HasSuffix(rt.path, "/") && rt.path != "/" &&
+		rt.path != "/lookup/" && rt.path != "/debug/pprof/"
+}
+
+// Reports whether the route accepts a method.
+func (rt *route) allows(method string) bool {
+
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+
+	for _, m := range rt.methods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// Finds the route for a request path.
+func findRoute(path string) (*route, string) {
+
+	for i := range routes {
+		if arg, ok := routes[i].match(path); ok {
+			return &routes[i], arg
+		}
+	}
+
+	return nil, ""
+
+}
+
+// HTTP request handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	// Bound the request body.  Handlers which accept a body read it with
+	// readBody, which answers 413 once the limit is exceeded.
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxBody)
+
+	rt, arg := findRoute(r.URL.Path)
+
+	// A cold standby has no database, so can't answer even reads; only
+	// metrics and health checks work.
+	if !h.isActive() && (rt == nil || (rt.path != "/metrics" &&
+		rt.path != "/healthz" && rt.path != "/readyz")) {
+		w.Header().Set("Retry-After", "5")
+		writeError(w, r, http.StatusServiceUnavailable,
+			"Cold standby, another instance is active; "+
+				"nothing is served until it takes over.")
+		return
+	}
+
+	if rt == nil {
+		writeError(w, r, http.StatusNotFound,
+			"Not found, see / for the available endpoints.")
+		return
+	}
+
+	if !rt.allows(r.Method) {
+		w.Header().Set("Allow", strings.Join(rt.methods, ", "))
+		writeError(w, r, http.StatusMethodNotAllowed,
+			fmt.Sprintf("Method %s not allowed on %s, use %s.",
+				r.Method, rt.path, strings.Join(rt.methods, " or ")))
+		return
+	}
+
+	if rt.admin && !h.isAdmin(r) {
+		writeError(w, r, http.StatusForbidden,
+			"Admin access required.")
+		return
+	}
+
+	device, ok := h.certDevice(w, r, rt, canonicalDevice(arg))
+	if !ok {
+		return
+	}
+	if h.tenantFrom != "" {
+		if h.tenantOf(r) == "" {
+			writeError(w, r, http.StatusForbidden,
+				"No tenant identity.")
+			return
+		}
+		if rt.takesDevice() {
+			device = h.scoped(r, device)
+		}
+	}
+
+	// Read-only, only existing devices' addresses can be given out.
+	if h.isReadOnly() && rt.changesState() && rt.path != "/get/" &&
+		rt.path != "/openvpn-ccd/" && rt.path != "/ifconfig/" &&
+		rt.path != "/wireguard/" {
+		writeFailed(w, r, errReadOnly)
+		return
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	if key != "" && h.idempotencyTTL > 0 && rt.changesState() &&
+		!h.isReadOnly() {
+		h.serveIdempotent(w, r, rt, device, key)
+		return
+	}
+
+	rt.serve(h, w, r, device)
+
+}
+
+// Returns the common name on the client certificate.
+func clientCN(r *http.Request) string {
+
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+
+}
+
+// Reports whether the client may use admin endpoints: its certificate's CN
+// is one of -admin, or one of its OUs one of -admin-ou.
+func (h *Handler) isAdmin(r *http.Request) bool {
+
+	if len(h.admins) == 0 && len(h.adminOUs) == 0 {
+		return true
+	}
+	if h.admins[clientCN(r)] {
+		return true
+	}
+
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	for _, ou := range r.TLS.PeerCertificates[0].Subject.OrganizationalUnit {
+		if h.adminOUs[ou] {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// Reports whether the client prefers a JSON response.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// Writes an error response, as JSON if the client asked for it and plain
+// text otherwise.
+func writeError(w http.ResponseWriter, r *http.Request, code int,
+	msg string) {
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": code,
+			"error":  msg,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	io.WriteString(w, msg)
+
+}
+
+// An endpoint, as listed by the index.
+type endpoint struct {
+	Path        string   `json:"path"`
+	Methods     []string `json:"methods"`
+	Description string   `json:"description"`
+}
+
+// Index page, for browsers.
+var indexPage = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Address allocator</title></head>
+<body>
+<h1>Address allocator</h1>
+<p>Pool {{.Pool.start}} - {{.Pool.end}}: {{.Capacity.allocated}} of
+{{.Capacity.size}} addresses allocated, {{.Capacity.free}} free.</p>
+<table>
+<tr><th>Methods</th><th>Path</th><th>Description</th></tr>
+{{range .Endpoints}}<tr><td>{{range .Methods}}{{.}} {{end}}</td>
+<td><code>{{.Path}}</code></td><td>{{.Description}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// Describes the allocator: endpoints, pool range and utilisation.  Served
+// as HTML to browsers, JSON on request, or plain text.
+func (h *Handler) ServeIndex(w http.ResponseWriter, r *http.Request) {
+
+	p := h.currentPool()
+	index := struct {
+		Endpoints []endpoint        `json:"endpoints"`
+		Pool      map[string]string `json:"pool"`
+		Capacity  map[string]uint32 `json:"capacity"`
+	}{
+		Endpoints: []endpoint{},
+		Pool: map[string]string{
+			"start":    p.first().String(),
+			"end":      p.last().String(),
+			"segments": p.String(),
+		},
+		Capacity: h.capacity(),
+	}
+	for _, rt := range routes {
+		index.Endpoints = append(index.Endpoints,
+			endpoint{rt.path, rt.methods, rt.desc})
+	}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(index)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		indexPage.Execute(w, index)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Pool %s - %s: %d of %d addresses allocated, "+
+		"%d free.\n\n", index.Pool["start"], index.Pool["end"],
+		index.Capacity["allocated"], index.Capacity["size"],
+		index.Capacity["free"])
+	for _, e := range index.Endpoints {
+		fmt.Fprintf(w, "%-6s %-12s %s\n", strings.Join(e.Methods, ","),
+			e.Path, e.Description)
+	}
+
+}
+
+// Serves Prometheus metrics.
+func (h *Handler) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	promhttp.Handler().ServeHTTP(w, r)
+}
@@ -0,0 +1,117 @@
+package main
+
+//
+// Bounded scans.  Endpoints listing allocations walk the addresses bucket,
+// and on a large database one request could hold a read transaction open
+// for a long time.  With -max-scan, such a walk stops after that many
+// keys, and the answer says so with X-Truncated and gives X-Next-After:
+// passing that back as ?after= continues from where it stopped.
+//
+
+import (
+	"bytes"
+	"net/http"
+	"path"
+
+	"github.com/boltdb/bolt"
+)
+
+// A walk over the addresses bucket.
+type deviceScan struct {
+
+	// Only device names with this prefix, and matching this shell
+	// pattern if it's set.
+	prefix []byte
+	glob   string
+
+	// Start after this device name.
+	after []byte
+
+	// Most keys visited; zero for no limit.
+	limit int
+
+	// With -tenant, the tenant's key prefix.  Names given and returned
+	// are without it.
+	scope []byte
+}
+
+// Returns the walk a request asks for with ?prefix=, ?glob= and ?after=.
+// Answers 400 and returns nil if they're bad.
+func (h *Handler) scanFor(w http.ResponseWriter, r *http.Request) *deviceScan {
+
+	s := &deviceScan{
+		prefix: []byte(r.URL.Query().Get("prefix")),
+		glob:   r.URL.Query().Get("glob"),
+		after:  []byte(r.URL.Query().Get("after")),
+		limit:  h.maxScan,
+	}
+	if h.tenantFrom != "" {
+		s.scope = []byte(h.tenantOf(r) + ":")
+	}
+	if _, err := path.Match(s.glob, ""); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Bad ?glob= pattern.")
+		return nil
+	}
+
+	return s
+
+}
+
+// Calls f for each allocation the walk covers, in device name order.
+// Returns the device name to continue after if the limit cut it short,
+// else nil.  A missing bucket has nothing to walk.
+func (s *deviceScan) each(tx *bolt.Tx, bucket []byte,
+	f func(k, v []byte) error) ([]byte, error) {
+
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return nil, nil
+	}
+	c := b.Cursor()
+
+	prefix := append(append([]byte(nil), s.scope...), s.prefix...)
+	after := append(append([]byte(nil), s.scope...), s.after...)
+
+	k, v := c.Seek(prefix)
+	if len(s.after) > 0 && bytes.Compare(after, prefix) >= 0 {
+		k, v = c.Seek(after)
+		if bytes.Equal(k, after) {
+			k, v = c.Next()
+		}
+	}
+
+	visited := 0
+	var last []byte
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if s.limit > 0 && visited == s.limit {
+			return last, nil
+		}
+		visited++
+		k = k[len(s.scope):]
+		last = append(last[:0], k...)
+		if s.glob != "" {
+			if ok, _ := path.Match(s.glob, string(k)); !ok {
+				continue
+			}
+		}
+		err := f(k, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+
+}
+
+// Sets the headers saying a walk was cut short, if it was.
+func truncated(w http.ResponseWriter, next []byte) {
+
+	if next == nil {
+		return
+	}
+
+	w.Header().Set("X-Truncated", "true")
+	w.Header().Set("X-Next-After", string(next))
+
+}
@@ -0,0 +1,78 @@
+package main
+
+//
+// Startup self-test: exercise the allocation path against a scratch bucket
+// so a read-only or corrupt database is found before traffic arrives,
+// rather than by the first real request.
+//
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// Claims an address, writes it to a scratch bucket, reads it back, and
+// releases it again.  Runs before serving starts, so nothing else moves
+// next meanwhile and it can be put back afterwards.
+func (h *Handler) selfTest() error {
+
+	h.mu.Lock()
+	next := h.next
+	ip, ok := h.claim()
+	h.mu.Unlock()
+	if !ok {
+		return errors.New("no free address to test with")
+	}
+	defer func() {
+		h.free(ip)
+		h.mu.Lock()
+		h.next = next
+		h.mu.Unlock()
+	}()
+
+	rec := &record{Address: ip, Allocated: h.now()}
+	v, err := rec.encode()
+	if err != nil {
+		return err
+	}
+
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(h.buckets.selftest)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("probe"), v)
+	})
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	err = h.db.View(func(tx *bolt.Tx) error {
+		got, err := decodeRecord(tx.Bucket(h.buckets.selftest).
+			Get([]byte("probe")))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got.Address, ip) {
+			return errors.New("read back " + got.Address.String() +
+				", wrote " + ip.String())
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("read: %s", err)
+	}
+
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(h.buckets.selftest)
+	})
+	if err != nil {
+		return fmt.Errorf("release: %s", err)
+	}
+
+	return nil
+
+}
@@ -0,0 +1,85 @@
+package main
+
+//
+// Graceful shutdown.  On SIGINT or SIGTERM the server stops accepting
+// connections and waits for requests in flight, for up to
+// -shutdown-timeout, after which whatever's left is closed regardless, so
+// a long-lived connection can't keep the process from exiting.  The
+// database is closed either way.
+//
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Connections open, maintained by trackConn.
+var openConns atomic.Int64
+
+// Counts connections as they open and close; the server's ConnState hook.
+func trackConn(c net.Conn, state http.ConnState) {
+
+	switch state {
+	case http.StateNew:
+		openConns.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		openConns.Add(-1)
+	}
+
+}
+
+// Waits for a termination signal, then shuts the servers down together,
+// allowing them timeout to finish, and closes the database.
+func (h *Handler) awaitShutdown(servers []*http.Server,
+	timeout time.Duration) {
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	log.Printf("Received %s, shutting down", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			err := s.Shutdown(ctx)
+			if err == context.DeadlineExceeded {
+				log.Printf("Shutdown of %s timed out after %s "+
+					"with %d connections open, closing "+
+					"them", s.Addr, timeout,
+					openConns.Load())
+				s.Close()
+			} else if err != nil {
+				log.Printf("Shutdown of %s: %s", s.Addr, err)
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	if h.writeBack != nil {
+		err := h.writeBack.Close()
+		if err != nil {
+			log.Printf("Closing database: %s", err)
+		}
+	} else if h.isActive() {
+		err := h.db.Close()
+		if err != nil {
+			log.Printf("Closing database: %s", err)
+		}
+	}
+
+	log.Print("Shut down")
+
+}
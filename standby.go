@@ -0,0 +1,226 @@
+package main
+
+//
+// Active/passive operation over a shared database file.  Bolt holds an
+// exclusive lock on the file while it's open, so of several instances
+// pointed at the same file (e.g. on a shared volume) exactly one can open
+// it: that one is the leader.  With -cold-standby, the others start
+// serving straight away but answer 503 until the leader goes away and they
+// win the lock, at which point the allocation state is re-derived from the
+// database before anything is allocated.
+//
+// The standby is cold: it serves no reads either, only /healthz, /readyz
+// and /metrics, since it can't open the file at all while the leader has
+// it, not even read-only, as Bolt's shared lock waits on the leader's
+// exclusive one.  Reads during a failover wait for the takeover.
+//
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// How long each attempt to take the database lock waits.
+const lockWait = time.Second
+
+// With -durability=relaxed, how often the database is synced to disk.
+const syncInterval = time.Second
+
+// Opens the database, waiting for the lock if standby is set, then loads
+// each pool's allocation state and begins serving.
+func (ps *poolSet) open(path string, standby bool) error {
+
+	h := ps.handlers[0]
+
+	opts := &bolt.Options{}
+	if standby {
+		opts.Timeout = lockWait
+	}
+
+	var db *bolt.DB
+	var readOnly bool
+	waiting := false
+	for {
+		var err error
+		db, readOnly, err = openDatabase(path, opts, h.onReadOnly)
+		if err == nil {
+			db.NoSync = h.relaxed
+			break
+		}
+		if !standby || err != bolt.ErrTimeout {
+			return err
+		}
+		if !waiting {
+			log.Printf("Standby: %s is locked by the active "+
+				"instance, waiting", path)
+			waiting = true
+		}
+	}
+
+	if h.inMemory {
+		if readOnly {
+			db.Close()
+			return errors.New("-in-memory needs a writable database")
+		}
+		wb, err := newWriteBack(db)
+		if err != nil {
+			db.Close()
+			return err
+		}
+		h.writeBack = wb
+		db = wb.mem
+		if h.flushInterval > 0 {
+			go wb.flusher(h.flushInterval)
+		}
+	} else if h.relaxed {
+		go syncer(db)
+	}
+
+	if h.backupDir != "" {
+		go h.backups(db)
+	}
+
+	for _, h := range ps.handlers {
+		h.db = db
+		h.readOnly.Store(readOnly)
+		err := h.start()
+		if err != nil {
+			return err
+		}
+	}
+
+	if waiting {
+		log.Printf("Standby: took over %s, now active", path)
+	}
+
+	return nil
+
+}
+
+// Loads allocation state from the database, now it's open, and begins
+// serving.
+func (h *Handler) start() error {
+
+	err := h.loadPoolEnd()
+	if err != nil {
+		return err
+	}
+
+	err = h.checkPool()
+	if err != nil {
+		return err
+	}
+
+	// Find next available IP address.
+	err = h.scan()
+	if err != nil {
+		return err
+	}
+
+	if h.selfTesting && !h.isReadOnly() {
+		err = h.selfTest()
+		switch {
+		case isReadOnly(err) && h.onReadOnly == "serve":
+			log.Printf("Warning: self-test: %s, serving read-only",
+				err)
+			h.readOnly.Store(true)
+		case err != nil:
+			return fmt.Errorf("self-test failed: %s", err)
+		default:
+			fmt.Println("Self-test passed")
+		}
+	}
+
+	if !h.isReadOnly() {
+		err = h.holdReserved()
+		if err != nil {
+			return err
+		}
+	}
+
+	if h.reservations != "" && !h.isReadOnly() {
+		err = h.loadReservations()
+		if err != nil {
+			return err
+		}
+	}
+
+	if h.set != nil && len(h.set.handlers) > 1 {
+		fmt.Printf("Pool %s: next free address is %s\n", h.name,
+			h.currentNext())
+	} else {
+		fmt.Printf("Next free address is %s\n", h.currentNext())
+	}
+	h.checkThreshold()
+
+	// Read-only, nothing can be reclaimed or purged.
+	if h.isReadOnly() {
+		h.active.Store(true)
+		return nil
+	}
+
+	if h.reuseCooldown > 0 {
+		go h.cooler()
+	}
+
+	if h.idempotencyTTL > 0 {
+		go h.purgeIdempotency()
+	}
+
+	// Reclaim expired leases and drop old tombstones.
+	if h.ttl > 0 || h.maxTTL > 0 || h.tombstoneTTL > 0 {
+		go h.reap()
+	}
+
+	// Reclaim the addresses of expired certificates.
+	if h.reclaimCerts {
+		go h.reapCerts()
+	}
+
+	h.active.Store(true)
+
+	return nil
+
+}
+
+// Returns the next address to be allocated from the end of the pool.
+func (h *Handler) currentNext() string {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.next >= h.pool.size() {
+		return "none"
+	}
+
+	return h.pool.address(h.next).String()
+
+}
+
+// Reports whether the instance is serving, as opposed to waiting in
+// standby for the database.
+func (h *Handler) isActive() bool {
+	return h.active.Load()
+}
+
+// Reports whether the database is read-only.
+func (h *Handler) isReadOnly() bool {
+	return h.readOnly.Load()
+}
+
+// With -durability=relaxed, commits don't fsync, so this does it
+// periodically, bounding what a crash can lose.
+func syncer(db *bolt.DB) {
+
+	for range time.Tick(syncInterval) {
+		err := db.Sync()
+		if err != nil {
+			log.Printf("Database sync failed: %s", err)
+		}
+	}
+
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// A cold standby answers health checks and metrics, and 503 to everything
+// else, reads included.
+func TestColdStandby(t *testing.T) {
+
+	h := newTestHandler(t, nil)
+	expect(t, h, "GET", "/get/host", "dev1", http.StatusOK)
+	h.active.Store(false)
+
+	tests := []struct {
+		method string
+		target string
+		code   int
+	}{
+		{"GET", "/healthz", http.StatusOK},
+		{"GET", "/readyz", http.StatusServiceUnavailable},
+		{"GET", "/get/host", http.StatusServiceUnavailable},
+		{"GET", "/all", http.StatusServiceUnavailable},
+		{"GET", "/lookup/10.1.0.1", http.StatusServiceUnavailable},
+		{"GET", "/nowhere", http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range tests {
+		w := do(t, h, tc.method, tc.target, "dev1", "")
+		if w.Code != tc.code {
+			t.Errorf("%s %s: got %d, want %d", tc.method, tc.target,
+				w.Code, tc.code)
+		}
+		if tc.code == http.StatusServiceUnavailable &&
+			w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s %s: no Retry-After", tc.method, tc.target)
+		}
+	}
+
+}
@@ -0,0 +1,43 @@
+package main
+
+//
+// Bolt database statistics, for deciding when the file needs compacting.
+//
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+)
+
+// Returns database statistics, and key and page counts for each bucket.
+func (h *Handler) ServeStats(w http.ResponseWriter, r *http.Request) {
+
+	stats := struct {
+		DB      bolt.Stats                  `json:"db"`
+		Size    int64                       `json:"size"`
+		Buckets map[string]bolt.BucketStats `json:"buckets"`
+	}{
+		DB:      h.db.Stats(),
+		Buckets: map[string]bolt.BucketStats{},
+	}
+
+	err := h.db.View(func(tx *bolt.Tx) error {
+		stats.Size = tx.Size()
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			stats.Buckets[string(name)] = b.Stats()
+			return nil
+		})
+	})
+	if err != nil {
+		writeLookupFailed(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(stats)
+	return
+
+}
@@ -0,0 +1,82 @@
+package main
+
+//
+// Tenants.  With -tenant, each client belongs to a tenant, taken from its
+// certificate's first OU or, behind a proxy which sets it, the X-Tenant
+// header, and device names are the tenant's own: two tenants can both
+// have a "gateway", with separate addresses from the shared pool.  A
+// device is stored under tenant:device, and the endpoints about devices
+// only ever see the client's tenant's, so one tenant can't read or release
+// another's.  Events, logs and hooks carry the stored tenant:device name.
+// /export crosses tenants, so with -tenant it's for admins only.
+//
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// A tenant name: no colon, which separates it from the device name, nor
+// slash or control characters.
+var tenantName = regexp.MustCompile(`^[^:/\x00-\x1f\x7f]{1,64}$`)
+
+// Returns the tenant a request is from, or "" if it has none.
+func (h *Handler) tenantOf(r *http.Request) string {
+
+	var t string
+	switch h.tenantFrom {
+	case "ou":
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			ou := r.TLS.PeerCertificates[0].Subject.OrganizationalUnit
+			if len(ou) > 0 {
+				t = ou[0]
+			}
+		}
+	case "header":
+		t = r.Header.Get("X-Tenant")
+	}
+
+	if !tenantName.MatchString(t) {
+		return ""
+	}
+
+	return t
+
+}
+
+// Returns the stored name for a device of the request's tenant.  Without
+// -tenant, that's the device name.
+func (h *Handler) scoped(r *http.Request, device string) string {
+
+	if h.tenantFrom == "" || device == "" {
+		return device
+	}
+
+	return h.tenantOf(r) + ":" + device
+
+}
+
+// Returns the request's tenant's device name for a stored name, and
+// whether it's the tenant's at all.
+func (h *Handler) unscoped(r *http.Request, key string) (string, bool) {
+
+	if h.tenantFrom == "" {
+		return key, true
+	}
+
+	return strings.CutPrefix(key, h.tenantOf(r)+":")
+
+}
+
+// Returns the device name part of a stored name, whatever its tenant.
+func (h *Handler) bareDevice(key string) string {
+
+	if h.tenantFrom == "" {
+		return key
+	}
+
+	_, device, _ := strings.Cut(key, ":")
+	return device
+
+}
@@ -0,0 +1,38 @@
+package main
+
+//
+// Early warning of exhaustion.  With -warn-threshold set, the pool's
+// utilisation is checked after every change, from the bitmap's count so
+// it's cheap, and crossing the threshold is logged, raises the
+// addr_alloc_pool_near_exhaustion gauge and emits a pool_low event, giving
+// time to enlarge the pool before allocations start failing.  Dropping
+// back below it resets the warning.
+//
+
+import (
+	"log"
+)
+
+// Warns if the pool has just passed the threshold, or clears the warning
+// if it's dropped back below.
+func (h *Handler) checkThreshold() {
+
+	if h.warnThreshold <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	pct := 100 * float64(h.used.count) / float64(h.pool.size())
+	crossed := pct >= h.warnThreshold && !h.nearExhaustion
+	h.nearExhaustion = pct >= h.warnThreshold
+	h.mu.Unlock()
+
+	if !crossed {
+		return
+	}
+
+	log.Printf("Pool %s is %.1f%% allocated, past -warn-threshold of "+
+		"%g%%", h.name, pct, h.warnThreshold)
+	h.emit(&event{Type: eventPoolLow, Pool: h.name, Utilisation: pct})
+
+}
@@ -0,0 +1,112 @@
+package main
+
+//
+// TLS policy: the oldest protocol version accepted, and optionally which
+// cipher suites may be negotiated for TLS 1.2 and below.  TLS 1.3 suites
+// aren't configurable in Go, and are all considered secure.  The server's
+// certificate is checked on startup and when it's reloaded, so swapped
+// files or the wrong CA are found then rather than as handshakes failing.
+//
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TLS versions by name.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Parses a TLS version such as 1.2.
+func parseTLSVersion(s string) (uint16, error) {
+
+	v, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("bad TLS version %s, use 1.0, 1.1, 1.2 "+
+			"or 1.3", s)
+	}
+
+	return v, nil
+
+}
+
+// Parses a comma-separated list of cipher suite names, as Go names them,
+// e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256.  Only suites Go considers
+// secure are accepted.
+func parseCipherSuites(s string) ([]uint16, error) {
+
+	known := map[string]uint16{}
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+	insecure := map[string]bool{}
+	for _, cs := range tls.InsecureCipherSuites() {
+		insecure[cs.Name] = true
+	}
+
+	ids := []uint16{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if insecure[name] {
+			return nil, fmt.Errorf("cipher suite %s is insecure",
+				name)
+		}
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+
+}
+
+// Checks the server's certificate and key go together, and that the
+// certificate is currently valid and chains to the CA clients are verified
+// against, which is also the one they're expected to trust.
+func checkServerCert(certFile, keyFile string, roots *x509.CertPool) error {
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range pair.Certificate[1:] {
+		ic, err := x509.ParseCertificate(c)
+		if err != nil {
+			return err
+		}
+		intermediates.AddCert(ic)
+	}
+
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		var unknown x509.UnknownAuthorityError
+		if errors.As(err, &unknown) {
+			return fmt.Errorf("%s, %s, isn't signed by the CA",
+				certFile, leaf.Subject)
+		}
+		return fmt.Errorf("%s: %s", certFile, err)
+	}
+
+	return nil
+
+}
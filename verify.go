@@ -0,0 +1,63 @@
+package main
+
+//
+// Verifying that the server agrees with a client about its allocation, so
+// a client can notice the server has lost or changed it, e.g. after a
+// restore, and re-provision.
+//
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+)
+
+// Compares a device's allocation with the address given as ?expect=.
+// Answers 200 if they agree, 409 with the address held if they don't, and
+// 404 if the device holds none.  Never allocates.
+func (h *Handler) ServeVerify(w http.ResponseWriter, r *http.Request,
+	device string) {
+
+	if device == "" {
+		writeError(w, r, http.StatusBadRequest,
+			"No device name given, use "+
+				"/verify/<device>?expect=<address>.")
+		return
+	}
+
+	expect := parseIPv4(r.URL.Query().Get("expect"))
+	if expect == nil {
+		writeError(w, r, http.StatusBadRequest,
+			"Give the expected address as ?expect=<address>.")
+		return
+	}
+
+	var rec *record
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		rec, err = h.getAllocation(tx, device)
+		return err
+	})
+	if err != nil {
+		writeLookupFailed(w, r)
+		return
+	}
+
+	if rec == nil {
+		writeError(w, r, http.StatusNotFound,
+			"Device holds no address.")
+		return
+	}
+	if !rec.Address.Equal(expect) {
+		writeError(w, r, http.StatusConflict,
+			"Device holds "+rec.Address.String()+".")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, rec.Address.String())
+	return
+
+}
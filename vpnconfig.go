@@ -0,0 +1,106 @@
+package main
+
+//
+// VPN configuration generated from allocations.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Returns an OpenVPN client-config-dir fragment pushing the device's
+// address, allocating one if it's new, headed by comments naming and
+// describing the device.
+func (h *Handler) ServeOpenVPN(w http.ResponseWriter, r *http.Request,
+	device string) {
+
+	if device == "" {
+		writeError(w, r, http.StatusBadRequest,
+			"No device name given, use /openvpn-ccd/<device>.")
+		return
+	}
+
+	// The fragment is saved in the client-config-dir, named after the
+	// device, so the name must be a plain file name.
+	if err := fileSafe(h.bareDevice(device)); err != nil {
+		writeError(w, r, http.StatusBadRequest,
+			"Bad device name: "+err.Error()+".")
+		return
+	}
+
+	rec, ok := h.getOrAllocate(w, r, device)
+	if !ok {
+		return
+	}
+	h.setLease(w, r, device, rec)
+
+	mask := net.IP(h.network().Mask)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "# %s\n%s", sanitiseComment(h.bareDevice(device)),
+		configComments("#", rec))
+	fmt.Fprintf(w, "ifconfig-push %s %s\n", rec.Address, mask)
+	return
+
+}
+
+// An interface configuration, as /ifconfig/ returns it.
+type ifconfig struct {
+	Device  string   `json:"device"`
+	Address string   `json:"address"`
+	Prefix  int      `json:"prefix"`
+	Netmask string   `json:"netmask"`
+	Gateway string   `json:"gateway"`
+	DNS     []string `json:"dns"`
+	MTU     int      `json:"mtu,omitempty"`
+}
+
+// Returns the gateway for a network: its first host address.
+func gateway(n *net.IPNet) net.IP {
+	return uintToIP(ipToUint(n.IP.Mask(n.Mask).To4()) + 1)
+}
+
+// Returns a device's whole interface configuration as JSON, allocating an
+// address if it's new: the address and prefix length of the network,
+// the network's first address as the gateway, and the -dns servers and
+// -mtu.
+func (h *Handler) ServeIfconfig(w http.ResponseWriter, r *http.Request,
+	device string) {
+
+	if device == "" {
+		writeError(w, r, http.StatusBadRequest,
+			"No device name given, use /ifconfig/<device>.")
+		return
+	}
+
+	rec, ok := h.getOrAllocate(w, r, device)
+	if !ok {
+		return
+	}
+	h.setLease(w, r, device, rec)
+
+	n := h.network()
+	prefix, _ := n.Mask.Size()
+	cfg := &ifconfig{
+		Device:  h.bareDevice(device),
+		Address: rec.Address.String(),
+		Prefix:  prefix,
+		Netmask: net.IP(n.Mask).String(),
+		Gateway: gateway(n).String(),
+		DNS:     []string{},
+		MTU:     h.mtu,
+	}
+	for _, ip := range h.dns {
+		cfg.DNS = append(cfg.DNS, ip.String())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(cfg)
+	return
+
+}
@@ -0,0 +1,145 @@
+package main
+
+//
+// Webhooks.  With -webhook, every event is POSTed as JSON, the event as the
+// event stream carries it, to each URL given, so a firewall rule generator
+// or DNS updater can be told of changes without polling.  Each URL has its
+// own queue, so a slow receiver doesn't hold up the others, and a delivery
+// which fails is retried with backoff before it's dropped and logged.
+// With -webhook-secret, each request carries X-Addr-Alloc-Signature,
+// sha256= then the hex HMAC-SHA256 of the body under the secret, for the
+// receiver to check.
+//
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+
+	// Events queued for a receiver before more are dropped.
+	webhookQueue = 1000
+
+	// Deliveries attempted for each event, and the wait after the first
+	// failure, doubling after each.
+	webhookAttempts = 5
+	webhookBackoff  = time.Second
+
+	// Time allowed for each delivery.
+	webhookTimeout = 10 * time.Second
+)
+
+// Receivers events are POSTed to.
+type webhooks struct {
+	secret  []byte
+	client  *http.Client
+	targets []*webhookTarget
+}
+
+// A receiver and the events waiting for it.
+type webhookTarget struct {
+	url   string
+	queue chan []byte
+}
+
+// Starts delivering to the URLs given, signing with secret if it's not
+// empty.
+func newWebhooks(urls []string, secret string) *webhooks {
+
+	wh := &webhooks{
+		secret: []byte(secret),
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+
+	for _, u := range urls {
+		t := &webhookTarget{url: u, queue: make(chan []byte, webhookQueue)}
+		wh.targets = append(wh.targets, t)
+		go wh.deliver(t)
+	}
+
+	return wh
+
+}
+
+// Queues an event for every receiver, dropping it for those whose queue
+// is full.
+func (wh *webhooks) send(ev *event) {
+
+	b, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Webhook: %s", err)
+		return
+	}
+
+	for _, t := range wh.targets {
+		select {
+		case t.queue <- b:
+		default:
+			log.Printf("Webhook %s: queue full, dropping %s event "+
+				"for %s", t.url, ev.Type, ev.Device)
+		}
+	}
+
+}
+
+// Delivers a receiver's events in turn, forever.
+func (wh *webhooks) deliver(t *webhookTarget) {
+
+	for body := range t.queue {
+		wait := webhookBackoff
+		var err error
+		for attempt := 1; attempt <= webhookAttempts; attempt++ {
+			err = wh.post(t.url, body)
+			if err == nil {
+				break
+			}
+			if attempt < webhookAttempts {
+				time.Sleep(wait)
+				wait *= 2
+			}
+		}
+		if err != nil {
+			log.Printf("Webhook %s: giving up after %d attempts: %s",
+				t.url, webhookAttempts, err)
+		}
+	}
+
+}
+
+// POSTs an event body once.  Any status but 2xx is a failure.
+func (wh *webhooks) post(url string, body []byte) error {
+
+	req, err := http.NewRequest(http.MethodPost, url,
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(wh.secret) > 0 {
+		mac := hmac.New(sha256.New, wh.secret)
+		mac.Write(body)
+		req.Header.Set("X-Addr-Alloc-Signature",
+			"sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+
+	return nil
+
+}
@@ -0,0 +1,49 @@
+package main
+
+//
+// Reflecting the client's certificate, for debugging mTLS set-ups.
+//
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Returns the client certificate's subject, SANs and serial as JSON, with
+// the identity the server takes from it and whether that's an admin.
+func (h *Handler) ServeWhoami(w http.ResponseWriter, r *http.Request) {
+
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		writeError(w, r, http.StatusUnauthorized,
+			"No client certificate.")
+		return
+	}
+	cert := r.TLS.PeerCertificates[0]
+
+	ips := []string{}
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	uris := []string{}
+	for _, u := range cert.URIs {
+		uris = append(uris, u.String())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"subject":      cert.Subject.String(),
+		"common_name":  cert.Subject.CommonName,
+		"dns_names":    append([]string{}, cert.DNSNames...),
+		"emails":       append([]string{}, cert.EmailAddresses...),
+		"ip_addresses": ips,
+		"uris":         uris,
+		"serial":       cert.SerialNumber.String(),
+		"issuer":       cert.Issuer.String(),
+		"not_after":    cert.NotAfter,
+		"identity":     clientCN(r),
+		"admin":        h.isAdmin(r),
+	})
+	return
+
+}
@@ -0,0 +1,169 @@
+package main
+
+//
+// WireGuard client configuration.  /wireguard/<device> allocates as /get/
+// does and returns the device's config, rendered from -wg-template or the
+// built-in template, with the server's -wg-server-key and -wg-endpoint as
+// its peer.  The device's own public key, given as ?public_key=, is kept
+// with the allocation, so the server's peer list can be built from
+// /export.
+//
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/boltdb/bolt"
+)
+
+// The config returned without -wg-template.
+const defaultWireGuardTemplate = `[Interface]
+# {{.Device}}
+{{.Comments}}Address = {{.Address}}/{{.Prefix}}
+{{- if .DNS}}
+DNS = {{join .DNS ", "}}
+{{- end}}
+{{- if .MTU}}
+MTU = {{.MTU}}
+{{- end}}
+
+[Peer]
+PublicKey = {{.ServerKey}}
+Endpoint = {{.Endpoint}}
+AllowedIPs = {{.Network}}
+`
+
+// What a WireGuard template is given.
+type wireGuardConfig struct {
+
+	// Device name, and comment lines describing it, each starting #.
+	Device   string
+	Comments string
+
+	// The device's address, and its network and prefix length.
+	Address string
+	Network string
+	Prefix  int
+
+	// The device's public key, if known.
+	PublicKey string
+
+	// The server's public key and endpoint.
+	ServerKey string
+	Endpoint  string
+
+	// -dns servers and -mtu, 0 if not given.
+	DNS []string
+	MTU int
+}
+
+// Parses a WireGuard config template.
+func parseWireGuardTemplate(name, text string) (*template.Template, error) {
+
+	return template.New(name).Funcs(template.FuncMap{
+		"join": strings.Join,
+	}).Parse(text)
+
+}
+
+// Reports whether a WireGuard key is well formed: 32 bytes, base64.
+func wireGuardKeyOK(key string) bool {
+
+	b, err := base64.StdEncoding.DecodeString(key)
+
+	return err == nil && len(b) == 32
+
+}
+
+// Returns a device's WireGuard config, allocating an address if it's new,
+// and storing the public key given as ?public_key=.
+func (h *Handler) ServeWireGuard(w http.ResponseWriter, r *http.Request,
+	device string) {
+
+	if h.wgTemplate == nil {
+		writeError(w, r, http.StatusNotFound,
+			"WireGuard is off, start with -wg-server-key and "+
+				"-wg-endpoint.")
+		return
+	}
+
+	if device == "" {
+		writeError(w, r, http.StatusBadRequest,
+			"No device name given, use /wireguard/<device>.")
+		return
+	}
+
+	key := r.URL.Query().Get("public_key")
+	if key != "" && !wireGuardKeyOK(key) {
+		writeError(w, r, http.StatusBadRequest,
+			"Bad ?public_key=, expected a base64 WireGuard key.")
+		return
+	}
+
+	rec, ok := h.getOrAllocate(w, r, device)
+	if !ok {
+		return
+	}
+
+	if key != "" && key != rec.PublicKey {
+		err := h.db.Update(func(tx *bolt.Tx) error {
+			cur, err := h.getAllocation(tx, device)
+			if err != nil {
+				return err
+			}
+			if cur == nil {
+				return errNoDevice
+			}
+			cur.PublicKey = key
+			rec = cur
+			return h.putAllocation(tx, device, cur)
+		})
+		if err == errNoDevice {
+			writeError(w, r, http.StatusNotFound,
+				"Device not found.")
+			return
+		}
+		if err != nil {
+			writeFailed(w, r, err)
+			return
+		}
+		fmt.Printf("Device %s: public key updated\n", device)
+	}
+	h.setLease(w, r, device, rec)
+
+	n := h.network()
+	prefix, _ := n.Mask.Size()
+	cfg := &wireGuardConfig{
+		Device:    sanitiseComment(h.bareDevice(device)),
+		Comments:  configComments("#", rec),
+		Address:   rec.Address.String(),
+		Network:   n.String(),
+		Prefix:    prefix,
+		PublicKey: rec.PublicKey,
+		ServerKey: h.wgServerKey,
+		Endpoint:  h.wgEndpoint,
+		DNS:       []string{},
+		MTU:       h.mtu,
+	}
+	for _, ip := range h.dns {
+		cfg.DNS = append(cfg.DNS, ip.String())
+	}
+
+	var b bytes.Buffer
+	err := h.wgTemplate.Execute(&b, cfg)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError,
+			"Rendering the config failed: "+err.Error()+".")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b.Bytes())
+	return
+
+}